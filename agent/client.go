@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"yuri91/sloop/systemd"
+)
+
+// Client talks to a running agent through its unix socket
+type Client struct {
+	socketPath string
+	http *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}
+	return &Client{
+		socketPath: socketPath,
+		http: &http.Client{Transport: &http.Transport{DialContext: dial}},
+	}
+}
+
+// Available returns true if an agent is listening on the socket
+func (c *Client) Available() bool {
+	if _, err := os.Stat(c.socketPath); err != nil {
+		return false
+	}
+	conn, err := net.Dial("unix", c.socketPath)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (c *Client) do(method string, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return nil, RequestError.Wrap(err, "cannot encode request")
+		}
+	}
+	u := url.URL{Scheme: "http", Host: "sloop", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), &reqBody)
+	if err != nil {
+		return nil, RequestError.Wrap(err, "cannot create request")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, RequestError.Wrap(err, "cannot reach the agent")
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var errResp errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			return nil, RequestError.New("agent returned %s", resp.Status)
+		}
+		if errResp.Config {
+			return nil, ConfigError.New("%s", errResp.Error)
+		}
+		return nil, RequestError.New("%s", errResp.Error)
+	}
+	return resp, nil
+}
+
+func (c *Client) call(method string, path string, query url.Values, body interface{}, result interface{}) error {
+	resp, err := c.do(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return RequestError.Wrap(err, "cannot decode response from %s", path)
+	}
+	return nil
+}
+
+// Apply asks the agent to apply the configuration in confDir
+func (c *Client) Apply(confDir string) (*systemd.Changes, error) {
+	var changes systemd.Changes
+	err := c.call(http.MethodPost, "/apply", nil, applyRequest{confDir}, &changes)
+	if err != nil {
+		return nil, err
+	}
+	return &changes, nil
+}
+
+func (c *Client) Plan(confDir string) (*systemd.Plan, error) {
+	var plan systemd.Plan
+	err := c.call(http.MethodGet, "/plan", url.Values{"conf": {confDir}}, nil, &plan)
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func (c *Client) Status() ([]systemd.UnitStatus, error) {
+	var statuses []systemd.UnitStatus
+	err := c.call(http.MethodGet, "/status", nil, nil, &statuses)
+	return statuses, err
+}
+
+func (c *Client) Logs(unit string, lines int) ([]string, error) {
+	var logs []string
+	err := c.call(http.MethodGet, "/logs", url.Values{"unit": {unit}, "lines": {strconv.Itoa(lines)}}, nil, &logs)
+	return logs, err
+}
+
+func (c *Client) Restart(unit string) error {
+	return c.call(http.MethodPost, "/restart", url.Values{"unit": {unit}}, nil, nil)
+}
+
+// Events calls handler for every unit state change reported by the agent,
+// until the connection is closed
+func (c *Client) Events(handler func(systemd.UnitEvent)) error {
+	resp, err := c.do(http.MethodGet, "/events", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var ev systemd.UnitEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return RequestError.Wrap(err, "cannot decode event %s", scanner.Text())
+		}
+		handler(ev)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,13 @@
+package agent
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	AgentErrors = errorx.NewNamespace("agent")
+
+	ListenError = AgentErrors.NewType("listen")
+	RequestError = AgentErrors.NewType("request")
+	ConfigError = AgentErrors.NewType("config")
+)
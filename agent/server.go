@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+
+	"yuri91/sloop/cue"
+	"yuri91/sloop/diag"
+	"yuri91/sloop/metrics"
+	"yuri91/sloop/systemd"
+	"yuri91/sloop/validate"
+)
+
+// Server keeps the configuration and the connection to systemd open,
+// and serves the control API on a unix socket
+type Server struct {
+	confDir string
+	systemd *dbus.Conn
+
+	// mu serializes the operations that read or change the configuration
+	mu sync.Mutex
+	config *cue.Config
+	// units is the configuration the unit signals are filtered with. It
+	// is not guarded by mu, which is held while applying: the signals
+	// must be handled for the jobs of the apply to complete.
+	units atomic.Pointer[cue.Config]
+
+	subsMu sync.Mutex
+	subs map[chan systemd.UnitEvent]bool
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Config bool `json:"config,omitempty"`
+}
+
+type applyRequest struct {
+	Conf string `json:"conf"`
+}
+
+func NewServer(confDir string) (*Server, error) {
+	conn, err := systemd.Connect()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		confDir: confDir,
+		systemd: conn,
+		subs: make(map[chan systemd.UnitEvent]bool),
+	}
+	return s, nil
+}
+
+func (s *Server) Close() {
+	s.systemd.Close()
+}
+
+// Serve listens on socketPath and serves the API until an error occurs
+func (s *Server) Serve(socketPath string) error {
+	// The configuration may not be valid yet, it will be loaded
+	// again on the first request that needs it
+	if config, err := cue.GetConfig(s.confDir); err == nil {
+		s.setConfig(config)
+	}
+
+	events := make(chan systemd.UnitEvent, 64)
+	errs, err := systemd.Subscribe(s.systemd, s.isConfigUnit, events)
+	if err != nil {
+		return err
+	}
+	go s.broadcast(events)
+	go func() {
+		for range errs {
+			// Errors on single units are not fatal for the stream
+		}
+	}()
+
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return ListenError.Wrap(err, "cannot create socket directory")
+	}
+	os.Remove(socketPath)
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return ListenError.Wrap(err, "cannot listen on %s", socketPath)
+	}
+	defer l.Close()
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return ListenError.Wrap(err, "cannot set permissions of %s", socketPath)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apply", s.handleApply)
+	mux.HandleFunc("/plan", s.handlePlan)
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/logs", s.handleLogs)
+	mux.HandleFunc("/restart", s.handleRestart)
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	return http.Serve(l, mux)
+}
+
+// setConfig changes the configuration. s.mu must be held, if the server
+// is serving.
+func (s *Server) setConfig(config *cue.Config) {
+	s.config = config
+	s.units.Store(config)
+}
+
+func (s *Server) isConfigUnit(name string) bool {
+	config := s.units.Load()
+	if config == nil {
+		return strings.HasPrefix(name, "sloop")
+	}
+	for _, u := range systemd.ConfigUnits(*config) {
+		if u == name {
+			return true
+		}
+	}
+	// ConfigUnits has the templates of replicated services, not their
+	// instances
+	for _, svc := range config.Services {
+		for _, u := range svc.Units() {
+			if u == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) broadcast(events <-chan systemd.UnitEvent) {
+	for ev := range events {
+		s.subsMu.Lock()
+		for sub := range s.subs {
+			select {
+			case sub <- ev:
+			default:
+				// Slow clients lose events instead of blocking everyone
+			}
+		}
+		s.subsMu.Unlock()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if diags, ok := diag.FromError(err); ok {
+		writeJSON(w, http.StatusUnprocessableEntity, errorResponse{diag.Text(diags), true})
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return false
+	}
+	return true
+}
+
+// loadConfig reads the configuration from confDir, or from the directory
+// the agent was started with if it is empty
+func (s *Server) loadConfig(confDir string) (*cue.Config, error) {
+	if confDir == "" {
+		confDir = s.confDir
+	}
+	config, violations, err := validate.Load(confDir)
+	if err != nil {
+		return nil, err
+	}
+	return config, validate.Error(violations)
+}
+
+// currentConfig returns the last applied configuration, loading it if
+// there is none yet. s.mu must be held.
+func (s *Server) currentConfig() (*cue.Config, error) {
+	if s.config == nil {
+		config, err := s.loadConfig("")
+		if err != nil {
+			return nil, err
+		}
+		s.setConfig(config)
+	}
+	return s.config, nil
+}
+
+func (s *Server) handleApply(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req applyRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, err := s.loadConfig(req.Conf)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	changes, err := systemd.Apply(s.systemd, *config)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.setConfig(config)
+	writeJSON(w, http.StatusOK, changes)
+}
+
+func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, err := s.loadConfig(r.URL.Query().Get("conf"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	plan, err := systemd.GetPlan(*config)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, err := s.currentConfig()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	statuses, err := systemd.Status(s.systemd, *config)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	unit := r.URL.Query().Get("unit")
+	if !s.isConfigUnit(unit) {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "unknown unit " + unit})
+		return
+	}
+	lines := 100
+	if l := r.URL.Query().Get("lines"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid lines " + l})
+			return
+		}
+		lines = n
+	}
+	logs, err := systemd.Logs(unit, lines)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, logs)
+}
+
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	unit := r.URL.Query().Get("unit")
+	if !s.isConfigUnit(unit) {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "unknown unit " + unit})
+		return
+	}
+	err := systemd.Restart(s.systemd, unit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "streaming not supported"})
+		return
+	}
+	sub := make(chan systemd.UnitEvent, 64)
+	s.subsMu.Lock()
+	s.subs[sub] = true
+	s.subsMu.Unlock()
+	defer func() {
+		s.subsMu.Lock()
+		delete(s.subs, sub)
+		s.subsMu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-sub:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, err := s.currentConfig()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	collector := metrics.Collector{Systemd: s.systemd, NetRoot: "/sys/class/net"}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	collector.Write(w, *config)
+}
@@ -0,0 +1,125 @@
+package cgroup
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Root is the mount point of the cgroup v2 hierarchy.
+// It can be changed to point to a fake hierarchy.
+var Root string = "/sys/fs/cgroup"
+
+type Stats struct {
+	MemoryCurrent uint64
+	CPUUsageUsec uint64
+	CPUUserUsec uint64
+	CPUSystemUsec uint64
+	IOReadBytes uint64
+	IOWriteBytes uint64
+	IOReads uint64
+	IOWrites uint64
+	PIDs uint64
+}
+
+// ServicePath returns the cgroup directory of a sloop service
+func ServicePath(service string) string {
+	return filepath.Join(Root, "sloop.slice", service+".service")
+}
+
+// ReadUint reads a file with a single unsigned number, like the files of
+// cgroups and sysfs
+func ReadUint(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, ReadError.Wrap(err, "cannot read %s", path)
+	}
+	s := strings.TrimSpace(string(b))
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, ReadError.Wrap(err, "invalid value %q in %s", s, path)
+	}
+	return n, nil
+}
+
+// readKeyValues parses files made of lines of space separated "key value"
+// or "key=value" pairs, like cpu.stat and io.stat, calling fn for each pair
+func readKeyValues(path string, fn func(key string, value uint64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return ReadError.Wrap(err, "cannot read %s", path)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i := 0; i < len(fields); i++ {
+			key, value, found := strings.Cut(fields[i], "=")
+			if !found {
+				// A device name, like in io.stat
+				if i+1 >= len(fields) || strings.Contains(fields[i+1], "=") {
+					continue
+				}
+				value = fields[i+1]
+				i++
+			}
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			fn(key, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ReadError.Wrap(err, "cannot read %s", path)
+	}
+	return nil
+}
+
+// ReadStats reads the resource usage of a sloop service from its cgroup
+func ReadStats(service string) (*Stats, error) {
+	p := ServicePath(service)
+	var stats Stats
+	var err error
+
+	stats.MemoryCurrent, err = ReadUint(filepath.Join(p, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+	stats.PIDs, err = ReadUint(filepath.Join(p, "pids.current"))
+	if err != nil {
+		return nil, err
+	}
+	err = readKeyValues(filepath.Join(p, "cpu.stat"), func(key string, value uint64) {
+		switch key {
+		case "usage_usec":
+			stats.CPUUsageUsec = value
+		case "user_usec":
+			stats.CPUUserUsec = value
+		case "system_usec":
+			stats.CPUSystemUsec = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// io.stat has one line per device, sum them up
+	err = readKeyValues(filepath.Join(p, "io.stat"), func(key string, value uint64) {
+		switch key {
+		case "rbytes":
+			stats.IOReadBytes += value
+		case "wbytes":
+			stats.IOWriteBytes += value
+		case "rios":
+			stats.IOReads += value
+		case "wios":
+			stats.IOWrites += value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -0,0 +1,12 @@
+package cgroup
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	CgroupErrors = errorx.NewNamespace("cgroup")
+
+	ReadError = CgroupErrors.NewType("read")
+	FreezeError = CgroupErrors.NewType("freeze")
+)
@@ -0,0 +1,133 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FreezeTimeout is how long Freeze and Thaw wait for the kernel to
+// report the new state of the cgroup
+var FreezeTimeout = 10 * time.Second
+
+// Frozen returns true if the cgroup of a sloop service is frozen
+func Frozen(service string) (bool, error) {
+	frozen := false
+	err := readKeyValues(filepath.Join(ServicePath(service), "cgroup.events"), func(key string, value uint64) {
+		if key == "frozen" {
+			frozen = value == 1
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	return frozen, nil
+}
+
+// setFrozen writes the freezer state of a cgroup, and waits until the
+// processes in it are actually frozen or thawed
+func setFrozen(service string, frozen bool) error {
+	value := "0"
+	if frozen {
+		value = "1"
+	}
+	p := filepath.Join(ServicePath(service), "cgroup.freeze")
+	err := os.WriteFile(p, []byte(value), 0644)
+	if err != nil {
+		return FreezeError.Wrap(err, "cannot write %s", p)
+	}
+	deadline := time.Now().Add(FreezeTimeout)
+	for {
+		f, err := Frozen(service)
+		if err != nil {
+			return err
+		}
+		if f == frozen {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return FreezeError.New("timeout waiting for %s to be %s", service, map[bool]string{true: "frozen", false: "thawed"}[frozen])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Freeze suspends all the processes of a sloop service
+func Freeze(service string) error {
+	return setFrozen(service, true)
+}
+
+// Thaw resumes the processes of a sloop service frozen with Freeze
+func Thaw(service string) error {
+	return setFrozen(service, false)
+}
+
+// Running returns true if a sloop service has a cgroup, that is if it
+// is running
+func Running(service string) bool {
+	_, err := os.Stat(filepath.Join(ServicePath(service), "cgroup.freeze"))
+	return err == nil
+}
+
+// ListFrozen returns the sloop services that are frozen, sorted by name
+func ListFrozen() ([]string, error) {
+	dirs, err := os.ReadDir(filepath.Join(Root, "sloop.slice"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ReadError.Wrap(err, "cannot list sloop services")
+	}
+	var frozen []string
+	for _, d := range dirs {
+		if !d.IsDir() || !strings.HasSuffix(d.Name(), ".service") {
+			continue
+		}
+		service := strings.TrimSuffix(d.Name(), ".service")
+		f, err := Frozen(service)
+		if err != nil {
+			return nil, err
+		}
+		if f {
+			frozen = append(frozen, service)
+		}
+	}
+	sort.Strings(frozen)
+	return frozen, nil
+}
+
+// FreezeServices freezes the services that are running and not frozen
+// yet, so that their files do not change while they are copied. It
+// returns a function that thaws them again.
+func FreezeServices(services []string) (func() error, error) {
+	var frozen []string
+	thaw := func() error {
+		var err error
+		for i := len(frozen) - 1; i >= 0; i-- {
+			if e := Thaw(frozen[i]); e != nil && err == nil {
+				err = e
+			}
+		}
+		frozen = nil
+		return err
+	}
+	for _, s := range services {
+		if !Running(s) {
+			continue
+		}
+		f, err := Frozen(s)
+		if err == nil && !f {
+			err = Freeze(s)
+		}
+		if err != nil {
+			thaw()
+			return nil, err
+		}
+		if !f {
+			frozen = append(frozen, s)
+		}
+	}
+	return thaw, nil
+}
@@ -0,0 +1,150 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRoot makes Root a fake cgroupfs with a cgroup for every service,
+// frozen or not. Services that are not in it are not running.
+func fakeRoot(t *testing.T, services map[string]bool) {
+	old := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = old })
+	for s, frozen := range services {
+		p := ServicePath(s)
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeState(t, s, frozen)
+	}
+}
+
+func writeState(t *testing.T, service string, frozen bool) {
+	value := map[bool]string{true: "1", false: "0"}[frozen]
+	p := ServicePath(service)
+	os.WriteFile(filepath.Join(p, "cgroup.freeze"), []byte(value + "\n"), 0644)
+	os.WriteFile(filepath.Join(p, "cgroup.events"), []byte("populated 1\nfrozen " + value + "\n"), 0644)
+}
+
+// fakeKernel reports in cgroup.events the state written in cgroup.freeze,
+// like the kernel does, until the test ends
+func fakeKernel(t *testing.T, services ...string) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			for _, s := range services {
+				b, err := os.ReadFile(filepath.Join(ServicePath(s), "cgroup.freeze"))
+				if err == nil {
+					// replaced at once, so that readers never see it empty
+					value := strings.TrimSpace(string(b))
+					tmp := filepath.Join(ServicePath(s), "cgroup.events.new")
+					os.WriteFile(tmp, []byte("populated 1\nfrozen " + value + "\n"), 0644)
+					os.Rename(tmp, filepath.Join(ServicePath(s), "cgroup.events"))
+				}
+			}
+		}
+	}()
+}
+
+func frozen(t *testing.T, service string) bool {
+	f, err := Frozen(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFreezeThaw(t *testing.T) {
+	fakeRoot(t, map[string]bool{"web": false})
+	fakeKernel(t, "web")
+	if err := Freeze("web"); err != nil {
+		t.Fatal(err)
+	}
+	if !frozen(t, "web") {
+		t.Fatal("web is not frozen after Freeze")
+	}
+	if err := Thaw("web"); err != nil {
+		t.Fatal(err)
+	}
+	if frozen(t, "web") {
+		t.Fatal("web is frozen after Thaw")
+	}
+}
+
+func TestFreezeTimeout(t *testing.T) {
+	fakeRoot(t, map[string]bool{"web": false})
+	old := FreezeTimeout
+	FreezeTimeout = 50 * time.Millisecond
+	defer func() { FreezeTimeout = old }()
+	err := Freeze("web")
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestRunning(t *testing.T) {
+	fakeRoot(t, map[string]bool{"web": false})
+	if !Running("web") {
+		t.Error("web is not running")
+	}
+	if Running("db") {
+		t.Error("db is running")
+	}
+}
+
+func TestListFrozen(t *testing.T) {
+	fakeRoot(t, map[string]bool{"web": true, "db": false, "cache": true})
+	frozen, err := ListFrozen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(frozen, []string{"cache", "web"}) {
+		t.Fatalf("frozen services are %v", frozen)
+	}
+}
+
+func TestListFrozenWithoutSlice(t *testing.T) {
+	fakeRoot(t, nil)
+	frozen, err := ListFrozen()
+	if err != nil || len(frozen) != 0 {
+		t.Fatalf("got %v, %v", frozen, err)
+	}
+}
+
+func TestFreezeServicesKeepsPaused(t *testing.T) {
+	// db was paused by the user, cache is not running
+	fakeRoot(t, map[string]bool{"web": false, "db": true})
+	fakeKernel(t, "web", "db")
+	thaw, err := FreezeServices([]string{"web", "db", "cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !frozen(t, "web") || !frozen(t, "db") {
+		t.Fatal("services are not frozen")
+	}
+	if err := thaw(); err != nil {
+		t.Fatal(err)
+	}
+	if frozen(t, "web") {
+		t.Error("web is still frozen")
+	}
+	if !frozen(t, "db") {
+		t.Error("db, paused before, was thawed")
+	}
+}
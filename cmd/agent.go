@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/joomcode/errorx"
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/agent"
+	"yuri91/sloop/common"
+	"yuri91/sloop/systemd"
+)
+
+var (
+	agentCmd = &cobra.Command{
+		Use:   "agent",
+		Short: "Run the sloop agent",
+		Long: `Run the sloop agent, that keeps the configuration and the systemd connection open and serves a local control API`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAgent()
+		},
+	}
+	agentInstallCmd = &cobra.Command{
+		Use:   "install",
+		Short: "Install the sloop agent as a systemd service",
+		Long: `Install the sloop agent as a systemd service, using the current configuration directory`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return installAgent()
+		},
+	}
+)
+
+func init() {
+	agentCmd.AddCommand(agentInstallCmd)
+}
+
+const agentUnitStr = `
+[Unit]
+Description=Sloop agent
+After=network-online.target
+
+[Service]
+ExecStart={{.Exe}} agent --conf {{.Conf}}
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
+
+var agentUnitTemplate *template.Template = template.Must(template.New("agent").Parse(agentUnitStr))
+
+func runAgent() error {
+	server, err := agent.NewServer(common.ConfPath)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	fmt.Printf("Listening on %s\n", common.AgentSocketPath)
+	return server.Serve(common.AgentSocketPath)
+}
+
+func installAgent() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	unitP := filepath.Join("/etc/systemd/system", "sloop-agent.service")
+	f, err := os.Create(unitP)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = agentUnitTemplate.Execute(f, struct{ Exe, Conf string }{exe, common.ConfPath})
+	if err != nil {
+		return err
+	}
+
+	systemd, err := systemd.Connect()
+	if err != nil {
+		return err
+	}
+	defer systemd.Close()
+	if err = systemd.ReloadContext(context.Background()); err != nil {
+		return err
+	}
+	_, _, err = systemd.EnableUnitFilesContext(context.Background(), []string{"sloop-agent.service"}, false, true)
+	if err != nil {
+		return err
+	}
+	wait := make(chan string)
+	_, err = systemd.RestartUnitContext(context.Background(), "sloop-agent.service", "replace", wait)
+	if err != nil {
+		return err
+	}
+	if res := <-wait; res != "done" {
+		return fmt.Errorf("cannot start sloop-agent.service: %s", res)
+	}
+	fmt.Printf("Installed %s\n", unitP)
+	return nil
+}
+
+// agentClient returns a client for the running agent, or nil if there is none
+func agentClient() *agent.Client {
+	client := agent.NewClient(common.AgentSocketPath)
+	if !client.Available() {
+		return nil
+	}
+	return client
+}
+
+// printAgentError prints err if it is an error in the configuration
+// reported by the agent, and returns true in that case
+func printAgentError(err error) bool {
+	if errx, ok := err.(*errorx.Error); ok && errx.IsOfType(agent.ConfigError) {
+		fmt.Print(errx.Message())
+		return true
+	}
+	return false
+}
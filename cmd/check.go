@@ -4,39 +4,85 @@ import (
 	"fmt"
 	"os"
 
-	"cuelang.org/go/cue/errors"
-	"github.com/joomcode/errorx"
 	//"github.com/kr/pretty"
 	"github.com/spf13/cobra"
 
 	"yuri91/sloop/cue"
+	"yuri91/sloop/diag"
+	"yuri91/sloop/validate"
 )
 
 var (
 	checkCmd = &cobra.Command{
 		Use:   "check",
 		Short: "Check the cue configuration",
-		Long: `Check the cue configuration, whithout actually applying it`,
+		Long: `Check the cue configuration, whithout actually applying it.
+Errors are reported with their position, as text or, for CI and editors, as JSON or SARIF.
+Besides the schema, the whole configuration is checked with the rules of
+validation, whose severity can be changed in $validation.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return check()
 		},
 	}
 )
 
+var diagFormat string = "text"
 func init() {
+	checkCmd.Flags().StringVar(&diagFormat, "format", "text", "output format: text, json or sarif")
+}
+
+// printConfigError prints the diagnostics of err if it is an error in
+// the configuration, and returns true in that case
+func printConfigError(err error) bool {
+	diags, ok := diag.FromError(err)
+	if !ok {
+		return false
+	}
+	if err := diag.Write(os.Stdout, diagFormat, diags); err != nil {
+		fmt.Println(err)
+	}
+	return true
+}
+
+// loadValid reads the configuration in path and refuses it if it breaks
+// the rules of validation. The warnings are printed.
+func loadValid(path string) (*cue.Config, error) {
+	config, violations, err := validate.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate.Error(violations); err != nil {
+		return nil, err
+	}
+	if len(violations) > 0 {
+		if err := diag.Write(os.Stdout, diagFormat, diag.FromViolations(violations)); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return config, nil
 }
 
 func check() error {
-	_, err := cue.GetConfig(".")
-	if errx, ok := err.(*errorx.Error); ok && cue.CueErrors.IsNamespaceOf(errx.Type()) {
-		fmt.Printf("Error in configuration: [%s] %s \n", errx.Type().FullName(), errx.Message())
-		fmt.Println(errors.Details(errx.Cause(), nil))
+	_, violations, err := validate.Load(".")
+	if printConfigError(err) {
 		os.Exit(1)
 	}
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Conf is valid!\n")
+	diags := diag.FromViolations(violations)
+	if len(diags) > 0 || diagFormat != "text" {
+		err = diag.Write(os.Stdout, diagFormat, diags)
+		if err != nil {
+			return err
+		}
+	}
+	if diag.HasErrors(diags) {
+		os.Exit(1)
+	}
+	if diagFormat == "text" {
+		fmt.Printf("Conf is valid!\n")
+	}
 	//fmt.Printf("%# v\n", pretty.Formatter(config))
 	return nil
 }
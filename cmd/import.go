@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/compose"
+)
+
+var (
+	importCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Convert configurations of other tools",
+		Long: `Convert configurations of other tools to sloop configurations`,
+	}
+	importComposeCmd = &cobra.Command{
+		Use:   "compose <file>",
+		Short: "Convert a docker-compose file",
+		Long: `Convert a docker-compose file to a CUE file of package main.
+Services, volumes and networks become $service, $volume and $bridge entries.
+Published ports become sockets, which the service must accept with socket activation.
+What cannot be converted is left as "not mapped" comments.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return importCompose(args[0])
+		},
+	}
+)
+var importOut string
+func init() {
+	importComposeCmd.Flags().StringVarP(&importOut, "out", "o", "", "file to write, instead of the standard output")
+	importCmd.AddCommand(importComposeCmd)
+}
+
+func importCompose(path string) error {
+	src, warnings, err := compose.Convert(path)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	if importOut == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	err = os.WriteFile(importOut, src, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", importOut)
+	return nil
+}
@@ -8,13 +8,15 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+
+	"yuri91/sloop/cue"
 )
 
 var (
 	initCmd = &cobra.Command{
 		Use:   "init",
 		Short: "Initialize a configuration directory",
-		Long: `Initialize a configuration directory`,
+		Long: `Initialize a configuration directory, with the sloop schema installed in cue.mod`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return doInit(args)
 		},
@@ -74,5 +76,14 @@ func doInit(args []string) error {
 		return err
 	}
 
-	return err
+	// Install the schema, so that editors and cue vet know the definitions
+	schemaDir := filepath.Join(mod, "pkg", filepath.FromSlash(cue.SchemaPackage))
+	if err = os.MkdirAll(schemaDir, 0755); err != nil {
+		return err
+	}
+	schema, err := cue.ExportSchema("cue")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(schemaDir, "sloop.cue"), schema, 0644)
 }
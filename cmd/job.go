@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/cue"
+	"yuri91/sloop/systemd"
+)
+
+var (
+	jobCmd = &cobra.Command{
+		Use:   "job",
+		Short: "Manage jobs",
+		Long: `Manage the jobs defined in the configuration`,
+	}
+	jobRunCmd = &cobra.Command{
+		Use:   "run <job> [-- command...]",
+		Short: "Run a job",
+		Long: `Run a job in a new container, and exit with its exit status.
+The command of the job can be replaced by the arguments after "--".
+The configuration must have been run already, so that the job is installed.
+A job that is already running, like when a service that requires it started it, cannot run
+again until it finishes.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return jobRun(args[0], args[1:])
+		},
+	}
+)
+
+func init() {
+	jobCmd.AddCommand(jobRunCmd)
+}
+
+func jobRun(name string, args []string) error {
+	config, err := cue.GetConfig(".")
+	if printConfigError(err) {
+		os.Exit(1)
+	}
+	if err != nil {
+		return err
+	}
+	job, ok := config.Services[name]
+	if !ok || !job.Job {
+		return systemd.RunJobError.New("no job named %s", name)
+	}
+	conn, err := systemd.Connect()
+	if err != nil {
+		return err
+	}
+	status, err := systemd.RunJob(conn, job, args)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	os.Exit(status)
+	return nil
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/cgroup"
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/metrics"
+	"yuri91/sloop/systemd"
+)
+
+var (
+	metricsCmd = &cobra.Command{
+		Use:   "metrics",
+		Short: "Expose metrics of sloop services",
+		Long: `Expose metrics of sloop services`,
+	}
+	metricsServeCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Serve metrics in the Prometheus format",
+		Long: `Serve per-service cgroup, systemd, timer, bridge and image metrics in the Prometheus format.
+The configuration is loaded again when its files change.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return serveMetrics()
+		},
+	}
+)
+var metricsListen string
+var metricsSysfsRoot string
+func init() {
+	metricsServeCmd.Flags().StringVar(&metricsListen, "listen", ":9558", "address to listen on")
+	metricsServeCmd.Flags().StringVar(&metricsSysfsRoot, "sysfs-root", "/sys", "root of the sysfs filesystem")
+	metricsCmd.AddCommand(metricsServeCmd)
+}
+
+func serveMetrics() error {
+	config, err := cue.GetConfig(".")
+	if printConfigError(err) {
+		os.Exit(1)
+	}
+	if err != nil {
+		return err
+	}
+	cgroup.Root = filepath.Join(metricsSysfsRoot, "fs", "cgroup")
+	collector := metrics.Collector{NetRoot: filepath.Join(metricsSysfsRoot, "class", "net")}
+	conn, err := systemd.Connect()
+	if err == nil {
+		defer conn.Close()
+		collector.Systemd = conn
+	} else {
+		fmt.Printf("Unit states will not be reported: %v\n", err)
+	}
+
+	var current atomic.Pointer[cue.Config]
+	current.Store(config)
+	go reloadMetricsConfig(&current)
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		collector.Write(w, *current.Load())
+	})
+	fmt.Printf("Serving metrics on %s\n", metricsListen)
+	return http.ListenAndServe(metricsListen, nil)
+}
+
+// reloadMetricsConfig loads the configuration in current again when its
+// files change, like watch does. An invalid configuration is reported,
+// and the last valid one kept.
+func reloadMetricsConfig(current *atomic.Pointer[cue.Config]) {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = addWatches(watcher, common.ConfPath)
+	}
+	if err != nil {
+		fmt.Printf("The configuration will not be reloaded: %v\n", err)
+		return
+	}
+	defer watcher.Close()
+	timer := time.NewTimer(time.Second)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !isCueEvent(ev) {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					addWatches(watcher, ev.Name)
+				}
+			}
+			timer.Reset(time.Second)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("Watch error: %v\n", err)
+			timer.Reset(time.Second)
+		case <-timer.C:
+			config, err := cue.GetConfig(".")
+			if err != nil {
+				fmt.Printf("Keeping the previous configuration: %v\n", err)
+				continue
+			}
+			current.Store(config)
+			fmt.Printf("Configuration reloaded\n")
+		}
+	}
+}
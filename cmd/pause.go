@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/cgroup"
+	"yuri91/sloop/cue"
+)
+
+var (
+	pauseCmd = &cobra.Command{
+		Use:   "pause [service...]",
+		Short: "Freeze services",
+		Long: `Suspend all the processes of services with the cgroup freezer.
+Without arguments, list the services that are frozen.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cgroup.Root = pauseCgroupRoot
+			if len(args) == 0 {
+				return listFrozen()
+			}
+			return pause(args, true)
+		},
+	}
+	resumeCmd = &cobra.Command{
+		Use:   "resume <service...>",
+		Short: "Thaw services frozen with pause",
+		Long: `Resume the processes of services frozen with "sloop pause"`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cgroup.Root = pauseCgroupRoot
+			return pause(args, false)
+		},
+	}
+)
+var pauseCgroupRoot string
+func init() {
+	pauseCmd.Flags().StringVar(&pauseCgroupRoot, "cgroup-root", cgroup.Root, "mount point of the cgroup v2 hierarchy")
+	resumeCmd.Flags().StringVar(&pauseCgroupRoot, "cgroup-root", cgroup.Root, "mount point of the cgroup v2 hierarchy")
+}
+
+// serviceCgroups returns the cgroups of the instances of a service
+func serviceCgroups(s cue.Service) []string {
+	return lo.Map(s.Units(), func(u string, _ int) string {
+		return strings.TrimSuffix(u, ".service")
+	})
+}
+
+func listFrozen() error {
+	frozen, err := cgroup.ListFrozen()
+	if err != nil {
+		return err
+	}
+	if len(frozen) == 0 {
+		fmt.Printf("No frozen services\n")
+	}
+	for _, s := range frozen {
+		fmt.Println(s)
+	}
+	return nil
+}
+
+func pause(names []string, freeze bool) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var services []cue.Service
+	for _, n := range names {
+		s, ok := config.Services[n]
+		if !ok {
+			return cgroup.FreezeError.New("no service named %s", n)
+		}
+		services = append(services, s)
+	}
+	for _, s := range services {
+		for _, c := range serviceCgroups(s) {
+			if !cgroup.Running(c) {
+				fmt.Printf("%s is not running\n", c)
+				continue
+			}
+			if freeze {
+				err = cgroup.Freeze(c)
+			} else {
+				err = cgroup.Thaw(c)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %s\n", map[bool]string{true: "Froze", false: "Thawed"}[freeze], c)
+		}
+	}
+	return nil
+}
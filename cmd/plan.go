@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/systemd"
+)
+
+var (
+	planCmd = &cobra.Command{
+		Use:   "plan",
+		Short: "Show what run would change",
+		Long: `Show the units, services and images that run would change, without applying anything`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return plan()
+		},
+	}
+)
+
+func init() {
+}
+
+func printPlanSection(title string, elems []string) {
+	if len(elems) == 0 {
+		return
+	}
+	fmt.Printf("%s:\n\t%s\n", title, strings.Join(elems, "\n\t"))
+}
+
+func plan() error {
+	var p *systemd.Plan
+	if client := agentClient(); client != nil {
+		var err error
+		p, err = client.Plan(common.ConfPath)
+		if printAgentError(err) {
+			os.Exit(1)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		config, err := cue.GetConfig(".")
+		if printConfigError(err) {
+			os.Exit(1)
+		}
+		if err != nil {
+			return err
+		}
+		p, err = systemd.GetPlan(*config)
+		if err != nil {
+			return err
+		}
+	}
+	if p.Empty() {
+		fmt.Printf("Nothing to do\n")
+		return nil
+	}
+	printPlanSection("Units to remove", p.RemoveUnits)
+	printPlanSection("Units to write", p.WriteUnits)
+	printPlanSection("Services to rebuild", p.Services)
+	printPlanSection("Services to reload", p.ReloadServices)
+	printPlanSection("Images to fetch", p.FetchImages)
+	printPlanSection("Images to build", p.BuildImages)
+	printPlanSection("Images to remove", p.RemoveImages)
+	return nil
+}
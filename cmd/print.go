@@ -1,11 +1,8 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 
-	"cuelang.org/go/cue/errors"
-	"github.com/joomcode/errorx"
 	"github.com/spf13/cobra"
 
 	"yuri91/sloop/cue"
@@ -27,9 +24,7 @@ func init() {
 
 func print(path string) error {
 	value, err := cue.GetCueConfig(".")
-	if errx, ok := err.(*errorx.Error); ok && cue.CueErrors.IsNamespaceOf(errx.Type()) {
-		fmt.Printf("Error in configuration: [%s] %s \n", errx.Type().FullName(), errx.Message())
-		fmt.Println(errors.Details(errx.Cause(), nil))
+	if printConfigError(err) {
 		os.Exit(1)
 	}
 	if err != nil {
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/systemd"
+)
+
+var (
+	renderCmd = &cobra.Command{
+		Use:   "render",
+		Short: "Write the units of the configuration without applying it",
+		Long: `Write the units, service files, hosts files, volume directories and helper scripts of the
+configuration in a directory that stands for the root of the machine that runs them, like for an
+image build. Units are linked and enabled with symbolic links in /etc/systemd/system.
+No image is fetched or built: their metadata is read from the local image store, and rendering
+fails if one is missing. Secrets, which are encrypted for the machine that runs them, and the
+firewall rules of bridges are left to "sloop run".`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return render()
+		},
+	}
+)
+var renderOut string
+var renderPrefix string
+func init() {
+	renderCmd.Flags().StringVarP(&renderOut, "out", "o", "", "root directory to write to")
+	renderCmd.Flags().StringVar(&renderPrefix, "prefix", common.BaseDir(), "directory of the state of sloop on the target machine")
+	renderCmd.MarkFlagRequired("out")
+}
+
+func render() error {
+	config, err := loadValid(".")
+	if printConfigError(err) {
+		os.Exit(1)
+	}
+	if err != nil {
+		return err
+	}
+	err = systemd.Render(*config, renderOut, renderPrefix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rendered configuration in %s\n", renderOut)
+	return nil
+}
@@ -39,6 +39,19 @@ func init() {
 	rootCmd.AddCommand(purgeCmd)
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(fetchCmd)
+	rootCmd.AddCommand(agentCmd)
+	rootCmd.AddCommand(planCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(syncCmd)
+	rootCmd.AddCommand(metricsCmd)
+	rootCmd.AddCommand(secretCmd)
+	rootCmd.AddCommand(jobCmd)
+	rootCmd.AddCommand(volumeCmd)
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(schemaCmd)
+	rootCmd.AddCommand(renderCmd)
+	rootCmd.AddCommand(importCmd)
 }
 
 func initConfig() {
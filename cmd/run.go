@@ -3,12 +3,12 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
-	"cuelang.org/go/cue/errors"
-	"github.com/joomcode/errorx"
 	"github.com/spf13/cobra"
 
-	"yuri91/sloop/cue"
+	"yuri91/sloop/common"
 	//	"yuri91/sloop/podman"
 	"yuri91/sloop/systemd"
 )
@@ -19,28 +19,55 @@ var (
 		Short: "Run the cue configuration",
 		Long: `Run the cue configuration`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if runWatch {
+				return watch(runDebounce)
+			}
 			return run()
 		},
 	}
 )
-
+var runWatch bool
+var runDebounce time.Duration
 func init() {
+	runCmd.Flags().BoolVarP(&runWatch, "watch", "w", false, "watch the configuration and re-apply it on change")
+	runCmd.Flags().DurationVar(&runDebounce, "debounce", 500*time.Millisecond, "time to wait for further changes before re-applying")
 }
 
 func run() error {
-	config, err := cue.GetConfig(".")
-	if errx, ok := err.(*errorx.Error); ok && cue.CueErrors.IsNamespaceOf(errx.Type()) {
-		fmt.Printf("Error in configuration: [%s] %s \n", errx.Type().FullName(), errx.Message())
-		fmt.Println(errors.Details(errx.Cause(), nil))
+	if client := agentClient(); client != nil {
+		changes, err := client.Apply(common.ConfPath)
+		if printAgentError(err) {
+			os.Exit(1)
+		}
+		if err != nil {
+			return err
+		}
+		printChanges(changes)
+		return nil
+	}
+	config, err := loadValid(".")
+	if printConfigError(err) {
 		os.Exit(1)
 	}
 	if err != nil {
 		return err
 	}
 	//err = podman.Execute(config);
-	err = systemd.Create(*config)
+	changes, err := systemd.Create(*config)
 	if err != nil {
 		return err
 	}
+	printChanges(changes)
 	return nil
 }
+
+// printChanges prints the services that applying a configuration
+// restarted or reloaded
+func printChanges(changes *systemd.Changes) {
+	if len(changes.Restarted) > 0 {
+		fmt.Printf("Restarted services: %s\n", strings.Join(changes.Restarted, ", "))
+	}
+	if len(changes.Reloaded) > 0 {
+		fmt.Printf("Reloaded services: %s\n", strings.Join(changes.Reloaded, ", "))
+	}
+}
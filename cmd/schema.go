@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/cue"
+)
+
+var (
+	schemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Show the schema of the configuration",
+		Long: `Show the schema of the configuration`,
+	}
+	schemaExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export the schema of the configuration",
+		Long: `Export the definitions of the configuration, like #Service, with their descriptions and defaults.
+With --format cue the schema is the CUE package that "sloop init" installs in cue.mod,
+which can be imported as "` + cue.SchemaPackage + `".`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return exportSchema()
+		},
+	}
+)
+var schemaFormat string
+func init() {
+	schemaExportCmd.Flags().StringVar(&schemaFormat, "format", "jsonschema", "schema format: jsonschema, openapi or cue")
+	schemaCmd.AddCommand(schemaExportCmd)
+}
+
+func exportSchema() error {
+	b, err := cue.ExportSchema(schemaFormat)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/secret"
+)
+
+var (
+	secretCmd = &cobra.Command{
+		Use:   "secret",
+		Short: "Manage encrypted secrets",
+		Long: `Manage the host key and the encrypted secrets used in the configuration`,
+	}
+	secretKeygenCmd = &cobra.Command{
+		Use:   "keygen",
+		Short: "Create the host key",
+		Long: `Create the host key used to decrypt secrets, if it does not exist, and print its public key`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			recipient, err := secret.Keygen(common.SecretKeyPath)
+			if err != nil {
+				return err
+			}
+			fmt.Println(recipient)
+			return nil
+		},
+	}
+	secretEncryptCmd = &cobra.Command{
+		Use:   "encrypt",
+		Short: "Encrypt a secret read from stdin",
+		Long: `Encrypt a secret read from stdin, printing a value that can be used as the age field of a #Secret.
+By default the secret is encrypted for the host key.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return encryptSecret()
+		},
+	}
+)
+var secretRecipients []string
+func init() {
+	secretEncryptCmd.Flags().StringArrayVarP(&secretRecipients, "recipient", "r", nil, "age public key to encrypt for (can be repeated)")
+	secretCmd.AddCommand(secretKeygenCmd)
+	secretCmd.AddCommand(secretEncryptCmd)
+}
+
+func encryptSecret() error {
+	recipients := secretRecipients
+	if len(recipients) == 0 {
+		identity, err := secret.LoadIdentity(common.SecretKeyPath)
+		if err != nil {
+			return err
+		}
+		recipients = []string{identity.Recipient().String()}
+	}
+	plain, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	armored, err := secret.Encrypt(recipients, plain)
+	if err != nil {
+		return err
+	}
+	fmt.Print(armored)
+	return nil
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/cue"
+	"yuri91/sloop/systemd"
+)
+
+var (
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of sloop units",
+		Long: `Show the status of the units generated from the configuration`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return status()
+		},
+	}
+)
+
+func init() {
+}
+
+func status() error {
+	var statuses []systemd.UnitStatus
+	if client := agentClient(); client != nil {
+		var err error
+		statuses, err = client.Status()
+		if err != nil {
+			return err
+		}
+	} else {
+		config, err := cue.GetConfig(".")
+		if printConfigError(err) {
+			os.Exit(1)
+		}
+		if err != nil {
+			return err
+		}
+		conn, err := systemd.Connect()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		statuses, err = systemd.Status(conn, *config)
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range statuses {
+		fmt.Printf("%-40s %-10s %-10s %s\n", s.Name, s.LoadState, s.ActiveState, s.SubState)
+	}
+	return nil
+}
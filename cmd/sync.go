@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/gitsync"
+	"yuri91/sloop/systemd"
+)
+
+var (
+	syncCmd = &cobra.Command{
+		Use:   "sync",
+		Short: "Apply the configuration from a git repository",
+		Long: `Fetch a git repository, validate the configuration in it and apply it.
+With --interval, keep polling the repository and apply every new commit.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if syncInterval > 0 {
+				return syncLoop()
+			}
+			err := syncOnce()
+			if err == errSyncRefused {
+				os.Exit(1)
+			}
+			return err
+		},
+	}
+)
+var syncRepo string
+var syncRef string
+var syncDir string
+var syncInterval time.Duration
+
+// syncFailed is the last commit that could not be deployed
+var syncFailed string
+
+// errSyncRefused is returned when the configuration is invalid,
+// after its details have been printed
+var errSyncRefused = fmt.Errorf("configuration is invalid")
+
+func init() {
+	syncCmd.Flags().StringVar(&syncRepo, "repo", "", "url or path of the git repository")
+	syncCmd.Flags().StringVar(&syncRef, "ref", "main", "branch, tag or commit to deploy")
+	syncCmd.Flags().StringVar(&syncDir, "dir", ".", "configuration root directory inside the repository")
+	syncCmd.Flags().DurationVar(&syncInterval, "interval", 0, "poll the repository with this interval, instead of syncing once")
+	syncCmd.MarkFlagRequired("repo")
+}
+
+func applyDir(confDir string) error {
+	if client := agentClient(); client != nil {
+		changes, err := client.Apply(confDir)
+		if printAgentError(err) {
+			return errSyncRefused
+		}
+		if err != nil {
+			return err
+		}
+		printChanges(changes)
+		return nil
+	}
+	config, err := loadValid(confDir)
+	if printConfigError(err) {
+		return errSyncRefused
+	}
+	if err != nil {
+		return err
+	}
+	changes, err := systemd.Create(*config)
+	if err != nil {
+		return err
+	}
+	printChanges(changes)
+	return nil
+}
+
+// syncOnce fetches the repository and applies it if it changed since
+// the last deployment. Commits that already failed are not retried.
+func syncOnce() error {
+	commit, err := gitsync.Fetch(syncRepo, syncRef, common.RepoPath)
+	if err != nil {
+		return err
+	}
+	deployed, err := gitsync.Deployed(common.DeployedPath)
+	if err != nil {
+		return err
+	}
+	if commit == deployed || commit == syncFailed {
+		return nil
+	}
+	fmt.Printf("Deploying %s...\n", commit)
+	confDir := filepath.Join(common.RepoPath, syncDir)
+	// The configuration is validated, locally or by the agent, before
+	// touching anything: an invalid commit is never applied
+	err = applyDir(confDir)
+	if err == nil {
+		err = gitsync.RecordDeployed(common.DeployedPath, commit)
+	}
+	if printConfigError(err) {
+		err = errSyncRefused
+	}
+	if err == errSyncRefused {
+		syncFailed = commit
+		fmt.Printf("Refusing to deploy invalid commit %s\n", commit)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deployed %s\n", commit)
+	return nil
+}
+
+func syncLoop() error {
+	for {
+		err := syncOnce()
+		if err != nil && err != errSyncRefused {
+			fmt.Printf("Error: %+v\n", err)
+		}
+		time.Sleep(syncInterval)
+	}
+}
@@ -0,0 +1,403 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+
+	"yuri91/sloop/cgroup"
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/systemd"
+	"yuri91/sloop/volume"
+)
+
+var (
+	volumeCmd = &cobra.Command{
+		Use:   "volume",
+		Short: "Manage volumes",
+		Long: `Back up, restore, list and remove the named volumes`,
+	}
+	volumeBackupCmd = &cobra.Command{
+		Use:   "backup <volume>",
+		Short: "Back up a volume",
+		Long: `Write a compressed archive of a named volume, by default in the backups directory.
+The services that mount the volume are frozen while a snapshot is taken, or while the volume is
+archived if it cannot be snapshotted. With --stop-services they are stopped instead.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return volumeBackup(args[0])
+		},
+	}
+	volumeRestoreCmd = &cobra.Command{
+		Use:   "restore <volume> <archive>",
+		Short: "Restore a volume from a backup",
+		Long: `Replace the content of a named volume with an archive written by "sloop volume backup".
+The services that mount the volume are stopped while it is restored.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return volumeRestore(args[0], args[1])
+		},
+	}
+	volumeLsCmd = &cobra.Command{
+		Use:   "ls",
+		Short: "List volumes",
+		Long: `List the volumes, with their size and the services that mount them.
+Directories of volumes that are no longer in the configuration are listed too.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return volumeLs()
+		},
+	}
+	volumeRmCmd = &cobra.Command{
+		Use:   "rm <volume>",
+		Short: "Remove a volume",
+		Long: `Remove the directory of a named volume, if no service mounts it`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return volumeRm(args[0])
+		},
+	}
+)
+var volumeStopServices bool
+var volumeFreeze bool
+var volumeSnapshot string
+var volumeCompression string
+var volumeOut string
+func init() {
+	volumeBackupCmd.Flags().BoolVar(&volumeStopServices, "stop-services", false, "stop the services that mount the volume while it is snapshotted")
+	volumeBackupCmd.Flags().BoolVar(&volumeFreeze, "freeze", true, "freeze the services that mount the volume while it is snapshotted")
+	volumeBackupCmd.Flags().StringVar(&volumeSnapshot, "snapshot", "auto", "snapshot driver: auto, btrfs, lvm, copy or none")
+	volumeBackupCmd.Flags().StringVar(&volumeCompression, "compression", "zstd", "compression of the archive: zstd, gzip or none")
+	volumeBackupCmd.Flags().StringVarP(&volumeOut, "out", "o", "", "archive file, relative to the backups directory")
+	volumeCmd.AddCommand(volumeBackupCmd)
+	volumeCmd.AddCommand(volumeRestoreCmd)
+	volumeCmd.AddCommand(volumeLsCmd)
+	volumeCmd.AddCommand(volumeRmCmd)
+}
+
+func loadConfig() (*cue.Config, error) {
+	config, err := cue.GetConfig(".")
+	if printConfigError(err) {
+		os.Exit(1)
+	}
+	return config, err
+}
+
+// namedVolume returns the volume called name, which must be a named one
+func namedVolume(config *cue.Config, name string) (cue.Volume, error) {
+	v, ok := config.Volumes[name]
+	if !ok {
+		return v, volume.NotFoundError.New("no volume named %s", name)
+	}
+	if v.Type != "named" {
+		return v, volume.NotFoundError.New("volume %s is a %s volume, not a named one", name, v.Type)
+	}
+	return v, nil
+}
+
+func backupPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(common.BackupPath, p)
+}
+
+func serviceNames(services []cue.Service) []string {
+	return lo.Map(services, func(s cue.Service, _ int) string {
+		return s.Name
+	})
+}
+
+// stopConsumers stops the services that mount a volume, and returns a
+// function that starts them again
+func stopConsumers(consumers []cue.Service) (func() error, error) {
+	conn, err := systemd.Connect()
+	if err != nil {
+		return nil, err
+	}
+	stopped, err := systemd.StopServices(conn, consumers)
+	restart := func() error {
+		if conn == nil {
+			return nil
+		}
+		err := systemd.StartUnits(conn, stopped)
+		conn.Close()
+		conn = nil
+		return err
+	}
+	if err != nil {
+		restart()
+		return nil, err
+	}
+	return restart, nil
+}
+
+func volumeBackup(name string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	v, err := namedVolume(config, name)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(common.VolumePath, v.Name)
+	consumers, err := systemd.VolumeConsumers(*config, v.Name)
+	if err != nil {
+		return err
+	}
+	driver := volumeSnapshot
+	if driver == "auto" {
+		driver = volume.Detect(dir)
+		if driver == "" && (volumeStopServices || volumeFreeze) {
+			driver = "copy"
+		} else if driver == "" {
+			driver = "none"
+		}
+	}
+	if !volumeStopServices && !volumeFreeze && (driver == "copy" || driver == "none") && len(consumers) > 0 {
+		fmt.Printf("Warning: volume %s is archived while %s can write to it\n", v.Name, strings.Join(serviceNames(consumers), ", "))
+	}
+
+	restart := func() error { return nil }
+	if volumeStopServices {
+		restart, err = stopConsumers(consumers)
+	} else if volumeFreeze {
+		restart, err = cgroup.FreezeServices(lo.FlatMap(consumers, func(s cue.Service, _ int) []string {
+			return serviceCgroups(s)
+		}))
+	}
+	if err != nil {
+		return err
+	}
+	defer restart()
+	snap, err := volume.Take(driver, dir)
+	if err != nil {
+		return err
+	}
+	defer snap.Remove()
+	if driver != "none" {
+		err = restart()
+		if err != nil {
+			return err
+		}
+	}
+
+	ext := map[string]string{"zstd": ".tar.zst", "gzip": ".tar.gz", "none": ".tar"}[volumeCompression]
+	out := volumeOut
+	if out == "" {
+		out = v.Name + "-" + time.Now().Format("20060102-150405") + ext
+	}
+	out = backupPath(out)
+	err = os.MkdirAll(filepath.Dir(out), 0700)
+	if err != nil {
+		return volume.FilesystemError.Wrap(err, "cannot create directory of %s", out)
+	}
+	f, err := os.CreateTemp(filepath.Dir(out), "." + filepath.Base(out))
+	if err != nil {
+		return volume.FilesystemError.Wrap(err, "cannot create %s", out)
+	}
+	defer os.Remove(f.Name())
+	fmt.Printf("Archiving volume %s (snapshot: %s)...\n", v.Name, driver)
+	err = volume.Write(f, snap.Path, volume.Metadata{
+		Volume: v.Name,
+		Created: time.Now(),
+		Snapshot: driver,
+		Services: serviceNames(consumers),
+		Compression: volumeCompression,
+	})
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = os.Rename(f.Name(), out)
+	if err != nil {
+		return volume.FilesystemError.Wrap(err, "cannot create %s", out)
+	}
+	err = restart()
+	if err != nil {
+		return err
+	}
+	err = snap.Remove()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up volume %s to %s\n", v.Name, out)
+	return nil
+}
+
+func volumeRestore(name string, archive string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	v, err := namedVolume(config, name)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(common.VolumePath, v.Name)
+	f, err := os.Open(backupPath(archive))
+	if err != nil {
+		return volume.RestoreError.Wrap(err, "cannot open archive %s", archive)
+	}
+	defer f.Close()
+	meta, err := volume.ReadMetadata(f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restoring volume %s from a backup of %s taken at %s\n", v.Name, meta.Volume, meta.Created.Format(time.RFC3339))
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return volume.RestoreError.Wrap(err, "cannot read archive %s", archive)
+	}
+
+	consumers, err := systemd.VolumeConsumers(*config, v.Name)
+	if err != nil {
+		return err
+	}
+	restart, err := stopConsumers(consumers)
+	if err != nil {
+		return err
+	}
+	defer restart()
+
+	// extract next to the volume, and swap them once it is done
+	tmp := filepath.Join(common.VolumePath, "." + v.Name + ".restore")
+	old := filepath.Join(common.VolumePath, "." + v.Name + ".old")
+	for _, p := range []string{tmp, old} {
+		err = volume.RemoveDir(p)
+		if err != nil {
+			return err
+		}
+	}
+	err = volume.CreateDir(tmp, dir)
+	if err != nil {
+		return err
+	}
+	_, err = volume.Extract(f, tmp)
+	if err != nil {
+		volume.RemoveDir(tmp)
+		return err
+	}
+	err = os.Rename(dir, old)
+	if err != nil && !os.IsNotExist(err) {
+		volume.RemoveDir(tmp)
+		return volume.FilesystemError.Wrap(err, "cannot move volume %s", v.Name)
+	}
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		return volume.FilesystemError.Wrap(err, "cannot move restored volume %s, the old content is in %s", v.Name, old)
+	}
+	err = volume.RemoveDir(old)
+	if err != nil {
+		return err
+	}
+	err = restart()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored volume %s\n", v.Name)
+	return nil
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	s := float64(size)
+	i := 0
+	for s >= 1024 && i < len(units)-1 {
+		s /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", s, units[i])
+}
+
+func volumeLs() error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	names := lo.Keys(config.Volumes)
+	// directories of volumes that are not in the configuration anymore
+	dirs, _ := os.ReadDir(common.VolumePath)
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		if _, ok := config.Volumes[d.Name()]; !ok {
+			names = append(names, d.Name())
+		}
+	}
+	sort.Strings(names)
+	fmt.Printf("%-30s %-8s %-10s %s\n", "NAME", "TYPE", "SIZE", "SERVICES")
+	for _, n := range names {
+		v, ok := config.Volumes[n]
+		typ := v.Type
+		dir := filepath.Join(common.VolumePath, n)
+		if !ok {
+			typ = "orphan"
+		} else if v.Type == "host" {
+			dir = v.Name
+		}
+		size := "-"
+		if typ != "tmpfs" {
+			if s, err := volume.Size(dir); err == nil {
+				size = humanSize(s)
+			}
+		}
+		consumers, err := systemd.VolumeConsumers(*config, n)
+		if err != nil {
+			return err
+		}
+		services := strings.Join(serviceNames(consumers), ",")
+		if services == "" {
+			services = "-"
+		}
+		fmt.Printf("%-30s %-8s %-10s %s\n", n, typ, size, services)
+	}
+	return nil
+}
+
+func volumeRm(name string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if v, ok := config.Volumes[name]; ok && v.Type != "named" {
+		return volume.NotFoundError.New("volume %s is a %s volume, not a named one", name, v.Type)
+	}
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		return volume.NotFoundError.New("invalid volume name %s", name)
+	}
+	dir := filepath.Join(common.VolumePath, name)
+	if _, err := os.Stat(dir); err != nil {
+		return volume.NotFoundError.Wrap(err, "no volume named %s", name)
+	}
+	consumers, err := systemd.VolumeConsumers(*config, name)
+	if err != nil {
+		return err
+	}
+	if len(consumers) > 0 {
+		return volume.InUseError.New("volume %s is used by %s", name, strings.Join(serviceNames(consumers), ", "))
+	}
+	if _, ok := config.Volumes[name]; ok {
+		fmt.Printf("Warning: volume %s is in the configuration, the next run creates it again empty\n", name)
+	}
+	err = volume.RemoveDir(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed volume %s\n", name)
+	return nil
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/systemd"
+)
+
+// addWatches adds an inotify watch to every directory under root
+// that cue could load files from, including cue.mod
+func addWatches(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+func isCueEvent(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+	if filepath.Ext(ev.Name) == ".cue" {
+		return true
+	}
+	// A new (or renamed) directory may contain cue files
+	info, err := os.Stat(ev.Name)
+	return err == nil && info.IsDir()
+}
+
+// changedServices returns the names of the services that differ between
+// the two configurations
+func changedServices(old *cue.Config, new *cue.Config) []string {
+	var changed []string
+	for n, s := range new.Services {
+		if o, ok := old.Services[n]; !ok || !reflect.DeepEqual(o, s) {
+			changed = append(changed, n)
+		}
+	}
+	for n := range old.Services {
+		if _, ok := new.Services[n]; !ok {
+			changed = append(changed, n)
+		}
+	}
+	return changed
+}
+
+func apply(old *cue.Config) *cue.Config {
+	config, err := loadValid(".")
+	if printConfigError(err) {
+		return old
+	}
+	if err != nil {
+		fmt.Printf("Error: %+v\n", err)
+		return old
+	}
+	if old != nil && reflect.DeepEqual(*old, *config) {
+		fmt.Printf("Configuration unchanged\n")
+		return old
+	}
+	var changes *systemd.Changes
+	if old != nil {
+		changed := lo.Uniq(changedServices(old, config))
+		fmt.Printf("Changed services: %s\n", strings.Join(changed, ", "))
+		changes, err = systemd.CreateServices(*config, changed)
+	} else {
+		changes, err = systemd.Create(*config)
+	}
+	if err != nil {
+		fmt.Printf("Error: %+v\n", err)
+		// Retry the whole configuration on the next change
+		return nil
+	}
+	printChanges(changes)
+	return config
+}
+
+func watch(debounce time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = addWatches(watcher, common.ConfPath)
+	if err != nil {
+		return err
+	}
+
+	config := apply(nil)
+	fmt.Printf("Watching %s for changes...\n", common.ConfPath)
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !isCueEvent(ev) {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					if err := addWatches(watcher, ev.Name); err != nil {
+						return err
+					}
+				}
+			}
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// like an overflow of the event queue: changes may have
+			// been missed, apply the configuration again
+			fmt.Printf("Watch error: %v\n", err)
+			timer.Reset(debounce)
+		case <-timer.C:
+			config = apply(config)
+		}
+	}
+}
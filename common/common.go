@@ -4,18 +4,45 @@ import "path/filepath"
 
 var ConfPath string
 var ImagePath string
+var BuildPath string
 var ServicePath string
 var UnitPath string
 var VolumePath string
+var BackupPath string
 var UtilsPath string
+var AgentSocketPath string
+var FreezePath string
+var RepoPath string
+var DeployedPath string
+var SecretKeyPath string
 
 var baseDir string = "/var/lib/sloop"
+var runDir string = "/run/sloop"
 
 func SetPaths(confDir string) {
 	ConfPath = filepath.Join(confDir, "")
 	ImagePath = filepath.Join(baseDir, "images")
+	BuildPath = filepath.Join(baseDir, "build")
 	ServicePath = filepath.Join(baseDir, "services")
 	UnitPath = filepath.Join(baseDir, "units")
 	VolumePath = filepath.Join(baseDir, "volumes")
+	BackupPath = filepath.Join(baseDir, "backups")
 	UtilsPath = filepath.Join(baseDir, "utils")
+	AgentSocketPath = filepath.Join(runDir, "agent.sock")
+	FreezePath = filepath.Join(runDir, "freeze")
+	RepoPath = filepath.Join(baseDir, "repo")
+	DeployedPath = filepath.Join(baseDir, "deployed")
+	SecretKeyPath = filepath.Join(baseDir, "secret.key")
+}
+
+// BaseDir returns the directory with the state of sloop
+func BaseDir() string {
+	return baseDir
+}
+
+// SetBaseDir moves the state of sloop to dir, keeping the configuration
+// directory
+func SetBaseDir(dir string) {
+	baseDir = dir
+	SetPaths(ConfPath)
 }
@@ -0,0 +1,694 @@
+package compose
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/format"
+	"cuelang.org/go/cue/literal"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// A docker-compose file is converted to CUE text, field by field.
+// Whatever has no equivalent in sloop is kept as a comment, so that the
+// user can decide what to do with it.
+
+type file struct {
+	Services map[string]map[string]interface{} `yaml:"services"`
+	Volumes map[string]map[string]interface{} `yaml:"volumes"`
+	Networks map[string]map[string]interface{} `yaml:"networks"`
+	Rest map[string]interface{} `yaml:",inline"`
+}
+
+type bridge struct {
+	label string
+	ip string
+	prefix int
+	ip6 string
+	prefix6 int
+	notes []string
+}
+
+type volume struct {
+	label string
+	// fields is the body of the volume
+	fields string
+}
+
+type converter struct {
+	// dir is the directory of the compose file, bind mounts are
+	// relative to it
+	dir string
+	bridges map[string]*bridge
+	volumes map[string]*volume
+	notes []string
+	// warnings are about what is converted, but may not work as in
+	// docker compose
+	warnings []string
+}
+
+// defaultSubnet is the subnet of the n-th network without one
+func defaultSubnet(n int) (string, int) {
+	return fmt.Sprintf("10.89.%d.1", n), 24
+}
+
+// freeSubnet returns the first default subnet that does not overlap the
+// subnets of the networks converted so far
+func (c *converter) freeSubnet() (string, int) {
+	for n := 0; ; n++ {
+		ip, prefix := defaultSubnet(n)
+		subnet := netip.PrefixFrom(netip.MustParseAddr(ip), prefix)
+		if !lo.SomeBy(lo.Values(c.bridges), func(b *bridge) bool {
+			addr, err := netip.ParseAddr(b.ip)
+			return err == nil && netip.PrefixFrom(addr, b.prefix).Overlaps(subnet)
+		}) {
+			return ip, prefix
+		}
+	}
+}
+
+// Convert reads the compose file in path and returns an equivalent
+// configuration, as a CUE file of package main
+func Convert(path string) ([]byte, []string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, ReadError.Wrap(err, "cannot read %s", path)
+	}
+	var f file
+	err = yaml.Unmarshal(b, &f)
+	if err != nil {
+		return nil, nil, ReadError.Wrap(err, "cannot parse %s", path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, ReadError.Wrap(err, "cannot resolve %s", path)
+	}
+	c := converter{
+		dir: filepath.Dir(abs),
+		bridges: make(map[string]*bridge),
+		volumes: make(map[string]*volume),
+	}
+	for _, k := range sortedKeys(f.Rest) {
+		if k != "version" && k != "name" {
+			c.notes = append(c.notes, fmt.Sprintf("%s: %s", k, compact(f.Rest[k])))
+		}
+	}
+	for _, n := range sortedKeys(f.Networks) {
+		c.network(n, f.Networks[n])
+	}
+	// after the networks with a subnet, not to take it
+	for _, n := range sortedKeys(c.bridges) {
+		if b := c.bridges[n]; b.ip == "" {
+			b.ip, b.prefix = c.freeSubnet()
+		}
+	}
+	for _, n := range sortedKeys(f.Volumes) {
+		c.namedVolume(n, f.Volumes[n])
+	}
+
+	var services strings.Builder
+	for _, n := range sortedKeys(f.Services) {
+		src, err := c.service(n, f.Services[n])
+		if err != nil {
+			return nil, nil, err
+		}
+		services.WriteString(src)
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "// Converted from %s by \"sloop import compose\"\npackage main\n\n", filepath.Base(path))
+	for _, n := range c.notes {
+		fmt.Fprintf(&out, "// not mapped: %s\n", n)
+	}
+	for _, n := range sortedKeys(c.volumes) {
+		v := c.volumes[n]
+		fmt.Fprintf(&out, "$volume: %s: {%s}\n", label(v.label), v.fields)
+	}
+	for _, n := range sortedKeys(c.bridges) {
+		b := c.bridges[n]
+		for _, note := range b.notes {
+			fmt.Fprintf(&out, "// not mapped: %s\n", note)
+		}
+		fields := []string{fmt.Sprintf("ip: %s, prefix: %d", quote(b.ip), b.prefix)}
+		if b.ip6 != "" {
+			fields = append(fields, fmt.Sprintf("ip6: %s, prefix6: %d", quote(b.ip6), b.prefix6))
+		}
+		fmt.Fprintf(&out, "$bridge: %s: {%s}\n", label(b.label), strings.Join(fields, ", "))
+	}
+	out.WriteString(services.String())
+
+	src, err := format.Source([]byte(out.String()), format.Simplify())
+	if err != nil {
+		return nil, nil, ConvertError.Wrap(err, "invalid CUE generated for %s", path)
+	}
+	return src, c.warnings, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := lo.Keys(m)
+	sort.Strings(keys)
+	return keys
+}
+
+// compact formats a YAML value on one line, for comments
+func compact(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func quote(s string) string {
+	return literal.String.Quote(s)
+}
+
+// label returns s as a CUE label, quoted if it is not an identifier
+func label(s string) string {
+	if ast.IsValidIdent(s) && !strings.ContainsAny(s[:1], "_#$") {
+		return s
+	}
+	return quote(s)
+}
+
+// ref returns a reference to an entry of a field of the configuration,
+// like $service.web
+func ref(field string, l string) string {
+	if label(l) == l {
+		return field + "." + l
+	}
+	return field + "[" + quote(l) + "]"
+}
+
+func quoteList(l []string) string {
+	return "[" + strings.Join(lo.Map(l, func(s string, _ int) string { return quote(s) }), ", ") + "]"
+}
+
+// sloopName makes a name valid for sloop, which allows letters, digits
+// and dashes
+func sloopName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// nameField returns the name field of an entry labeled l, if the
+// default one is not valid
+func nameField(l string) string {
+	if strings.ReplaceAll(l, "_", "-") == sloopName(l) {
+		return ""
+	}
+	return "name: " + quote(sloopName(l)) + ", "
+}
+
+// network converts a network, which has no IPv4 subnet if it has none
+// in the compose file
+func (c *converter) network(n string, net map[string]interface{}) {
+	b := &bridge{label: n}
+	c.bridges[n] = b
+	for _, k := range sortedKeys(net) {
+		switch k {
+		case "ipam":
+			ipam, _ := net[k].(map[string]interface{})
+			configs, _ := ipam["config"].([]interface{})
+			for _, conf := range configs {
+				conf, _ := conf.(map[string]interface{})
+				subnet, err := netip.ParsePrefix(fmt.Sprint(conf["subnet"]))
+				if err != nil {
+					b.notes = append(b.notes, fmt.Sprintf("network %s ipam: %s", n, compact(conf)))
+					continue
+				}
+				ip := subnet.Masked().Addr().Next()
+				if gw, err := netip.ParseAddr(fmt.Sprint(conf["gateway"])); err == nil {
+					ip = gw
+				}
+				if subnet.Addr().Is4() {
+					b.ip, b.prefix = ip.String(), subnet.Bits()
+				} else {
+					b.ip6, b.prefix6 = ip.String(), subnet.Bits()
+				}
+			}
+		case "driver":
+			if net[k] != "bridge" {
+				b.notes = append(b.notes, fmt.Sprintf("network %s driver: %s", n, compact(net[k])))
+			}
+		default:
+			b.notes = append(b.notes, fmt.Sprintf("network %s %s: %s", n, k, compact(net[k])))
+		}
+	}
+}
+
+func (c *converter) namedVolume(n string, v map[string]interface{}) {
+	c.volumes[n] = &volume{label: n, fields: strings.TrimSuffix(nameField(n), ", ")}
+	for _, k := range sortedKeys(v) {
+		c.notes = append(c.notes, fmt.Sprintf("volume %s %s: %s", n, k, compact(v[k])))
+	}
+}
+
+// hostVolume returns the label of the volume of a host path
+func (c *converter) hostVolume(p string) string {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(c.dir, p)
+	}
+	if _, ok := c.volumes[p]; !ok {
+		c.volumes[p] = &volume{label: p, fields: "name: " + quote(p)}
+	}
+	return p
+}
+
+// tmpfsVolume returns the label of a tmpfs volume
+func (c *converter) tmpfsVolume(service string, dest string) string {
+	l := service + strings.ReplaceAll(dest, "/", "-")
+	c.volumes[l] = &volume{label: l, fields: nameField(l) + `type: "tmpfs"`}
+	return l
+}
+
+// words splits a command like a shell, with quotes and backslashes
+func words(s string) []string {
+	var ws []string
+	var w strings.Builder
+	inWord := false
+	var q rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			w.WriteRune(r)
+			escaped = false
+		case r == '\\' && q != '\'':
+			escaped = true
+			inWord = true
+		case q != 0 && r == q:
+			q = 0
+		case q == 0 && (r == '"' || r == '\''):
+			q = r
+			inWord = true
+		case q == 0 && (r == ' ' || r == '\t' || r == '\n'):
+			if inWord {
+				ws = append(ws, w.String())
+				w.Reset()
+				inWord = false
+			}
+		default:
+			w.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		ws = append(ws, w.String())
+	}
+	return ws
+}
+
+func command(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return words(v)
+	case []interface{}:
+		return lo.Map(v, func(a interface{}, _ int) string { return fmt.Sprint(a) })
+	}
+	return nil
+}
+
+// names returns the names in a list, or the keys of a map, like the
+// ones of depends_on and networks, or a single name
+func names(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		return lo.Map(v, func(a interface{}, _ int) string { return fmt.Sprint(a) })
+	case map[string]interface{}:
+		return sortedKeys(v)
+	}
+	return nil
+}
+
+func imageRef(s string) string {
+	last := s[strings.LastIndex(s, "/")+1:]
+	if !strings.Contains(last, ":") && !strings.Contains(last, "@") {
+		return s + ":latest"
+	}
+	return s
+}
+
+// a service is built as a list of fields, and comments for what is not
+// mapped
+type service struct {
+	name string
+	fields []string
+	image []string
+	env []string
+	volumes []string
+	notes []string
+}
+
+func (s *service) note(format string, args ...interface{}) {
+	s.notes = append(s.notes, fmt.Sprintf(format, args...))
+}
+
+// list returns the list in the field key of service n, which is empty
+// if the field is null
+func list(n string, key string, v interface{}) ([]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, ConvertError.New("%s of service %s must be a list, not %s", key, n, compact(v))
+	}
+	return l, nil
+}
+
+func (c *converter) service(n string, def map[string]interface{}) (string, error) {
+	s := &service{name: sloopName(n)}
+	replicated := false
+	if d, ok := def["deploy"].(map[string]interface{}); ok && d["replicas"] != nil {
+		replicated = true
+	}
+	if def["scale"] != nil {
+		replicated = true
+	}
+	var entrypoint, cmd []string
+	for _, k := range sortedKeys(def) {
+		v := def[k]
+		switch k {
+		case "image":
+			s.image = append(s.image, "from: " + quote(imageRef(fmt.Sprint(v))))
+		case "environment":
+			c.environment(s, v)
+		case "volumes":
+			mounts, err := list(n, k, v)
+			if err != nil {
+				return "", err
+			}
+			for _, m := range mounts {
+				c.mount(s, m)
+			}
+		case "tmpfs":
+			for _, dest := range names(v) {
+				dest, opts, ok := strings.Cut(dest, ":")
+				if ok {
+					s.note("tmpfs %s options %s", dest, opts)
+				}
+				s.volumes = append(s.volumes, fmt.Sprintf("%s: %s", quote(dest), ref("$volume", c.tmpfsVolume(s.name, dest))))
+			}
+		case "ports":
+			if replicated {
+				s.note("ports: %s, replicated services cannot have sockets", compact(v))
+				continue
+			}
+			ports, err := list(n, k, v)
+			if err != nil {
+				return "", err
+			}
+			for _, p := range ports {
+				c.port(s, p)
+			}
+		case "networks":
+			c.networks(s, v)
+		case "network_mode":
+			switch v {
+			case "host":
+				s.fields = append(s.fields, "// the network of the host")
+			case "none":
+				s.fields = append(s.fields, "net: ifs: {}")
+			default:
+				s.note("network_mode: %s", compact(v))
+			}
+		case "depends_on":
+			deps := lo.Map(names(v), func(d string, _ int) string { return ref("$service", d) })
+			s.fields = append(s.fields, "requires: [" + strings.Join(deps, ", ") + "]", "after: [" + strings.Join(deps, ", ") + "]")
+		case "command":
+			cmd = command(v)
+		case "entrypoint":
+			entrypoint = command(v)
+		case "cap_add":
+			caps := lo.Map(names(v), func(c string, _ int) string {
+				c = strings.ToUpper(c)
+				if !strings.HasPrefix(c, "CAP_") {
+					c = "CAP_" + c
+				}
+				return c
+			})
+			s.fields = append(s.fields, "capabilities: " + quoteList(caps))
+		case "restart":
+			c.restart(s, fmt.Sprint(v))
+		case "deploy":
+			d, _ := v.(map[string]interface{})
+			for _, dk := range sortedKeys(d) {
+				if dk == "replicas" {
+					s.fields = append(s.fields, fmt.Sprintf("replicas: %v", d[dk]))
+					continue
+				}
+				s.note("deploy %s: %s", dk, compact(d[dk]))
+			}
+		case "scale":
+			s.fields = append(s.fields, fmt.Sprintf("replicas: %v", v))
+		case "container_name", "expose":
+			// services are reachable by name, on all ports
+		default:
+			s.note("%s: %s", k, compact(v))
+		}
+	}
+	if def["networks"] == nil && def["network_mode"] == nil {
+		c.networks(s, []interface{}{"default"})
+	}
+	if entrypoint != nil || cmd != nil {
+		if entrypoint == nil {
+			s.fields = append(s.fields, "// the command replaces the entrypoint of the image too, add it if there is one")
+		}
+		s.fields = append(s.fields, "exec: start: " + quoteList(append(entrypoint, cmd...)))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n$service: %s: {\n", label(n))
+	if field := nameField(n); field != "" {
+		fmt.Fprintf(&b, "%s\n", strings.TrimSuffix(field, ", "))
+	}
+	image := s.image
+	if len(s.env) > 0 {
+		image = append(image, "env: {\n" + strings.Join(s.env, "\n") + "\n}")
+	}
+	if len(s.volumes) > 0 {
+		image = append(image, "volumes: {\n" + strings.Join(s.volumes, "\n") + "\n}")
+	}
+	fmt.Fprintf(&b, "image: {\n%s\n}\n", strings.Join(image, "\n"))
+	for _, f := range s.fields {
+		fmt.Fprintf(&b, "%s\n", f)
+	}
+	for _, note := range s.notes {
+		fmt.Fprintf(&b, "// not mapped: %s\n", strings.ReplaceAll(note, "\n", " "))
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+func (c *converter) environment(s *service, v interface{}) {
+	add := func(k string, val *string) {
+		if val == nil {
+			s.note("environment %s, taken from the environment of docker compose", k)
+			return
+		}
+		s.env = append(s.env, fmt.Sprintf("%s: %s", label(k), quote(*val)))
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			if v[k] == nil {
+				add(k, nil)
+				continue
+			}
+			val := fmt.Sprint(v[k])
+			add(k, &val)
+		}
+	case []interface{}:
+		for _, e := range v {
+			k, val, ok := strings.Cut(fmt.Sprint(e), "=")
+			if !ok {
+				add(k, nil)
+				continue
+			}
+			add(k, &val)
+		}
+	}
+}
+
+// mount maps a volume of a service, in the short syntax
+// source:target[:mode] or in the long one
+func (c *converter) mount(s *service, m interface{}) {
+	var typ, source, target string
+	readOnly := false
+	switch m := m.(type) {
+	case string:
+		parts := strings.Split(m, ":")
+		switch len(parts) {
+		case 1:
+			target = parts[0]
+		case 2, 3:
+			source, target = parts[0], parts[1]
+			if len(parts) == 3 {
+				readOnly = lo.Contains(strings.Split(parts[2], ","), "ro")
+			}
+		default:
+			s.note("volume %s", m)
+			return
+		}
+		typ = "volume"
+		if strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") {
+			typ = "bind"
+		}
+	case map[string]interface{}:
+		typ, _ = m["type"].(string)
+		source, _ = m["source"].(string)
+		target, _ = m["target"].(string)
+		readOnly, _ = m["read_only"].(bool)
+		for _, k := range sortedKeys(m) {
+			if !lo.Contains([]string{"type", "source", "target", "read_only"}, k) {
+				s.note("volume %s %s: %s", target, k, compact(m[k]))
+			}
+		}
+	}
+	var l string
+	switch {
+	case typ == "tmpfs":
+		l = c.tmpfsVolume(s.name, target)
+	case typ == "bind" && strings.HasPrefix(source, "~"):
+		s.note("volume %s:%s, in the home directory", source, target)
+		return
+	case typ == "bind":
+		l = c.hostVolume(source)
+	case typ == "volume" && source == "":
+		// anonymous volumes live as long as the container, named ones
+		// as long as the service
+		l = s.name + strings.ReplaceAll(target, "/", "-")
+		if _, ok := c.volumes[l]; !ok {
+			c.volumes[l] = &volume{label: l, fields: strings.TrimSuffix(nameField(l), ", ")}
+		}
+	case typ == "volume":
+		if _, ok := c.volumes[source]; !ok {
+			c.volumes[source] = &volume{label: source, fields: strings.TrimSuffix(nameField(source), ", ")}
+		}
+		l = source
+	default:
+		s.note("volume %s of type %s", target, typ)
+		return
+	}
+	r := ref("$volume", l)
+	if readOnly {
+		r += " & {readOnly: true}"
+	}
+	s.volumes = append(s.volumes, fmt.Sprintf("%s: %s", quote(target), r))
+}
+
+// port maps a published port to a socket. The service gets the socket
+// from systemd, it must support socket activation: nothing forwards the
+// port to the one the container listens on.
+func (c *converter) port(s *service, p interface{}) {
+	var published, target, proto string
+	switch p := p.(type) {
+	case int:
+		s.note("port %d, published on a random port", p)
+		return
+	case string:
+		spec, pr, _ := strings.Cut(p, "/")
+		proto = pr
+		parts := strings.Split(spec, ":")
+		target = parts[len(parts)-1]
+		switch len(parts) {
+		case 2:
+			published = parts[0]
+		case 3:
+			if parts[0] != "" && parts[0] != "0.0.0.0" && parts[0] != "::" {
+				s.note("port %s, on address %s", p, parts[0])
+				return
+			}
+			published = parts[1]
+		default:
+			s.note("port %s, published on a random port", p)
+			return
+		}
+	case map[string]interface{}:
+		published = fmt.Sprint(p["published"])
+		target = fmt.Sprint(p["target"])
+		proto, _ = p["protocol"].(string)
+		if ip, ok := p["host_ip"].(string); ok && ip != "0.0.0.0" {
+			s.note("port %s, on address %s", compact(p), ip)
+			return
+		}
+	}
+	port, err := strconv.ParseUint(published, 10, 16)
+	if err != nil {
+		s.note("port %s", compact(p))
+		return
+	}
+	typ := "stream"
+	name := fmt.Sprintf("tcp-%d", port)
+	if proto == "udp" {
+		typ = "datagram"
+		name = fmt.Sprintf("udp-%d", port)
+	}
+	s.fields = append(s.fields, fmt.Sprintf("// the service must accept the socket with socket activation, the container port %s is not forwarded", target))
+	c.warnings = append(c.warnings, fmt.Sprintf("service %s: port %d becomes a socket, which only works if the image supports socket activation; container port %s is not forwarded", s.name, port, target))
+	field := fmt.Sprintf("sockets: %s: {port: %d", label(name), port)
+	if typ != "stream" {
+		field += ", type: " + quote(typ)
+	}
+	s.fields = append(s.fields, field + "}")
+}
+
+func (c *converter) networks(s *service, v interface{}) {
+	nets, _ := v.(map[string]interface{})
+	for i, n := range names(v) {
+		b, ok := c.bridges[n]
+		if !ok {
+			b = &bridge{label: n}
+			b.ip, b.prefix = c.freeSubnet()
+			c.bridges[n] = b
+		}
+		iface := fmt.Sprintf("net: ifs: eth%d: {type: \"bridge\", bridge: %s", i, ref("$bridge", n))
+		conf, _ := nets[n].(map[string]interface{})
+		for _, k := range sortedKeys(conf) {
+			switch k {
+			case "ipv4_address":
+				iface += ", ip: " + quote(fmt.Sprint(conf[k]))
+			case "ipv6_address":
+				iface += ", ip6: " + quote(fmt.Sprint(conf[k]))
+			case "aliases":
+				s.note("network %s aliases: %s, the service is reachable by its name", n, compact(conf[k]))
+			default:
+				s.note("network %s %s: %s", n, k, compact(conf[k]))
+			}
+		}
+		s.fields = append(s.fields, iface + "}")
+	}
+}
+
+func (c *converter) restart(s *service, policy string) {
+	switch {
+	case policy == "no":
+	case policy == "always" || policy == "unless-stopped":
+		s.fields = append(s.fields, `restart: "always"`)
+	case policy == "on-failure":
+		s.fields = append(s.fields, `restart: "on-failure"`)
+	case strings.HasPrefix(policy, "on-failure:"):
+		s.fields = append(s.fields, `restart: "on-failure"`)
+		s.note("restart: %s, the number of retries", policy)
+	default:
+		s.note("restart: %s", policy)
+	}
+}
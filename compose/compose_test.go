@@ -0,0 +1,112 @@
+package compose
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"yuri91/sloop/validate"
+)
+
+const sample = `
+version: "3.8"
+services:
+  web:
+    image: nginx
+    depends_on: [db]
+    environment:
+      - MODE=production
+    volumes:
+      - ./html:/usr/share/nginx/html:ro
+      - cache:/var/cache/nginx
+    tmpfs: /tmp
+    restart: unless-stopped
+  db:
+    image: postgres:15
+    environment:
+      POSTGRES_PASSWORD: example
+    volumes:
+      - data:/var/lib/postgresql/data
+    networks:
+      default:
+      backend:
+        ipv4_address: 10.89.1.10
+  worker:
+    image: busybox
+    command: ["sleep", "infinity"]
+    deploy:
+      replicas: 2
+    volumes:
+    networks: [backend]
+volumes:
+  data: {}
+  cache:
+networks:
+  backend:
+    ipam:
+      config:
+        - subnet: 10.89.1.0/24
+`
+
+// convert converts the compose file src and returns the result
+func convert(t *testing.T, src string) (string, error) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "docker-compose.yml")
+	if err := os.WriteFile(p, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := Convert(p)
+	return string(out), err
+}
+
+func TestConvertIsValid(t *testing.T) {
+	out, err := convert(t, sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the routes of the host do not matter
+	old := validate.ProcRoot
+	validate.ProcRoot = t.TempDir()
+	defer func() { validate.ProcRoot = old }()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.cue"), []byte(out), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, violations, err := validate.Load(dir)
+	if err != nil {
+		t.Fatalf("%+v\n%s", err, out)
+	}
+	if err := validate.Error(violations); err != nil {
+		t.Fatalf("%v %v\n%s", err, violations, out)
+	}
+	for _, n := range []string{"web", "db", "worker"} {
+		if _, ok := config.Services[n]; !ok {
+			t.Errorf("service %s is missing", n)
+		}
+	}
+	if len(config.Services["web"].Image.Volumes) != 3 {
+		t.Errorf("web has volumes %v", config.Services["web"].Image.Volumes)
+	}
+	if n := len(config.Services["worker"].Instances); n != 2 {
+		t.Errorf("worker has %d instances", n)
+	}
+	if ip := config.Services["db"].Net.Interfaces["eth0"].Ip; ip != "10.89.1.10" {
+		t.Errorf("db has address %s on backend", ip)
+	}
+}
+
+func TestConvertNullLists(t *testing.T) {
+	_, err := convert(t, "services:\n  web:\n    image: nginx\n    volumes:\n    ports:\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConvertWrongShape(t *testing.T) {
+	_, err := convert(t, "services:\n  web:\n    image: nginx\n    ports: \"8080:80\"\n")
+	if err == nil || !strings.Contains(err.Error(), "ports of service web must be a list") {
+		t.Fatalf("expected an error about ports, got %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+package compose
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	ComposeErrors = errorx.NewNamespace("compose")
+
+	ReadError = ComposeErrors.NewType("read")
+	ConvertError = ComposeErrors.NewType("convert")
+)
@@ -2,47 +2,139 @@ package cue
 
 type Volume struct {
 	Name string
+	Type string
+	ReadOnly bool
+	PerInstance bool
+	Size string
+	// Uid, Gid and Mode are nil if they are not set
+	Uid *int
+	Gid *int
+	Mode *uint32
+	Recursive bool
+	Idmap bool
 }
 type Bridge struct {
 	Name string `json:"name"`
 	Ip string `json:"ip"`
-	Prefix int `json:"prefix"`
+	Prefix int `json:"prefix,omitempty"`
+	Ip6 string `json:"ip6"`
+	Prefix6 int `json:"prefix6,omitempty"`
+	Mode6 string `json:"mode6"`
+}
+type PolicyRule struct {
+	From string
+	To string
+	Port uint16
+	Proto string
+}
+type EgressRule struct {
+	From string
+	To string
+	Port uint16
+	Proto string
+}
+type Policy struct {
+	Default string
+	Egress string
+	Allow []PolicyRule
+	EgressAllow []EgressRule
 }
 type Interface struct {
 	Type string `json:"type"`
 	Name string `json:"name"`
 	Ip string `json:"ip"`
+	Ip6 string `json:"ip6"`
+	// Prefix and Gateway are only used by macvlan and ipvlan interfaces
+	// with a static address
+	Prefix int `json:"prefix"`
+	Gateway string `json:"gateway"`
+	Parent string `json:"parent"`
+	Mode string `json:"mode"`
 	Bridge Bridge `json:"bridge"`
 }
 type Network struct {
 	Interfaces map[string]*Interface `json:"ifs"`
 	Private bool `json:"private"`
 }
+type Pod struct {
+	Name string
+	Net Network
+}
 type File struct {
 	Content string
 	Permissions uint16
+	// Template is true if Content is a Go template, see systemd.FileData
+	Template bool `json:",omitempty"`
 }
 type VolumeMapping struct {
-	Name string
+	Volume `json:"volume"`
 	Dest string
 }
+// Secret only holds the encrypted value, it is decrypted when applying
+// the configuration
+type Secret struct {
+	Age string
+	File string
+	Env string
+}
+// BuildStep has only one of its fields set
+type BuildStep struct {
+	Copy map[string]File `json:",omitempty"`
+	Run []string `json:",omitempty"`
+	Env map[string]string `json:",omitempty"`
+	Workdir string `json:",omitempty"`
+	User string `json:",omitempty"`
+}
+type Build struct {
+	From string
+	Steps []BuildStep
+	Tag string
+}
 type Image struct {
 	From string
+	// Build is nil if the image is fetched
+	Build *Build `json:",omitempty"`
 	Files map[string]File
 	Env map[string]string
 	Volumes []VolumeMapping
+	Secrets map[string]Secret
 }
 type Exec struct {
 	Start []string
 	Reload []string
 }
+type Socket struct {
+	Name string
+	Type string
+	Port uint16
+	Path string
+	// Bridge is nil if the socket listens on all the addresses of the host
+	Bridge *Bridge
+}
+// Instance is an instance of a replicated service
+type Instance struct {
+	Name string
+	// Index is the position of the instance in SortedInstances
+	Index int `json:"-"`
+	Env map[string]string
+	// Net has the addresses of the instance
+	Net Network
+}
 type Service struct {
 	Name  string
 	Image Image
 	Exec Exec
 	Capabilities []string
 	Net Network
+	// Pod is the name of the pod whose network the service joins
+	Pod string
+	Instances map[string]Instance
+	Sockets map[string]Socket
+	// Job is true for jobs, which run to completion and are never enabled
+	Job bool
 	Type string
+	// Restart is "no", "always" or "on-failure"
+	Restart string
 	Enable bool
 	Wants []string
 	Requires []string
@@ -51,18 +143,36 @@ type Service struct {
 type Cmd struct {
 	Service string
 	Action string
+	Command []string
+	Container string
+	// Units are the units of the service, one for every instance if
+	// it is replicated
+	Units []string `json:"-"`
 }
 type Timer struct {
 	Name string
 	Run []Cmd
 	OnCalendar []string
 	OnActiveSec []string
+	OnBootSec []string
+	RandomizedDelaySec string
+	AccuracySec string
 	Persistent bool
+	Freeze []string
+}
+// ValidationRule changes how a rule of the validation is reported
+type ValidationRule struct {
+	// Severity is empty to keep the one of the rule
+	Severity string
+	Ignore []string
 }
 type Config struct {
 	Volumes map[string]Volume `json:"$volumes"`
 	Bridges map[string]Bridge `json:"$bridges"`
 	Services map[string]Service `json:"$services"`
 	Timers map[string]Timer `json:"$timers"`
+	Policies map[string]Policy `json:"$policies"`
+	Pods map[string]Pod `json:"$pods"`
+	Validation map[string]ValidationRule `json:"$rules"`
 }
 
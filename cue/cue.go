@@ -1,110 +1,83 @@
 package cue
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
+	_ "embed"
 	"fmt"
-	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/cuecontext"
 	"cuelang.org/go/cue/format"
 	"cuelang.org/go/cue/load"
+	"cuelang.org/go/cue/token"
 
 	"github.com/samber/lo"
 )
 
-const typesStr = `
-import $__net "net"
-#Volume: {
-	name: string
-}
-#IPPrefix: >0 & <32
-#Bridge: {
-	name: string
-	ip: $__net.IP & string | *"0.0.0.0"
-	prefix: #IPPrefix
-	...
-}
-#Interface: {
-	name: string
-	type: "bridge"
-	bridge: #Bridge
-	ip: $__net.IP & string | *"0.0.0.0"
-	...
-}
-#Network: {
-	private: bool | *true
-	ifs: [Name=_]: #Interface & {name: string | *Name}
-	...
-}
-
-#File: {
-	content:     string
-	permissions: uint16
-} | string
-
-#PortBinding: {
-	host:    uint16
-	service: uint16
-} | uint16
-
-#Image: {
-	from: string
-	files: [string]:  #File
-	env: [string]:    string
-	volumes: [string]: #Volume
-}
-#Exec: {
-	start: [...string] | *[]
-	reload: [...string] | *[]
-}
-#Service: {
-	name:  =~ "^[A-Za-z0-9-]+$"
-	exec: #Exec
-	image: #Image
-	net?: #Network
-	capabilities: [...string] | *[]
-	type: "notify" | "oneshot" | *"simple"
-	enable: bool | *true
-	wants: [...#Dependency]
-	requires: [...#Dependency]
-	after: [...#Dependency]
-	...
-}
+// typesStr is the schema, in scope when the configuration is evaluated
+//go:embed schema/sloop.cue
+var typesStr string
 
-#Cmd: {
-	service: #Service
-	action: "start" | "reload"
-}
-
-#Timer: {
-	name: string
-	run: [...#Cmd]
-	onCalendar: [...string] | *[]
-	onActiveSec: [...string] | *[]
-	persistent: bool | *true
-	...
-}
-
-#UnitName:   =~"^(\\.service)|(\\.target)|(\\.socket)$"
-#Dependency: #Service | #UnitName
-
-`
 const constraintsStr = `
 import "strings"
 
-$volume: [Name=_]: #Volume & {name: string | *strings.Replace(Name,"_","-",-1)}
+$volume: [Name=_]: V=#Volume & {
+	name: string | *strings.Replace(Name,"_","-",-1)
+	// only host volumes are paths
+	_typeCheck: {
+		"\(V.name).is_absolute": (V.name =~ "^/") & (V.type == "host")
+	}
+}
 
 $bridge: [Name=_]: #Bridge & {name: string | *strings.Replace(Name,"_","-",-1)}
 
+$validation: #Validation
+
+$pod: [Name=_]: #Pod & {name: string | *strings.Replace(Name,"_","-",-1)}
+
 $service: [Name=_]: S=#Service & {
 	name: string | *strings.Replace(Name,"_","-",-1)
+	job?: _|_
 	_volumeCheck: {
 		for k, v in S.image.volumes {
 			"\(v.name).is_in_$volume": [ for k1, v1 in $volume if v1.name == v.name {v1}] & [v]
 		}
 	}
+	if S.net != _|_ {
+		instances: [_]: net: S.net
+	}
+	_podCheck: {
+		if S.pod != _|_ {
+			"\(S.pod.name).is_in_$pod": [ for k, v in $pod if v.name == S.pod.name {v}] & [S.pod]
+		}
+	}
+	// a socket would be shared by all the instances of the template
+	_socketCheck: {
+		if len(S.instances) > 0 {
+			"\(S.name).has_no_sockets": [ for k, v in S.sockets {k}] & []
+		}
+	}
+}
+
+$job: [Name=_]: J=#Job & {
+	name: string | *strings.Replace(Name,"_","-",-1)
+	_volumeCheck: {
+		for k, v in J.image.volumes {
+			"\(v.name).is_in_$volume": [ for k1, v1 in $volume if v1.name == v.name {v1}] & [v]
+		}
+	}
+	_podCheck: {
+		if J.pod != _|_ {
+			"\(J.pod.name).is_in_$pod": [ for k, v in $pod if v.name == J.pod.name {v}] & [J.pod]
+		}
+	}
+	// jobs have units named like the ones of services
+	_nameCheck: {
+		"\(J.name).is_not_in_$service": [ for k, v in $service if v.name == J.name {v}] & []
+	}
 }
 
 $timer: [Name=_]: T=#Timer & {
@@ -113,10 +86,14 @@ $timer: [Name=_]: T=#Timer & {
 		for r in T.run {
 			"\(r.service.name).is_in_$service": [ for k, v in $service if v.name == r.service.name {v}] & [r.service]
 		}
+		for f in T.freeze {
+			"\(f.name).to_freeze_is_in_$service": [ for k, v in $service if v.name == f.name {v.name}] & [f.name]
+		}
 	}
 }
 `
 const goTypesStr = `
+$rules: $validation
 $volumes: {
 	for _, v in $volume {
 		"\(v.name)": v&#Volume
@@ -127,22 +104,81 @@ $bridges: {
 		"\(v.name)": v&#Bridge
 	}
 }
-$services: {
+$policies: {
+	for _, b in $bridge if b.policy != _|_ {
+		"\(b.name)": b.policy
+	}
+}
+$pods: {
+	for _, p in $pod {
+		"\(p.name)": {
+			name: p.name
+			net: p.net
+		}
+	}
+}
+// jobs are converted like services
+_hosts: {
 	for _, s in $service {
+		"\(s.name)": s
+	}
+	for _, j in $job {
+		"\(j.name)": j
+	}
+}
+$services: {
+	for _, s in _hosts {
 		"\(s.name)": {
 			name: s.name
+			if s.job != _|_ {
+				job: s.job
+			}
 			type: s.type
+			restart: s.restart
 			exec: s.exec
-			if s.net != _|_ {
+			if s.pod != _|_ {
+				pod: s.pod.name
+				net: s.pod.net
+			}
+			if s.pod == _|_ && s.net != _|_ {
 				net: s.net
 			}
-			if s.net == _|_ {
+			if s.pod == _|_ && s.net == _|_ {
 				net: {
 					private: false
 				}
 			}
 			image: {
 				from: s.image.from
+				if s.image.build != _|_ {
+					build: {
+						from: s.image.build.from
+						tag: s.image.build.tag
+						steps: [
+							for st in s.image.build.steps {
+								if st.copy != _|_ {
+									copy: {
+										for p,f in st.copy {
+											"\(p)": {
+												if f.content != _|_ {
+													content: f.content
+													permissions: f.permissions
+												}
+												if f.content == _|_ {
+													content: f
+													permissions: 0o644
+												}
+											}
+										}
+									}
+								}
+								if st.copy == _|_ {
+									st
+								}
+							}
+						]
+					}
+				}
 				env: s.image.env
 				files: {
 					for p,f in s.image.files {
@@ -150,23 +186,38 @@ $services: {
 							if f.content != _|_ {
 								content: f.content
 								permissions: f.permissions
+								template: f.template
 							}
 							if f.content == _|_ {
 								content: f
 								permissions: 0o666
+								template: false
 							}
 						}
 					}
 				}
+				secrets: s.image.secrets
 				volumes: [
 					for p,v in s.image.volumes {
 						{
-							name: v.name
+							volume: v
 							dest: p
 						}
 					}
 				]
 			}
+			instances: {
+				for n, i in s.instances {
+					"\(n)": {
+						name: i.name
+						env: i.env
+						if i.net != _|_ {
+							net: i.net
+						}
+					}
+				}
+			}
+			sockets: s.sockets
 			enable: s.enable
 			capabilities: s.capabilities
 			wants: [ for w in s.wants {(w & string) | (w.name + ".service")}]
@@ -185,12 +236,24 @@ $timers: {
 					{
 						service: r.service.name + ".service"
 						action: r.action
+						if r.action == "exec" {
+							command: r.command
+							container: r.container
+						}
 					}
 				}
 			]
 			onCalendar: t.onCalendar
 			onActiveSec: t.onActiveSec
+			onBootSec: t.onBootSec
+			if t.randomizedDelaySec != _|_ {
+				randomizedDelaySec: t.randomizedDelaySec
+			}
+			if t.accuracySec != _|_ {
+				accuracySec: t.accuracySec
+			}
 			persistent: t.persistent
+			freeze: [ for f in t.freeze {f.name + ".service"}]
 		}
 	}
 }
@@ -199,64 +262,19 @@ $timers: {
 type BridgePeer struct {
 	Host string
 	Iface *Interface
+	// path of the interface in the configuration
+	Path cue.Path
+	Pos token.Pos
 }
 type BridgeData struct {
 	Bridge
 	Peers []BridgePeer `json:"-"`
+	Pos token.Pos `json:"-"`
 }
 type HostData struct {
 	Name string `json:"name"`
 	Net Network `json:"net"`
-}
-func nonull(ptr []byte, msg string) {
-	if ptr == nil {
-		panic(msg)
-	}
-}
-func ip2int(ipStr string) uint32 {
-	ip := net.ParseIP(ipStr)[12:]
-	nonull(ip, "ipStr must be a valid ip")
-	return binary.BigEndian.Uint32(ip)
-}
-func ip2intPrefix(ipStr string, prefix uint32) uint32 {
-	ip := net.ParseIP(ipStr)
-	nonull(ip, "ipStr must be a valid ip")
-	mask := net.CIDRMask(int(prefix), 32)
-	nonull(mask, "prefix must be a valid subnet prefix")
-	masked := ip.Mask(mask)
-	nonull(masked, "mask operation cannot fail")
-	return binary.BigEndian.Uint32(masked)
-}
-
-func int2ip(nn uint32) string {
-	ip := make(net.IP, 4)
-	binary.BigEndian.PutUint32(ip, nn)
-	return ip.String()
-}
-func hashBits(input string, mask uint32) uint32 {
-	sha := sha256.Sum256([]byte(input))
-	n := binary.BigEndian.Uint32(sha[0:4])
-	n = n & mask
-	return n
-}
-func allocateIp(allocMap map[uint32]bool, start uint32, end uint32,name string) (uint32, error) {
-	mask := end-start-1
-	candidate := start + 1 + hashBits(name, mask)
-	if candidate >= end {
-		candidate = start + 1
-	}
-	for {
-		_, exists := allocMap[candidate]
-		if !exists {
-			break;
-		}
-		candidate++
-		if candidate >= end {
-			return 0, IpInjectError.New("Ip range exausted")
-		}
-	}
-	allocMap[candidate] = true
-	return candidate, nil
+	Instances map[string]HostData `json:"instances"`
 }
 func injectIPs(value cue.Value) (*cue.Value, error) {
 	bridgeMap := make(map[string]BridgeData)
@@ -265,50 +283,127 @@ func injectIPs(value cue.Value) (*cue.Value, error) {
 	if err != nil {
 		return nil, DecodeError.Wrap(err, "Error during decoding into go type")
 	}
+	for label, b := range bridgeMap {
+		b.Pos = bridgesVal.LookupPath(cue.MakePath(cue.Str(label))).Pos()
+		bridgeMap[label] = b
+	}
 	bridgeMap = lo.MapKeys(bridgeMap, func(v BridgeData, _ string) string {
 		return v.Name
 	})
-	hostMap := make(map[string]HostData)
-	hostsVal := value.LookupPath(cue.ParsePath("$service"))
-	err = hostsVal.Decode(&hostMap)
-	if err != nil {
-		return nil, DecodeError.Wrap(err, "Error during decoding into go type")
-	}
-	for _, host := range hostMap {
-		for _, iface := range host.Net.Interfaces {
-			b := bridgeMap[iface.Bridge.Name]
-			b.Peers = append(b.Peers, BridgePeer{host.Name, iface})
-			bridgeMap[iface.Bridge.Name] = b
+	// Pods own the network of their members, so they are the hosts
+	// that get an address
+	for _, kind := range []string{"$service", "$job", "$pod"} {
+		hostMap := make(map[string]HostData)
+		hostsVal := value.LookupPath(cue.ParsePath(kind))
+		err = hostsVal.Decode(&hostMap)
+		if err != nil {
+			return nil, DecodeError.Wrap(err, "Error during decoding into go type")
 		}
-	}
-	for _, bridge := range bridgeMap {
-		start := ip2intPrefix(bridge.Ip, uint32(bridge.Prefix))
-		end := start + (1<<bridge.Prefix)
-		ip := ip2int(bridge.Ip)
-		allocMap := make(map[uint32]bool)
-		allocMap[ip] = true
-		if ip := ip2int(bridge.Ip); ip != 0 {
-			allocMap[ip] = true
+		addPeers := func(name string, net Network, path ...cue.Selector) {
+			for ifLabel, iface := range net.Interfaces {
+				if iface == nil || iface.Type != "bridge" {
+					continue
+				}
+				sels := append(append([]cue.Selector{}, path...), cue.Str("net"), cue.Str("ifs"), cue.Str(ifLabel))
+				b := bridgeMap[iface.Bridge.Name]
+				path := cue.MakePath(sels...)
+				b.Peers = append(b.Peers, BridgePeer{name, iface, path, value.LookupPath(path).Pos()})
+				bridgeMap[iface.Bridge.Name] = b
+			}
 		}
-		for _, i := range bridge.Peers {
-			if ip := ip2int(i.Iface.Ip); ip != 0 {
-				allocMap[ip] = true
+		for hostLabel, host := range hostMap {
+			// Every instance gets its own addresses, the base service
+			// does not need any
+			if len(host.Instances) > 0 {
+				for ifLabel, iface := range host.Net.Interfaces {
+					if iface != nil && (isStaticAddr(iface.Ip) || isStaticAddr(iface.Ip6)) {
+						path := cue.MakePath(cue.Str(kind), cue.Str(hostLabel), cue.Str("net"), cue.Str("ifs"), cue.Str(ifLabel))
+						return nil, IpInjectError.New("interface %s of %s has a static address, which all of its instances would share", ifLabel, host.Name).WithProperty(PositionProperty, value.LookupPath(path).Pos())
+					}
+				}
+				for instLabel, inst := range host.Instances {
+					addPeers(InstanceHost(host.Name, inst.Name), inst.Net, cue.Str(kind), cue.Str(hostLabel), cue.Str("instances"), cue.Str(instLabel))
+				}
+				continue
 			}
+			addPeers(host.Name, host.Net, cue.Str(kind), cue.Str(hostLabel))
 		}
-		for _, i := range bridge.Peers {
-			if ip := ip2int(i.Iface.Ip); ip != 0 {
-				continue;
+	}
+	for _, bridge := range bridgeMap {
+		if bridge.Prefix != 0 {
+			err := injectBridgeIPs(bridge.Name, bridge.Pos, bridge.Ip, bridge.Prefix, bridge.Peers, func(i *Interface) *string {
+				return &i.Ip
+			})
+			if err != nil {
+				return nil, err
 			}
-			ip, err := allocateIp(allocMap, start, end, i.Host+i.Iface.Name)
+		}
+		if bridge.Prefix6 != 0 {
+			err := injectBridgeIPs(bridge.Name, bridge.Pos, bridge.Ip6, bridge.Prefix6, bridge.Peers, func(i *Interface) *string {
+				return &i.Ip6
+			})
 			if err != nil {
 				return nil, err
 			}
-			i.Iface.Ip = int2ip(ip)
 		}
 	}
-	newVal := value.FillPath(cue.ParsePath("$service"), hostMap)
-	return &newVal, nil
+	// Only fill in the addresses: the other interface types have fields
+	// that the go type cannot represent faithfully
+	for _, bridge := range bridgeMap {
+		for _, p := range bridge.Peers {
+			value = value.FillPath(p.Path, map[string]string{"ip": p.Iface.Ip, "ip6": p.Iface.Ip6})
+		}
+	}
+	return &value, nil
 }
+
+// isStaticAddr returns true if ip is an address set in the configuration,
+// rather than one to allocate
+func isStaticAddr(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && !addr.IsUnspecified()
+}
+
+// injectBridgeIPs allocates an address in the subnet of a bridge for every
+// peer that does not have a static one. addr selects the address of the
+// interface to fill in, so that the same code serves both IPv4 and IPv6.
+func injectBridgeIPs(name string, pos token.Pos, ip string, prefixLen int, peers []BridgePeer, addr func(*Interface) *string) error {
+	bridgeIp, err := netip.ParseAddr(ip)
+	if err != nil {
+		return IpInjectError.Wrap(err, "invalid address %s for bridge %s", ip, name).WithProperty(PositionProperty, pos)
+	}
+	prefix, err := bridgeIp.Prefix(prefixLen)
+	if err != nil {
+		return IpInjectError.Wrap(err, "invalid prefix %d for bridge %s", prefixLen, name).WithProperty(PositionProperty, pos)
+	}
+	alloc := newAllocator(prefix)
+	alloc.reserve(bridgeIp)
+	for _, i := range peers {
+		if peerIp, err := netip.ParseAddr(*addr(i.Iface)); err == nil && !peerIp.IsUnspecified() {
+			if !prefix.Contains(peerIp) {
+				return IpInjectError.New("address %s of %s is not in the subnet %s of bridge %s", peerIp, i.Host, prefix, name).WithProperty(PositionProperty, i.Pos)
+			}
+			alloc.reserve(peerIp)
+		}
+	}
+	// Allocate in a stable order, so that collisions are resolved
+	// the same way every time
+	sort.Slice(peers, func(a, b int) bool {
+		return peers[a].Host+peers[a].Iface.Name < peers[b].Host+peers[b].Iface.Name
+	})
+	for _, i := range peers {
+		if isStaticAddr(*addr(i.Iface)) {
+			continue
+		}
+		peerIp, err := alloc.allocate(i.Host + i.Iface.Name)
+		if err != nil {
+			return IpInjectError.Wrap(err, "cannot allocate address for %s on bridge %s", i.Host, name).WithProperty(PositionProperty, i.Pos)
+		}
+		*addr(i.Iface) = peerIp.String()
+	}
+	return nil
+}
+
 func GetCueConfig(path string) (*cue.Value, error) {
 	// We need a cue.Context, the New'd return is ready to use
 	ctx := cuecontext.New()
@@ -318,8 +413,9 @@ func GetCueConfig(path string) (*cue.Value, error) {
 
 	// Load Cue files into Cue build.Instances slice
 	// the second arg is a configuration object, we'll see this later
-	bis := load.Instances([]string{path}, &load.Config {
+	bis := load.Instances([]string{"."}, &load.Config {
 		Package: "main",
+		Dir: path,
 	})
 	bi := bis[0]
 
@@ -332,12 +428,13 @@ func GetCueConfig(path string) (*cue.Value, error) {
 	// Use cue.Context to turn build.Instance to cue.Instance
 	value := ctx.BuildInstance(bi, cue.Scope(types))
 	if value.Err() != nil {
-		return nil, BuildError.Wrap(value.Err(), "Error during build")
+		return nil, BuildError.Wrap(value.Err(), "Error during build").WithProperty(ValueProperty, value)
 	}
 
+	built := value
 	value = value.Unify(constraints)
 	if value.Err() != nil {
-		return nil, ConstraintError.Wrap(value.Err(), "Error during constrain")
+		return nil, ConstraintError.Wrap(value.Err(), "Error during constrain").WithProperty(ValueProperty, built)
 	}
 
 	value = value.Unify(types)
@@ -365,6 +462,7 @@ func GetGoConfig(scope cue.Value) (*Config, error) {
 	if err != nil {
 		return nil, DecodeError.Wrap(err, "Error during decoding into go type")
 	}
+	resolveInstances(&conf)
 	return &conf,nil
 }
 
@@ -376,6 +474,81 @@ func GetConfig(path string) (*Config, error) {
 	return GetGoConfig(*scope)
 }
 
+// InstanceHost is the host name of an instance of a replicated service
+func InstanceHost(service string, instance string) string {
+	return service + "-" + instance
+}
+
+// Units returns the units that run the service: one for every instance
+// if the service is replicated
+func (s *Service) Units() []string {
+	if len(s.Instances) == 0 {
+		return []string{s.Name + ".service"}
+	}
+	return lo.Map(s.SortedInstances(), func(i Instance, _ int) string {
+		return s.Name + "@" + i.Name + ".service"
+	})
+}
+
+// UnitFile returns the name of the unit file of the service, which is
+// a template if the service is replicated
+func (s *Service) UnitFile() string {
+	if len(s.Instances) == 0 {
+		return s.Name + ".service"
+	}
+	return s.Name + "@.service"
+}
+
+// SortedInstances returns the instances of the service, numbered ones
+// in numeric order
+func (s *Service) SortedInstances() []Instance {
+	instances := lo.Values(s.Instances)
+	sort.Slice(instances, func(a, b int) bool {
+		na, errA := strconv.Atoi(instances[a].Name)
+		nb, errB := strconv.Atoi(instances[b].Name)
+		if errA == nil && errB == nil {
+			return na < nb
+		}
+		return instances[a].Name < instances[b].Name
+	})
+	for i := range instances {
+		instances[i].Index = i
+	}
+	return instances
+}
+
+// resolveInstances makes the dependencies on a replicated service, and
+// the timers that run it, refer to all of its instances
+func resolveInstances(conf *Config) {
+	expand := func(deps []string) []string {
+		return lo.FlatMap(deps, func(d string, _ int) []string {
+			if s, ok := conf.Services[strings.TrimSuffix(d, ".service")]; ok {
+				return s.Units()
+			}
+			return []string{d}
+		})
+	}
+	for n, s := range conf.Services {
+		s.Wants = expand(s.Wants)
+		s.Requires = expand(s.Requires)
+		s.After = expand(s.After)
+		for i, inst := range s.Instances {
+			if len(inst.Net.Interfaces) == 0 {
+				inst.Net = s.Net
+			}
+			s.Instances[i] = inst
+		}
+		conf.Services[n] = s
+	}
+	for n, t := range conf.Timers {
+		for i, r := range t.Run {
+			t.Run[i].Units = expand([]string{r.Service})
+		}
+		t.Freeze = expand(t.Freeze)
+		conf.Timers[n] = t
+	}
+}
+
 func Print(value cue.Value, pathStr string) {
 	path := cue.ParsePath(pathStr)
 	print := value.LookupPath(path);
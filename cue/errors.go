@@ -14,4 +14,12 @@ var (
 	ValidateError = CueErrors.NewType("validate")
 	DecodeError = CueErrors.NewType("decode")
 	IpInjectError = CueErrors.NewType("ip_inject")
+	SchemaError = CueErrors.NewType("schema")
+
+	// PositionProperty is the token.Pos of the value an error is about,
+	// for errors that are not reported by CUE
+	PositionProperty = errorx.RegisterProperty("position")
+	// ValueProperty is the configuration as written, before the checks
+	// of sloop, to find the position of the values an error is about
+	ValueProperty = errorx.RegisterProperty("value")
 )
@@ -0,0 +1,88 @@
+package cue
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"net/netip"
+)
+
+// allocator assigns addresses in a subnet. The address of a name is
+// derived from its hash, so that it stays the same across runs as long
+// as there are no collisions.
+type allocator struct {
+	prefix netip.Prefix
+	used map[netip.Addr]bool
+}
+
+func newAllocator(prefix netip.Prefix) *allocator {
+	return &allocator{prefix: prefix.Masked(), used: make(map[netip.Addr]bool)}
+}
+
+func (a *allocator) reserve(addr netip.Addr) {
+	a.used[addr] = true
+}
+
+func addrToInt(addr netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(addr.AsSlice())
+}
+
+func intToAddr(n *big.Int, is4 bool) netip.Addr {
+	size := 16
+	if is4 {
+		size = 4
+	}
+	b := make([]byte, size)
+	n.FillBytes(b)
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// allocate returns a free address for name. The network address, and the
+// broadcast address for IPv4, are never returned.
+func (a *allocator) allocate(name string) (netip.Addr, error) {
+	is4 := a.prefix.Addr().Is4()
+	hostBits := a.prefix.Addr().BitLen() - a.prefix.Bits()
+	// Number of usable offsets, starting from 1
+	usable := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+	usable.Sub(usable, big.NewInt(1))
+	if is4 {
+		usable.Sub(usable, big.NewInt(1))
+	}
+	if usable.Sign() <= 0 {
+		return netip.Addr{}, IpInjectError.New("subnet %s is too small", a.prefix)
+	}
+
+	sha := sha256.Sum256([]byte(name))
+	var offset *big.Int
+	if is4 {
+		// the first 32 bits of the hash, masked to the size of the
+		// subnet, as sloop always did: the addresses of existing
+		// services do not change
+		h := binary.BigEndian.Uint32(sha[0:4]) & uint32(1<<hostBits - 1)
+		offset = new(big.Int).SetUint64(uint64(h))
+		if offset.Cmp(usable) >= 0 {
+			offset.SetInt64(0)
+		}
+	} else {
+		offset = new(big.Int).SetBytes(sha[:16])
+		offset.Mod(offset, usable)
+	}
+
+	base := addrToInt(a.prefix.Addr())
+	one := big.NewInt(1)
+	for tries := new(big.Int); tries.Cmp(usable) < 0; tries.Add(tries, one) {
+		candidate := new(big.Int).Add(base, one)
+		candidate.Add(candidate, offset)
+		addr := intToAddr(candidate, is4)
+		if !a.used[addr] {
+			a.used[addr] = true
+			return addr, nil
+		}
+		offset.Add(offset, one)
+		if offset.Cmp(usable) >= 0 {
+			offset.SetInt64(0)
+		}
+	}
+	return netip.Addr{}, IpInjectError.New("Ip range exausted")
+}
@@ -0,0 +1,106 @@
+package cue
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joomcode/errorx"
+)
+
+func allocate(t *testing.T, a *allocator, name string) netip.Addr {
+	addr, err := a.allocate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestAllocateIPv4(t *testing.T) {
+	// the addresses sloop always gave, from the first 32 bits of the hash
+	// of the host and the interface
+	tests := []struct {
+		prefix string
+		name string
+		want string
+	}{
+		{"10.0.0.0/16", "webeth0", "10.0.34.214"},
+		{"10.0.0.1/24", "webeth0", "10.0.0.214"},
+		{"10.0.0.0/16", "dbeth0", "10.0.133.99"},
+	}
+	for _, test := range tests {
+		a := newAllocator(netip.MustParsePrefix(test.prefix))
+		if got := allocate(t, a, test.name); got.String() != test.want {
+			t.Errorf("%s in %s: expected %s, got %s", test.name, test.prefix, test.want, got)
+		}
+	}
+}
+
+func TestAllocateIPv6(t *testing.T) {
+	prefix := netip.MustParsePrefix("fd00:1::/64")
+	a := newAllocator(prefix)
+	got := allocate(t, a, "webeth0")
+	if got.String() != "fd00:1::c326:d3d0:f466:db96" {
+		t.Errorf("expected fd00:1::c326:d3d0:f466:db96, got %s", got)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		addr := allocate(t, a, name)
+		if !prefix.Contains(addr) || addr == prefix.Addr() {
+			t.Errorf("%s got %s, which is not a host of %s", name, addr, prefix)
+		}
+	}
+}
+
+func TestAllocateCollisions(t *testing.T) {
+	a := newAllocator(netip.MustParsePrefix("10.0.0.0/24"))
+	a.reserve(netip.MustParseAddr("10.0.0.214"))
+	if got := allocate(t, a, "webeth0"); got.String() != "10.0.0.215" {
+		t.Errorf("expected the next address 10.0.0.215, got %s", got)
+	}
+	// the same name again gets the next free address
+	if got := allocate(t, a, "webeth0"); got.String() != "10.0.0.216" {
+		t.Errorf("expected 10.0.0.216, got %s", got)
+	}
+
+	// a /30 has two hosts: the search wraps around, and never returns the
+	// network or the broadcast address
+	a = newAllocator(netip.MustParsePrefix("192.0.2.0/30"))
+	seen := map[netip.Addr]bool{}
+	for _, name := range []string{"a", "b"} {
+		addr := allocate(t, a, name)
+		if addr.String() != "192.0.2.1" && addr.String() != "192.0.2.2" {
+			t.Errorf("%s got %s", name, addr)
+		}
+		seen[addr] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected two addresses, got %v", seen)
+	}
+	if _, err := a.allocate("c"); !errorx.IsOfType(err, IpInjectError) {
+		t.Errorf("expected the range to be exhausted, got %v", err)
+	}
+
+	a = newAllocator(netip.MustParsePrefix("192.0.2.0/31"))
+	if _, err := a.allocate("a"); !errorx.IsOfType(err, IpInjectError) {
+		t.Errorf("expected the subnet to be too small, got %v", err)
+	}
+}
+
+func TestInjectIPs(t *testing.T) {
+	dir := t.TempDir()
+	src := `package main
+$bridge: br0: {ip: "10.0.0.1", prefix: 16}
+$service: web: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br0}}
+`
+	if err := os.WriteFile(filepath.Join(dir, "main.cue"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := GetConfig(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if ip := conf.Services["web"].Net.Interfaces["eth0"].Ip; ip != "10.0.34.214" {
+		t.Errorf("expected web to keep 10.0.34.214, got %s", ip)
+	}
+}
@@ -0,0 +1,535 @@
+package cue
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/format"
+	"cuelang.org/go/cue/literal"
+	"cuelang.org/go/cue/parser"
+	"cuelang.org/go/cue/token"
+
+	"github.com/samber/lo"
+)
+
+// SchemaPackage is the import path of the schema when it is installed
+// in cue.mod
+const SchemaPackage = "github.com/yuri91/sloop"
+
+// configFields are the top level fields of a configuration, with the
+// definition of their entries
+var configFields = map[string]string{
+	"$volume": "Volume",
+	"$bridge": "Bridge",
+	"$pod": "Pod",
+	"$service": "Service",
+	"$job": "Job",
+	"$timer": "Timer",
+}
+
+type jsonSchema = map[string]interface{}
+
+// schemaGen converts the definitions of the schema to JSON Schema. It
+// works on the syntax, since most fields depend on others and have no
+// schema until they are evaluated. Conditional fields become optional.
+type schemaGen struct {
+	// ref is the prefix of references to other definitions
+	ref string
+}
+
+// ExportSchema returns the schema in format, which is one of "cue",
+// "jsonschema" or "openapi"
+func ExportSchema(format string) ([]byte, error) {
+	switch format {
+	case "cue":
+		return []byte(typesStr), nil
+	case "jsonschema":
+		g := schemaGen{ref: "#/$defs/"}
+		defs, err := g.definitions()
+		if err != nil {
+			return nil, err
+		}
+		doc := g.config()
+		doc["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+		doc["title"] = "sloop configuration"
+		doc["$defs"] = defs
+		return marshalSchema(doc)
+	case "openapi":
+		g := schemaGen{ref: "#/components/schemas/"}
+		defs, err := g.definitions()
+		if err != nil {
+			return nil, err
+		}
+		defs["Config"] = g.config()
+		return marshalSchema(jsonSchema{
+			"openapi": "3.1.0",
+			"info": jsonSchema{"title": "sloop configuration", "version": "1"},
+			"paths": jsonSchema{},
+			"components": jsonSchema{"schemas": defs},
+		})
+	}
+	return nil, SchemaError.New("unknown schema format %s", format)
+}
+
+func marshalSchema(doc jsonSchema) ([]byte, error) {
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, SchemaError.Wrap(err, "cannot marshal schema")
+	}
+	return append(b, '\n'), nil
+}
+
+// config is the schema of a whole configuration
+func (g *schemaGen) config() jsonSchema {
+	props := jsonSchema{}
+	for f, def := range configFields {
+		props[f] = jsonSchema{
+			"type": "object",
+			"additionalProperties": jsonSchema{"$ref": g.ref + def},
+		}
+	}
+	props["$validation"] = jsonSchema{"$ref": g.ref + "Validation"}
+	return jsonSchema{"type": "object", "properties": props}
+}
+
+func (g *schemaGen) definitions() (jsonSchema, error) {
+	f, err := parser.ParseFile("sloop.cue", typesStr, parser.ParseComments)
+	if err != nil {
+		return nil, SchemaError.Wrap(err, "cannot parse schema")
+	}
+	defs := jsonSchema{}
+	for _, d := range f.Decls {
+		field, ok := d.(*ast.Field)
+		if !ok {
+			continue
+		}
+		name, _, err := ast.LabelName(field.Label)
+		if err != nil || !strings.HasPrefix(name, "#") {
+			continue
+		}
+		s := g.expr(field.Value, false)
+		if doc := docComment(field); doc != "" {
+			s["description"] = doc
+		}
+		defs[strings.TrimPrefix(name, "#")] = s
+	}
+	return defs, nil
+}
+
+func docComment(n ast.Node) string {
+	var lines []string
+	for _, c := range ast.Comments(n) {
+		if c.Doc {
+			lines = append(lines, strings.Fields(c.Text())...)
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
+// literalValue returns the value of literals, like defaults
+func literalValue(e ast.Expr) (interface{}, bool) {
+	switch x := e.(type) {
+	case *ast.ParenExpr:
+		return literalValue(x.X)
+	case *ast.BasicLit:
+		switch x.Kind {
+		case token.STRING:
+			s, err := literal.Unquote(x.Value)
+			return s, err == nil
+		case token.INT:
+			n, err := strconv.ParseInt(strings.ReplaceAll(x.Value, "_", ""), 0, 64)
+			return n, err == nil
+		case token.FLOAT:
+			n, err := strconv.ParseFloat(x.Value, 64)
+			return n, err == nil
+		case token.TRUE, token.FALSE:
+			return x.Kind == token.TRUE, true
+		case token.NULL:
+			return nil, true
+		}
+	case *ast.Ident:
+		switch x.Name {
+		case "true", "false":
+			return x.Name == "true", true
+		case "null":
+			return nil, true
+		}
+	case *ast.ListLit:
+		l := []interface{}{}
+		for _, e := range x.Elts {
+			v, ok := literalValue(e)
+			if !ok {
+				return nil, false
+			}
+			l = append(l, v)
+		}
+		return l, true
+	}
+	return nil, false
+}
+
+func hasDefault(e ast.Expr) bool {
+	switch x := e.(type) {
+	case *ast.ParenExpr:
+		return hasDefault(x.X)
+	case *ast.UnaryExpr:
+		return x.Op == token.MUL
+	case *ast.BinaryExpr:
+		return x.Op == token.OR && (hasDefault(x.X) || hasDefault(x.Y))
+	}
+	return false
+}
+
+// operands flattens a chain of the same binary operator
+func operands(e ast.Expr, op token.Token) []ast.Expr {
+	if p, ok := e.(*ast.ParenExpr); ok {
+		return operands(p.X, op)
+	}
+	if b, ok := e.(*ast.BinaryExpr); ok && b.Op == op {
+		return append(operands(b.X, op), operands(b.Y, op)...)
+	}
+	return []ast.Expr{e}
+}
+
+func (g *schemaGen) expr(e ast.Expr, inAnd bool) jsonSchema {
+	switch x := e.(type) {
+	case *ast.ParenExpr:
+		return g.expr(x.X, inAnd)
+	case *ast.Ident:
+		switch x.Name {
+		case "string":
+			return jsonSchema{"type": "string"}
+		case "int":
+			return jsonSchema{"type": "integer"}
+		case "uint":
+			return jsonSchema{"type": "integer", "minimum": 0}
+		case "uint16":
+			return jsonSchema{"type": "integer", "minimum": 0, "maximum": 65535}
+		case "number", "float":
+			return jsonSchema{"type": "number"}
+		case "bool":
+			return jsonSchema{"type": "boolean"}
+		}
+		if strings.HasPrefix(x.Name, "#") {
+			return jsonSchema{"$ref": g.ref + strings.TrimPrefix(x.Name, "#")}
+		}
+		if v, ok := literalValue(x); ok {
+			return jsonSchema{"const": v}
+		}
+		return jsonSchema{}
+	case *ast.BasicLit:
+		if v, ok := literalValue(x); ok {
+			return jsonSchema{"const": v}
+		}
+		return jsonSchema{}
+	case *ast.BottomLit:
+		return jsonSchema{"not": jsonSchema{}}
+	case *ast.SelectorExpr:
+		pkg, _ := x.X.(*ast.Ident)
+		sel, _, _ := ast.LabelName(x.Sel)
+		if pkg != nil && pkg.Name == "$__net" {
+			switch sel {
+			case "IPv4":
+				return jsonSchema{"type": "string", "format": "ipv4"}
+			case "IP":
+				return jsonSchema{"type": "string", "anyOf": []jsonSchema{{"format": "ipv4"}, {"format": "ipv6"}}}
+			}
+		}
+		return jsonSchema{}
+	case *ast.UnaryExpr:
+		return g.unary(x)
+	case *ast.BinaryExpr:
+		switch x.Op {
+		case token.OR:
+			return g.disjunction(operands(x, token.OR))
+		case token.AND:
+			return g.conjunction(operands(x, token.AND))
+		}
+		return jsonSchema{}
+	case *ast.StructLit:
+		return g.object(x, inAnd)
+	case *ast.ListLit:
+		return g.list(x)
+	case *ast.CallExpr:
+		if fun, ok := x.Fun.(*ast.Ident); ok && fun.Name == "close" && len(x.Args) == 1 {
+			s := g.expr(x.Args[0], false)
+			s["additionalProperties"] = false
+			return s
+		}
+		return jsonSchema{}
+	}
+	return jsonSchema{}
+}
+
+func (g *schemaGen) unary(x *ast.UnaryExpr) jsonSchema {
+	if x.Op == token.MUL {
+		return g.expr(x.X, false)
+	}
+	v, ok := literalValue(x.X)
+	if !ok {
+		return jsonSchema{}
+	}
+	switch x.Op {
+	case token.MAT:
+		return jsonSchema{"type": "string", "pattern": v}
+	case token.NMAT:
+		return jsonSchema{"type": "string", "not": jsonSchema{"pattern": v}}
+	case token.GEQ:
+		return jsonSchema{"minimum": v}
+	case token.GTR:
+		return jsonSchema{"exclusiveMinimum": v}
+	case token.LEQ:
+		return jsonSchema{"maximum": v}
+	case token.LSS:
+		return jsonSchema{"exclusiveMaximum": v}
+	case token.NEQ:
+		return jsonSchema{"not": jsonSchema{"const": v}}
+	case token.SUB:
+		if n, ok := v.(int64); ok {
+			return jsonSchema{"const": -n}
+		}
+	}
+	return jsonSchema{}
+}
+
+func (g *schemaGen) disjunction(alts []ast.Expr) jsonSchema {
+	var def interface{}
+	hasDef := false
+	var schemas []jsonSchema
+	for _, a := range alts {
+		u, isDef := a.(*ast.UnaryExpr)
+		isDef = isDef && u.Op == token.MUL
+		if isDef {
+			// computed defaults say nothing about the type
+			v, ok := literalValue(u.X)
+			if !ok {
+				continue
+			}
+			def, hasDef = v, true
+			schemas = append(schemas, jsonSchema{"const": v})
+			continue
+		}
+		s := g.expr(a, false)
+		if len(s) == 0 {
+			// anything is allowed
+			schemas = nil
+			break
+		}
+		schemas = append(schemas, s)
+	}
+	var s jsonSchema
+	switch {
+	case len(schemas) == 0:
+		s = jsonSchema{}
+	case lo.EveryBy(schemas, func(s jsonSchema) bool { _, ok := s["const"]; return len(s) == 1 && ok }):
+		s = jsonSchema{"enum": lo.Map(schemas, func(s jsonSchema, _ int) interface{} { return s["const"] })}
+		if len(schemas) == 1 {
+			s = schemas[0]
+		}
+	default:
+		// a literal default is usually also allowed by the other
+		// alternatives, like in [...string] | *[]
+		if hasDef && len(schemas) > 1 {
+			schemas = lo.Filter(schemas, func(s jsonSchema, _ int) bool {
+				c, ok := s["const"]
+				return !ok || !reflect.DeepEqual(c, def)
+			})
+		}
+		s = jsonSchema{"anyOf": schemas}
+		if len(schemas) == 1 {
+			s = schemas[0]
+		}
+	}
+	if hasDef {
+		s = lo.Assign(s, jsonSchema{"default": def})
+	}
+	return s
+}
+
+func (g *schemaGen) conjunction(ops []ast.Expr) jsonSchema {
+	var schemas []jsonSchema
+	hasRef := false
+	for _, o := range ops {
+		s := g.expr(o, true)
+		if len(s) == 0 {
+			continue
+		}
+		_, ref := s["$ref"]
+		hasRef = hasRef || ref
+		schemas = append(schemas, s)
+	}
+	if len(schemas) == 0 {
+		return jsonSchema{}
+	}
+	if len(schemas) == 1 {
+		return schemas[0]
+	}
+	if hasRef {
+		return jsonSchema{"allOf": schemas}
+	}
+	merged := jsonSchema{}
+	for _, s := range schemas {
+		for k, v := range s {
+			if old, ok := merged[k]; ok && !reflect.DeepEqual(old, v) {
+				return jsonSchema{"allOf": schemas}
+			}
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func (g *schemaGen) list(x *ast.ListLit) jsonSchema {
+	var prefix []jsonSchema
+	var rest jsonSchema
+	for _, e := range x.Elts {
+		if el, ok := e.(*ast.Ellipsis); ok {
+			rest = jsonSchema{}
+			if el.Type != nil {
+				rest = g.expr(el.Type, false)
+			}
+			break
+		}
+		prefix = append(prefix, g.expr(e, false))
+	}
+	s := jsonSchema{"type": "array"}
+	if rest == nil {
+		s["maxItems"] = len(prefix)
+	} else if len(rest) > 0 {
+		s["items"] = rest
+	}
+	if len(prefix) > 0 {
+		s["minItems"] = len(prefix)
+		// the common case of [T, ...T]
+		if !lo.EveryBy(prefix, func(p jsonSchema) bool { return reflect.DeepEqual(p, rest) }) {
+			s["prefixItems"] = prefix
+		}
+	}
+	return s
+}
+
+// condition describes the condition of a conditional field
+func condition(e ast.Expr) string {
+	if b, ok := e.(*ast.BinaryExpr); ok {
+		if _, bottom := b.Y.(*ast.BottomLit); bottom {
+			x, err := format.Node(b.X)
+			if err == nil && b.Op == token.NEQ {
+				return string(x) + " is set"
+			}
+			if err == nil && b.Op == token.EQL {
+				return string(x) + " is not set"
+			}
+		}
+	}
+	b, err := format.Node(e)
+	if err != nil {
+		return "some condition"
+	}
+	return string(b)
+}
+
+// object converts a struct. Structs are closed in definitions, unless
+// they are unified with other ones.
+func (g *schemaGen) object(x *ast.StructLit, inAnd bool) jsonSchema {
+	closed := !inAnd
+	props := jsonSchema{}
+	patterns := jsonSchema{}
+	var required []string
+	var additional jsonSchema
+
+	var field func(f *ast.Field, cond string)
+	field = func(f *ast.Field, cond string) {
+		if pattern, ok := f.Label.(*ast.ListLit); ok && len(pattern.Elts) == 1 {
+			key := pattern.Elts[0]
+			if a, ok := key.(*ast.Alias); ok {
+				key = a.Expr
+			}
+			value := g.expr(f.Value, inAnd)
+			if u, ok := key.(*ast.UnaryExpr); ok && u.Op == token.MAT {
+				if re, ok := literalValue(u.X); ok {
+					patterns[re.(string)] = value
+					return
+				}
+			}
+			additional = value
+			return
+		}
+		name, _, err := ast.LabelName(f.Label)
+		if err != nil || strings.HasPrefix(name, "_") || strings.HasPrefix(name, "#") {
+			return
+		}
+		if _, ok := props[name]; ok {
+			return
+		}
+		if _, bottom := f.Value.(*ast.BottomLit); bottom && cond != "" {
+			return
+		}
+		s := g.expr(f.Value, inAnd)
+		desc := docComment(f)
+		if desc != "" && cond != "" && !strings.HasSuffix(desc, ".") {
+			desc += "."
+		}
+		if cond != "" {
+			desc = strings.TrimSpace(desc + " Only when " + cond + ".")
+		}
+		if desc != "" {
+			s = lo.Assign(s, jsonSchema{"description": desc})
+		}
+		props[name] = s
+		_, isConst := s["const"]
+		t, _ := s["type"].(string)
+		if cond == "" && f.Optional == token.NoPos && !hasDefault(f.Value) && !isConst &&
+			name != "name" && t != "" && t != "object" && t != "array" {
+			required = append(required, name)
+		}
+	}
+
+	for _, d := range x.Elts {
+		switch e := d.(type) {
+		case *ast.Field:
+			field(e, "")
+		case *ast.Ellipsis:
+			closed = false
+		case *ast.Comprehension:
+			var conds []string
+			ok := true
+			for _, c := range e.Clauses {
+				switch c := c.(type) {
+				case *ast.IfClause:
+					conds = append(conds, condition(c.Condition))
+				default:
+					ok = false
+				}
+			}
+			body, isStruct := e.Value.(*ast.StructLit)
+			if !ok || !isStruct {
+				continue
+			}
+			for _, bd := range body.Elts {
+				if f, ok := bd.(*ast.Field); ok {
+					field(f, strings.Join(conds, " and "))
+				}
+			}
+		}
+	}
+
+	s := jsonSchema{"type": "object"}
+	if len(props) > 0 {
+		s["properties"] = props
+	}
+	if len(patterns) > 0 {
+		s["patternProperties"] = patterns
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	if additional != nil {
+		s["additionalProperties"] = additional
+	} else if closed {
+		s["additionalProperties"] = false
+	}
+	return s
+}
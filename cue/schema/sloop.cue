@@ -0,0 +1,330 @@
+// Package sloop is the schema of sloop configurations.
+//
+// sloop evaluates configurations with these definitions in scope. They can
+// also be imported from cue.mod, as installed by "sloop init", to get
+// completion and validation in editors and with "cue vet".
+package sloop
+
+import $__net "net"
+import $__list "list"
+#Volume: {
+	name: string
+	// "named" volumes are directories created by sloop, "host" ones are
+	// paths of the host, and "tmpfs" ones live in memory and are empty
+	// every time the service starts. Names starting with "/" are host paths.
+	let hostPath = name =~ "^/"
+	type: *[ if hostPath {"host"}, "named"][0] | "named" | "host" | "tmpfs"
+	// can also be set on a single mount, as $volume.x & {readOnly: true}
+	readOnly: bool | *false
+	// give every instance of a replicated service its own directory
+	perInstance: bool | *false
+	if type == "tmpfs" {
+		readOnly: false
+		perInstance: false
+		// maximum size, in bytes or with a k, m, g or % suffix
+		size?: =~"^[0-9]+[kmgKMG%]?$"
+	}
+	if type != "host" {
+		// owner and permissions of the directory, only set when it is
+		// created since services often change them on their own
+		uid?: int & >=0
+		gid?: int & >=0
+		mode?: int & >=0 & <=0o7777
+	}
+	if type != "tmpfs" {
+		// also bind the mounts below the directory
+		recursive: bool | *true
+		// map the owner of the files to the root user of the container
+		idmap: bool | *false
+	}
+}
+#IPPrefix: >0 & <32
+#PolicyRule: {
+	// name of the source service, any service on the bridge if missing
+	from?: string
+	// name of the destination service, or "host" for the host itself
+	to: string
+	// destination port, any port if missing
+	port?: uint16
+	proto: *"tcp" | "udp"
+}
+#EgressRule: {
+	// name of the source service, any service on the bridge if missing
+	from?: string
+	// destination subnet, like "192.0.2.0/24" or "2001:db8::1/128" for
+	// a single address, any destination if missing
+	to?: $__net.IPCIDR & string
+	// destination port, any port if missing
+	port?: uint16
+	proto: *"tcp" | "udp"
+}
+#Policy: {
+	// what happens to traffic between services, and to the host,
+	// that is not allowed by a rule
+	default: *"allow" | "deny"
+	// what happens to traffic leaving the bridge that is not allowed
+	// by a rule of egressAllow
+	egress: *"allow" | "deny"
+	allow: [...#PolicyRule] | *[]
+	egressAllow: [...#EgressRule] | *[]
+}
+#IP6Prefix: >=8 & <128
+#Bridge: {
+	name: string
+	ip: $__net.IPv4 & string | *"0.0.0.0"
+	// the bridge has IPv4 addresses only if prefix is set
+	prefix?: #IPPrefix
+	ip6: $__net.IP & =~":" & string | *"::"
+	// the bridge has IPv6 addresses only if prefix6 is set
+	prefix6?: #IP6Prefix
+	// with "nat" the IPv6 traffic leaving the bridge is masqueraded,
+	// with "routed" the prefix must be routed to the host upstream
+	mode6: *"nat" | "routed"
+	policy?: #Policy
+	...
+}
+#BridgeInterface: {
+	name: string
+	type: "bridge"
+	bridge: #Bridge
+	ip: $__net.IPv4 & string | *"0.0.0.0"
+	ip6: $__net.IP & =~":" & string | *"::"
+	...
+}
+#LinkInterface: {
+	name: string
+	// host interface the device is attached to
+	parent: string
+	// static address, the address is obtained with DHCP if missing,
+	// which needs busybox on the host for its udhcpc client
+	ip?: $__net.IPv4 & string
+	if ip != _|_ {
+		prefix: #IPPrefix
+	}
+	gateway?: $__net.IPv4 & string
+	...
+}
+#MacvlanInterface: #LinkInterface & {
+	type: "macvlan"
+	mode: *"bridge" | "private" | "vepa" | "passthru"
+}
+#IpvlanInterface: #LinkInterface & {
+	type: "ipvlan"
+	mode: *"l2" | "l3" | "l3s"
+}
+// A veth pair with no bridge: the host routes the addresses of the
+// service to it, and answers for the gateway 169.254.1.1 (or fe80::1)
+#RoutedInterface: {
+	name: string
+	type: "routed"
+	ip: $__net.IPv4 & string
+	ip6?: $__net.IP & =~":" & string
+	...
+}
+// interfaces without a type are attached to a bridge
+#Interface: *#BridgeInterface | #MacvlanInterface | #IpvlanInterface | #RoutedInterface
+#Network: {
+	private: bool | *true
+	ifs: [Name=_]: #Interface & {name: string | *Name}
+	...
+}
+// A pod owns a network namespace, shared by all its member services
+#Pod: {
+	name: =~"^[A-Za-z0-9-]+$"
+	net: #Network & {private: true}
+	...
+}
+
+#File: {
+	content:     string
+	permissions: uint16
+	// content is a Go template, executed when the configuration is
+	// applied with the service, its interfaces, the addresses of the
+	// other services, the bridges and the hostname. A change of the
+	// result reloads the service instead of restarting it. Files that
+	// use secrets get permissions 0600.
+	template: bool | *false
+} | string
+
+#PortBinding: {
+	host:    uint16
+	service: uint16
+} | uint16
+
+#Secret: {
+	// ASCII armored age message, see "sloop secret encrypt"
+	age: =~"^-----BEGIN AGE ENCRYPTED FILE-----"
+	// path where the secret is mounted inside the container
+	file?: string
+	// environment variable that holds the secret
+	env?: =~"^[A-Za-z_][A-Za-z0-9_]*$"
+}
+
+// A step of the build of an image
+#BuildStep: {
+	// add files to the image. A string is the content of a file with
+	// permissions 0644.
+	copy: [string]: #File
+} | {
+	// run a command in a container of the image so far
+	run: [string, ...string]
+} | {
+	env: [string]: string
+} | {
+	workdir: =~"^/"
+} | {
+	user: string
+}
+
+// An image built by sloop from another image. The result of every step
+// is cached, and only the steps after the first one that changed run again.
+// A new image behind the tag of from rebuilds all the steps.
+#Build: {
+	// the image the build starts from, fetched from a registry
+	from: string
+	steps: [...#BuildStep]
+	// the name of the built image, like "local/app:1"
+	tag: =~"^[^:]+:[^:/]+$"
+}
+
+#Image: {
+	from: string
+	build?: #Build
+	if build != _|_ {
+		from: build.tag
+	}
+	files: [string]:  #File
+	env: [string]:    string
+	volumes: [string]: #Volume
+	secrets: [=~"^[A-Za-z0-9_-]+$"]: #Secret
+}
+#Instance: {
+	name: =~"^[A-Za-z0-9-]+$"
+	// environment variables specific to the instance
+	env: [string]: string
+	net?: #Network
+	...
+}
+// A socket is created by systemd, which starts the service on the
+// first connection and passes the socket to it
+#Socket: {
+	name: =~"^[A-Za-z0-9_-]+$"
+	type: *"stream" | "datagram" | "unix"
+	if type == "unix" {
+		path: =~"^/"
+	}
+	if type != "unix" {
+		port: uint16
+		// listen on the address of the bridge instead of all the
+		// addresses of the host
+		bridge?: #Bridge
+	}
+	...
+}
+#Exec: {
+	start: [...string] | *[]
+	// run when only the content of files changed, the service is
+	// restarted instead if it is empty
+	reload: [...string] | *[]
+}
+#Service: {
+	name:  =~ "^[A-Za-z0-9-]+$"
+	exec: #Exec
+	image: #Image
+	net?: #Network
+	// the service joins the network namespace of the pod, and has no
+	// network of its own
+	pod?: #Pod
+	if pod != _|_ {
+		net?: _|_
+	}
+	// run the service as a systemd template, with one instance for each
+	// entry of instances. With replicas, they are named from 0.
+	replicas?: int & >0
+	instances: [Name=_]: #Instance & {name: string | *Name}
+	if replicas != _|_ {
+		instances: {
+			for i in $__list.Range(0, replicas, 1) {
+				"\(i)": {}
+			}
+		}
+	}
+	// services with instances cannot have sockets
+	sockets: [Name=_]: #Socket & {name: string | *Name}
+	capabilities: [...string] | *[]
+	type: "notify" | "oneshot" | *"simple"
+	// restart the service when it exits, or only when it fails
+	restart: *"no" | "always" | "on-failure"
+	enable: bool | *true
+	wants: [...#Dependency]
+	requires: [...#Dependency]
+	after: [...#Dependency]
+	...
+}
+
+// A job runs a command to completion, in a new container set up like
+// the one of a service. It is run with "sloop job run", or before the
+// services that depend on it.
+#Job: #Service & {
+	job: true
+	type: "oneshot"
+	// systemd does not restart oneshot units that succeed
+	restart: "no" | "on-failure"
+	enable: false
+	replicas?: _|_
+	sockets: close({})
+	exec: reload: []
+}
+
+#Cmd: {
+	service: #Service
+	action: "start" | "stop" | "restart" | "reload" | "exec"
+	if action == "exec" {
+		// passed as written, "%" and "$" included: use
+		// ["sh", "-c", "..."] for variables and substitutions
+		command: [string, ...string]
+		// "running" runs the command in the running service, "ephemeral"
+		// in a new container of the image of the service, with its volumes
+		// and in its network namespace
+		container: *"running" | "ephemeral"
+	}
+}
+
+// A time span in the systemd format, like "1h 30min" or "90s"
+#TimeSpan: =~"^\\s*([0-9]+(\\.[0-9]+)?\\s*(us|usec|ms|msec|s|sec|second|seconds|m|min|minute|minutes|h|hr|hour|hours|d|day|days|w|week|weeks|M|month|months|y|year|years)?\\s*)+$"
+
+#Timer: {
+	name: string
+	run: [...#Cmd]
+	onCalendar: [...string] | *[]
+	onActiveSec: [...#TimeSpan] | *[]
+	onBootSec: [...#TimeSpan] | *[]
+	randomizedDelaySec?: #TimeSpan
+	accuracySec?: #TimeSpan
+	persistent: bool | *true
+	// services frozen while the commands run, like for a consistent
+	// copy of their volumes. Services that are not running are skipped,
+	// and the ones paused with "sloop pause" stay paused afterwards.
+	freeze: [...{name: string, ...}] | *[]
+	...
+}
+
+// A systemd unit that is not managed by sloop, like "network-online.target".
+// The name must end with one of the suffixes: the regex used to be
+// `^(\.service)|(\.target)|(\.socket)$`, whose alternation made it
+// accept any name starting with ".service" or containing ".target".
+#UnitName:   =~"\\.(service|target|socket)$"
+#Dependency: #Service | #UnitName
+
+
+// Changes to the rules that validate the whole configuration, by rule
+// name: "interface-name-length", "host-interface-name", "duplicate-ip",
+// "bridge-subnet-overlap", "unknown-dependency", "dependency-cycle",
+// "timer-disabled-service" and "bridge-policy"
+#Validation: [string]: {
+	// "off" disables the rule
+	severity?: "error" | "warning" | "off"
+	// names of services, bridges, pods or timers whose violations are
+	// not reported, with shell patterns like "web-*"
+	ignore: [...string] | *[]
+}
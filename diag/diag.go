@@ -0,0 +1,239 @@
+package diag
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	cuelang "cuelang.org/go/cue"
+	cueerrors "cuelang.org/go/cue/errors"
+	"cuelang.org/go/cue/token"
+	"github.com/joomcode/errorx"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/cue"
+	"yuri91/sloop/nft"
+	"yuri91/sloop/validate"
+)
+
+// A Diagnostic is a problem in the configuration, with the places in
+// the source that cause it
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	// Code is the type of the error, like "cue.constrain"
+	Code string `json:"code"`
+	Message string `json:"message"`
+	// Path is the path of the value in the configuration, if known
+	Path string `json:"path,omitempty"`
+	// Positions are sorted with the ones in the configuration first,
+	// followed by the ones in the schema of sloop
+	Positions []Position `json:"positions,omitempty"`
+}
+
+type Position struct {
+	File string `json:"file"`
+	Line int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// internal files are the ones with the schema and the checks of sloop,
+// which are not on disk
+func (p Position) internal() bool {
+	return strings.HasPrefix(p.File, "sloop_")
+}
+
+func position(pos token.Pos) (Position, bool) {
+	if !pos.IsValid() || pos.Filename() == "" {
+		return Position{}, false
+	}
+	file := pos.Filename()
+	if cwd, err := os.Getwd(); err == nil && filepath.IsAbs(file) {
+		if rel, err := filepath.Rel(cwd, file); err == nil && !strings.HasPrefix(rel, "..") {
+			file = rel
+		}
+	}
+	return Position{file, pos.Line(), pos.Column()}, true
+}
+
+func positions(poss ...token.Pos) []Position {
+	var user, internal []Position
+	for _, pos := range poss {
+		p, ok := position(pos)
+		if !ok || lo.Contains(user, p) || lo.Contains(internal, p) {
+			continue
+		}
+		if p.internal() {
+			internal = append(internal, p)
+		} else {
+			user = append(user, p)
+		}
+	}
+	return append(user, internal...)
+}
+
+// IsConfigError returns true if err is about the configuration, rather
+// than a failure of sloop
+func IsConfigError(err error) bool {
+	errx, ok := err.(*errorx.Error)
+	return ok && (cue.CueErrors.IsNamespaceOf(errx.Type()) || errx.IsOfType(nft.RulesError) || errx.IsOfType(validate.ValidationError))
+}
+
+// FromError returns the diagnostics of err if it is an error in the
+// configuration. The second return value is false otherwise.
+func FromError(err error) ([]Diagnostic, bool) {
+	if !IsConfigError(err) {
+		return nil, false
+	}
+	errx := err.(*errorx.Error)
+	if v, ok := errx.Property(validate.ViolationsProperty); ok {
+		return FromViolations(v.([]validate.Violation)), true
+	}
+	code := errx.Type().FullName()
+	cueErrs := cueerrors.Errors(errx.Cause())
+	if len(cueErrs) == 0 {
+		d := Diagnostic{Severity: "error", Code: code, Message: errx.Message()}
+		if cause := errx.Cause(); cause != nil {
+			d.Message += ": " + cause.Error()
+		}
+		if pos, ok := errx.Property(cue.PositionProperty); ok {
+			d.Positions = positions(pos.(token.Pos))
+		}
+		return []Diagnostic{d}, true
+	}
+	var diags []Diagnostic
+	for _, e := range cueErrs {
+		path := lo.Map(e.Path(), func(p string, _ int) string {
+			return unquote(p)
+		})
+		format, args := e.Msg()
+		msg := fmt.Sprintf(format, args...)
+		if m, ok := checkMessage(path); ok {
+			msg = m
+		} else if len(path) > 0 {
+			msg = strings.Join(path, ".") + ": " + msg
+		}
+		poss := append([]token.Pos{e.Position()}, e.InputPositions()...)
+		v, ok := errx.Property(cue.ValueProperty)
+		if ok && lo.EveryBy(positions(poss...), Position.internal) {
+			poss = append([]token.Pos{valuePos(v.(cuelang.Value), path)}, poss...)
+		}
+		d := Diagnostic{
+			Severity: "error",
+			Code: code,
+			Message: msg,
+			Path: strings.Join(path, "."),
+			Positions: positions(poss...),
+		}
+		// the same conflict is often reported for every value involved
+		if lo.ContainsBy(diags, func(o Diagnostic) bool { return o.Message == d.Message }) {
+			continue
+		}
+		diags = append(diags, d)
+	}
+	return diags, true
+}
+
+// FromViolations returns the diagnostics of the violations of the rules
+// of validate
+func FromViolations(violations []validate.Violation) []Diagnostic {
+	return lo.Map(violations, func(v validate.Violation, _ int) Diagnostic {
+		return Diagnostic{
+			Severity: v.Severity,
+			Code: "validate." + v.Rule,
+			Message: v.Message,
+			Positions: positions(v.Pos),
+		}
+	})
+}
+
+// HasErrors returns true if some of diags are errors, rather than warnings
+func HasErrors(diags []Diagnostic) bool {
+	return lo.SomeBy(diags, func(d Diagnostic) bool { return d.Severity == "error" })
+}
+
+// valuePos returns the position in the configuration of the closest
+// value to path, for errors in the checks of sloop that only have
+// positions in the schema
+func valuePos(value cuelang.Value, path []string) token.Pos {
+	for n := len(path); n > 0; n-- {
+		if lo.SomeBy(path[:n], func(p string) bool { return strings.HasPrefix(p, "_") }) {
+			continue
+		}
+		sels := lo.Map(path[:n], func(p string, _ int) cuelang.Selector {
+			return cuelang.Str(p)
+		})
+		if v := value.LookupPath(cuelang.MakePath(sels...)); v.Exists() && v.Pos().IsValid() {
+			return v.Pos()
+		}
+	}
+	return token.NoPos
+}
+
+func unquote(label string) string {
+	if s, err := strconv.Unquote(label); err == nil {
+		return s
+	}
+	return label
+}
+
+var kinds = map[string]string{
+	"$service": "service",
+	"$job": "job",
+	"$timer": "timer",
+	"$volume": "volume",
+}
+
+// checkMessage explains the failures of the checks in the constraints of
+// sloop, which are fields like _volumeCheck: "data.is_in_$volume" that
+// fail to unify
+func checkMessage(path []string) (string, bool) {
+	i := lo.IndexOf(lo.Map(path, func(p string, _ int) bool {
+		return strings.HasPrefix(p, "_") && strings.HasSuffix(p, "Check")
+	}), true)
+	if i < 2 || i+1 >= len(path) {
+		return "", false
+	}
+	kind, name, label := kinds[path[0]], path[1], path[i+1]
+	cut := func(suffix string) (string, bool) {
+		if !strings.HasSuffix(label, suffix) {
+			return "", false
+		}
+		return strings.TrimSuffix(label, suffix), true
+	}
+	switch path[i] {
+	case "_volumeCheck":
+		if v, ok := cut(".is_in_$volume"); ok {
+			return fmt.Sprintf("%s %s mounts undefined volume %s", kind, name, v), true
+		}
+	case "_podCheck":
+		if p, ok := cut(".is_in_$pod"); ok {
+			return fmt.Sprintf("%s %s joins undefined pod %s", kind, name, p), true
+		}
+	case "_nameCheck":
+		if _, ok := cut(".is_not_in_$service"); ok {
+			return fmt.Sprintf("job %s has the same name as a service", name), true
+		}
+	case "_socketCheck":
+		if _, ok := cut(".has_no_sockets"); ok {
+			return fmt.Sprintf("service %s is replicated, it cannot have sockets", name), true
+		}
+	case "_serviceCheck":
+		if s, ok := cut(".to_freeze_is_in_$service"); ok {
+			return fmt.Sprintf("timer %s freezes undefined service %s", name, s), true
+		}
+		if s, ok := cut(".is_in_$service"); ok {
+			return fmt.Sprintf("timer %s runs undefined service %s", name, s), true
+		}
+	case "_typeCheck":
+		if _, ok := cut(".is_absolute"); ok {
+			return fmt.Sprintf("volume %s must have type \"host\" if and only if its name is an absolute path", name), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,11 @@
+package diag
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	DiagErrors = errorx.NewNamespace("diag")
+
+	OutputError = DiagErrors.NewType("output")
+)
@@ -0,0 +1,140 @@
+package diag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// Formats are the output formats of Write
+var Formats = []string{"text", "json", "sarif"}
+
+// Text formats diagnostics for the terminal, one per line prefixed by
+// its position, followed by the other positions involved
+func Text(diags []Diagnostic) string {
+	var b strings.Builder
+	for _, d := range diags {
+		if len(d.Positions) > 0 {
+			b.WriteString(d.Positions[0].String() + ": ")
+		}
+		fmt.Fprintf(&b, "%s: %s [%s]\n", d.Severity, d.Message, d.Code)
+		for i := 1; i < len(d.Positions); i++ {
+			fmt.Fprintf(&b, "    %s\n", d.Positions[i])
+		}
+	}
+	return b.String()
+}
+
+// Write writes diagnostics to w in format, which is one of Formats
+func Write(w io.Writer, format string, diags []Diagnostic) error {
+	if diags == nil {
+		diags = []Diagnostic{}
+	}
+	var err error
+	switch format {
+	case "text":
+		_, err = io.WriteString(w, Text(diags))
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(map[string]interface{}{"diagnostics": diags})
+	case "sarif":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(sarif(diags))
+	default:
+		return OutputError.New("unknown format %s, expected one of %s", format, strings.Join(Formats, ", "))
+	}
+	if err != nil {
+		return OutputError.Wrap(err, "cannot write diagnostics")
+	}
+	return nil
+}
+
+type sarifLog struct {
+	Version string `json:"version"`
+	Schema string `json:"$schema"`
+	Runs []sarifRun `json:"runs"`
+}
+type sarifRun struct {
+	Tool sarifTool `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+type sarifDriver struct {
+	Name string `json:"name"`
+	InformationURI string `json:"informationUri,omitempty"`
+	Rules []sarifRule `json:"rules"`
+}
+type sarifRule struct {
+	Id string `json:"id"`
+}
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+type sarifResult struct {
+	RuleId string `json:"ruleId"`
+	Level string `json:"level"`
+	Message sarifMessage `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+}
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region sarifRegion `json:"region"`
+}
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+}
+
+func sarifLocations(positions []Position) []sarifLocation {
+	return lo.Map(positions, func(p Position, _ int) sarifLocation {
+		return sarifLocation{sarifPhysicalLocation{sarifArtifact{p.File}, sarifRegion{p.Line, p.Column}}}
+	})
+}
+
+// sarif converts diagnostics to SARIF 2.1.0, as read by code scanning
+// tools. Positions in the schema of sloop are left out, since they are
+// not files of the repository.
+func sarif(diags []Diagnostic) sarifLog {
+	results := []sarifResult{}
+	for _, d := range diags {
+		positions := lo.Filter(d.Positions, func(p Position, _ int) bool {
+			return !p.internal()
+		})
+		r := sarifResult{RuleId: d.Code, Level: d.Severity, Message: sarifMessage{d.Message}}
+		if len(positions) > 0 {
+			r.Locations = sarifLocations(positions[:1])
+			r.RelatedLocations = sarifLocations(positions[1:])
+		}
+		results = append(results, r)
+	}
+	codes := lo.Uniq(lo.Map(diags, func(d Diagnostic, _ int) string {
+		return d.Code
+	}))
+	return sarifLog{
+		Version: "2.1.0",
+		Schema: "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs: []sarifRun{{
+			Tool: sarifTool{sarifDriver{
+				Name: "sloop",
+				Rules: lo.Map(codes, func(c string, _ int) sarifRule {
+					return sarifRule{c}
+				}),
+			}},
+			Results: results,
+		}},
+	}
+}
@@ -0,0 +1,12 @@
+package gitsync
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	GitErrors = errorx.NewNamespace("git")
+
+	FetchError = GitErrors.NewType("fetch")
+	StateError = GitErrors.NewType("state")
+)
@@ -0,0 +1,116 @@
+package gitsync
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", FetchError.Wrap(err, "git %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Fetch makes dir a checkout of ref from the repository at url, cloning it
+// if needed, and returns the checked out commit. ref is a branch, a tag
+// or a commit, which is looked for in the history of the branches if the
+// server does not let it be fetched directly.
+// url can be anything git understands, including local paths and file:// urls
+func Fetch(url string, ref string, dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", FetchError.Wrap(err, "cannot create repository directory %s", dir)
+		}
+		if _, err := git(dir, "init", "--quiet"); err != nil {
+			return "", err
+		}
+	}
+	// Always set the remote url, so that changing it takes effect
+	remoteCmd := "set-url"
+	if _, err := git(dir, "remote", "get-url", "origin"); err != nil {
+		remoteCmd = "add"
+	}
+	if _, err := git(dir, "remote", remoteCmd, "origin", url); err != nil {
+		return "", err
+	}
+	head := "FETCH_HEAD"
+	_, err := git(dir, "fetch", "--quiet", "--depth", "1", "origin", ref)
+	if err != nil && isCommit(ref) {
+		// servers only send commits that are not the tip of a branch or
+		// a tag with allowReachableSHA1InWant: fetch the branches and
+		// look for it in their history
+		err = fetchBranches(dir)
+		if err == nil {
+			head, err = git(dir, "rev-parse", "--verify", "--quiet", ref + "^{commit}")
+			if err != nil {
+				err = FetchError.New("commit %s is not in any branch of %s", ref, url)
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := git(dir, "checkout", "--quiet", "--force", "--detach", head); err != nil {
+		return "", err
+	}
+	if _, err := git(dir, "clean", "--quiet", "-d", "--force", "-x"); err != nil {
+		return "", err
+	}
+	return git(dir, "rev-parse", "HEAD")
+}
+
+// isCommit returns true if ref looks like a commit hash, possibly
+// abbreviated
+func isCommit(ref string) bool {
+	if len(ref) < 4 || len(ref) > 40 {
+		return false
+	}
+	return strings.Trim(ref, "0123456789abcdef") == ""
+}
+
+// fetchBranches fetches the whole history of all the branches of origin
+func fetchBranches(dir string) error {
+	args := []string{"fetch", "--quiet", "origin", "+refs/heads/*:refs/remotes/origin/*"}
+	shallow, err := git(dir, "rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return err
+	}
+	if shallow == "true" {
+		args = append(args, "--unshallow")
+	}
+	_, err = git(dir, args...)
+	return err
+}
+
+// Deployed returns the last commit recorded in stateFile, or the empty
+// string if none was recorded yet
+func Deployed(stateFile string) (string, error) {
+	b, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", StateError.Wrap(err, "cannot read deployed commit from %s", stateFile)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// RecordDeployed writes commit to stateFile
+func RecordDeployed(stateFile string, commit string) error {
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		return StateError.Wrap(err, "cannot create state directory")
+	}
+	err := os.WriteFile(stateFile, []byte(commit+"\n"), 0600)
+	if err != nil {
+		return StateError.Wrap(err, "cannot record deployed commit in %s", stateFile)
+	}
+	return nil
+}
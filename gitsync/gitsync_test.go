@@ -0,0 +1,110 @@
+package gitsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// remote is a bare repository, with a clone to push commits to it
+type remote struct {
+	t *testing.T
+	url string
+	work string
+}
+
+func run(t *testing.T, dir string, args ...string) string {
+	out, err := git(dir, args...)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return out
+}
+
+func newRemote(t *testing.T) *remote {
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "remote.git")
+	work := filepath.Join(dir, "work")
+	run(t, dir, "init", "--quiet", "--bare", "--initial-branch", "main", bare)
+	run(t, dir, "clone", "--quiet", bare, work)
+	return &remote{t, "file://" + bare, work}
+}
+
+// commit commits main.cue with content and pushes it to main
+func (r *remote) commit(content string) string {
+	if err := os.WriteFile(filepath.Join(r.work, "main.cue"), []byte(content), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	run(r.t, r.work, "add", "main.cue")
+	run(r.t, r.work, "commit", "--quiet", "-m", content)
+	run(r.t, r.work, "push", "--quiet", "origin", "HEAD:main")
+	return run(r.t, r.work, "rev-parse", "HEAD")
+}
+
+func expectCheckout(t *testing.T, dir string, commit string, got string, content string) {
+	if got != commit {
+		t.Errorf("expected commit %s, got %s", commit, got)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "main.cue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != content {
+		t.Errorf("expected %q in the checkout, got %q", content, b)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	r := newRemote(t)
+	dir := filepath.Join(t.TempDir(), "repo")
+
+	first := r.commit("package main\n")
+	got, err := Fetch(r.url, "main", dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expectCheckout(t, dir, first, got, "package main\n")
+
+	// a new commit, and a file left over in the checkout
+	second := r.commit("package main\n$volume: data: {}\n")
+	if err := os.WriteFile(filepath.Join(dir, "extra.cue"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = Fetch(r.url, "main", dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expectCheckout(t, dir, second, got, "package main\n$volume: data: {}\n")
+	if _, err := os.Stat(filepath.Join(dir, "extra.cue")); !os.IsNotExist(err) {
+		t.Errorf("extra.cue was not cleaned: %v", err)
+	}
+
+	// an older commit, which is not the tip of a branch
+	got, err = Fetch(r.url, first[:12], dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expectCheckout(t, dir, first, got, "package main\n")
+
+	if _, err := Fetch(r.url, "0123456789abcdef", dir); err == nil {
+		t.Errorf("expected an error for a commit that does not exist")
+	}
+}
+
+func TestDeployed(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "sloop", "deployed")
+	if commit, err := Deployed(state); err != nil || commit != "" {
+		t.Fatalf("expected no commit, got %q %v", commit, err)
+	}
+	if err := RecordDeployed(state, "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if commit, err := Deployed(state); err != nil || commit != "abc123" {
+		t.Fatalf("expected abc123, got %q %v", commit, err)
+	}
+}
@@ -0,0 +1,399 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"yuri91/sloop/cue"
+)
+
+// BuildKeyFile is the file of a built bundle with the key of its last step
+const BuildKeyFile = "sloop-build"
+
+// basesFile is the file of the build cache with the digests the base
+// images resolved to, by name
+const basesFile = "sloop-bases.json"
+
+// BuildKeys returns the keys of the images of a build: the base image,
+// with the digest base it resolved to, then the image after every step.
+// A key depends on the step and on all the ones before it, so a change
+// invalidates the steps that follow, and a new base image all of them.
+func BuildKeys(b cue.Build, base string) []string {
+	h := sha256.Sum256([]byte("from " + b.From + "@" + base))
+	keys := []string{hex.EncodeToString(h[:])}
+	for _, step := range b.Steps {
+		h := sha256.New()
+		h.Write([]byte(keys[len(keys)-1]))
+		json.NewEncoder(h).Encode(step)
+		keys = append(keys, hex.EncodeToString(h.Sum(nil)))
+	}
+	return keys
+}
+
+// BuiltKey returns the key of the build a bundle was unpacked from, or
+// "" if it was fetched
+func BuiltKey(bundlePath string) string {
+	key, err := os.ReadFile(filepath.Join(bundlePath, BuildKeyFile))
+	if err != nil {
+		return ""
+	}
+	return string(key)
+}
+
+// createCache creates the OCI layout of the build cache, if it does not
+// exist yet
+func createCache(cachePath string) error {
+	if _, err := os.Stat(filepath.Join(cachePath, "index.json")); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(cachePath), 0700)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot create build cache %s", cachePath)
+	}
+	err = dir.Create(cachePath)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot create build cache %s", cachePath)
+	}
+	return nil
+}
+
+func readBases(cachePath string) map[string]string {
+	bases := make(map[string]string)
+	basesB, err := os.ReadFile(filepath.Join(cachePath, basesFile))
+	if err == nil {
+		json.Unmarshal(basesB, &bases)
+	}
+	return bases
+}
+
+// ResolveBase returns the digest the base image of a build refers to in
+// its registry. If the registry cannot be reached, the digest it last
+// resolved to is used, so that builds that did not change work offline.
+func ResolveBase(cachePath string, from string) (string, error) {
+	bases := readBases(cachePath)
+	ref, err := alltransports.ParseImageName("docker://" + from)
+	if err != nil {
+		return "", BuildError.Wrap(err, "invalid image name %s", from)
+	}
+	digest, err := docker.GetDigest(context.Background(), nil, ref)
+	if err != nil {
+		if last, ok := bases[from]; ok {
+			fmt.Printf("Cannot resolve image %s, using %s: %v\n", from, last, err)
+			return last, nil
+		}
+		return "", BuildError.Wrap(err, "cannot resolve image %s", from)
+	}
+	if bases[from] != digest.String() {
+		bases[from] = digest.String()
+		basesB, _ := json.MarshalIndent(bases, "", "\t")
+		err = createCache(cachePath)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(cachePath, basesFile), basesB, 0600)
+		}
+		if err != nil {
+			return "", BuildError.Wrap(err, "cannot record digest of image %s", from)
+		}
+	}
+	return digest.String(), nil
+}
+
+// LastBase returns the digest the base image from last resolved to,
+// without asking its registry
+func LastBase(cachePath string, from string) (string, bool) {
+	base, ok := readBases(cachePath)[from]
+	return base, ok
+}
+
+// pinned returns the name of the image from with its tag replaced by
+// digest, so that the image fetched is the one the key is made of
+func pinned(from string, digest string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(from)
+	if err != nil {
+		return "", BuildError.Wrap(err, "invalid image name %s", from)
+	}
+	canonical, err := reference.ParseNormalizedNamed(reference.TrimNamed(named).String() + "@" + digest)
+	if err != nil {
+		return "", BuildError.Wrap(err, "invalid digest %s of image %s", digest, from)
+	}
+	return canonical.String(), nil
+}
+
+func hasRef(engineExt casext.Engine, name string) bool {
+	paths, err := engineExt.ResolveReference(context.Background(), name)
+	return err == nil && len(paths) > 0
+}
+
+func describe(step cue.BuildStep) string {
+	switch {
+	case len(step.Copy) > 0:
+		paths := make([]string, 0, len(step.Copy))
+		for p := range step.Copy {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		return "COPY " + strings.Join(paths, " ")
+	case len(step.Run) > 0:
+		return "RUN " + strings.Join(step.Run, " ")
+	case len(step.Env) > 0:
+		b, _ := json.Marshal(step.Env)
+		return "ENV " + string(b)
+	case step.Workdir != "":
+		return "WORKDIR " + step.Workdir
+	default:
+		return "USER " + step.User
+	}
+}
+
+// setEnv sets the variables of env in the environment of an image
+func setEnv(imgEnv []string, env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		v := k + "=" + env[k]
+		found := false
+		for n, e := range imgEnv {
+			if strings.HasPrefix(e, k + "=") {
+				imgEnv[n] = v
+				found = true
+			}
+		}
+		if !found {
+			imgEnv = append(imgEnv, v)
+		}
+	}
+	return imgEnv
+}
+
+// run runs command in a container of rootfs with systemd-nspawn, with
+// the environment, directory and user of the image so far
+func run(rootfs string, config ispec.ImageConfig, command []string) error {
+	args := []string{"--quiet", "--register=no", "--console=pipe", "-D", rootfs}
+	if config.WorkingDir != "" {
+		args = append(args, "--chdir=" + config.WorkingDir)
+	}
+	if config.User != "" {
+		args = append(args, "--user=" + config.User)
+	}
+	for _, e := range config.Env {
+		args = append(args, "--setenv=" + e)
+	}
+	args = append(args, "--")
+	args = append(args, command...)
+	cmd := exec.Command("systemd-nspawn", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// applyStep makes the image tagged to from the one tagged from, with
+// step applied
+func applyStep(engineExt casext.Engine, from string, to string, step cue.BuildStep) error {
+	ctx := context.Background()
+	paths, err := engineExt.ResolveReference(ctx, from)
+	if err != nil || len(paths) == 0 {
+		return BuildError.New("cannot find image %s in the build cache", from)
+	}
+	mutator, err := mutate.New(engineExt, paths[0])
+	if err != nil {
+		return BuildError.Wrap(err, "cannot read image %s", from)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot read config of image %s", from)
+	}
+	now := time.Now()
+	history := &ispec.History{Created: &now, CreatedBy: describe(step)}
+
+	if len(step.Copy) == 0 && len(step.Run) == 0 {
+		// only the config changes, there is no new layer
+		config.Env = setEnv(config.Env, step.Env)
+		if step.Workdir != "" {
+			config.WorkingDir = step.Workdir
+		}
+		if step.User != "" {
+			config.User = step.User
+		}
+		imgMeta, err := mutator.Meta(ctx)
+		if err != nil {
+			return BuildError.Wrap(err, "cannot read image %s", from)
+		}
+		annotations, err := mutator.Annotations(ctx)
+		if err != nil {
+			return BuildError.Wrap(err, "cannot read image %s", from)
+		}
+		history.EmptyLayer = true
+		err = mutator.Set(ctx, config, imgMeta, annotations, history)
+		if err != nil {
+			return BuildError.Wrap(err, "cannot set config of step %s", history.CreatedBy)
+		}
+		newPath, err := mutator.Commit(ctx)
+		if err != nil {
+			return BuildError.Wrap(err, "cannot commit step %s", history.CreatedBy)
+		}
+		return engineExt.UpdateReference(ctx, to, newPath.Root())
+	}
+
+	tmpDir, err := os.MkdirTemp("", "sloop-build")
+	if err != nil {
+		return BuildError.Wrap(err, "cannot create temporary directory")
+	}
+	defer os.RemoveAll(tmpDir)
+	bundle := filepath.Join(tmpDir, "bundle")
+	err = umoci.Unpack(engineExt, from, bundle, layer.UnpackOptions{KeepDirlinks: true})
+	if err != nil {
+		return BuildError.Wrap(err, "cannot unpack image %s", from)
+	}
+	rootfs := filepath.Join(bundle, "rootfs")
+	for p, f := range step.Copy {
+		err = Extra(bundle, p, f.Content, os.FileMode(f.Permissions))
+		if err != nil {
+			return BuildError.Wrap(err, "cannot copy file %s", p)
+		}
+	}
+	if len(step.Run) > 0 {
+		err = run(rootfs, config, step.Run)
+		if err != nil {
+			return BuildError.Wrap(err, "step %s failed", history.CreatedBy)
+		}
+	}
+	meta, err := umoci.ReadBundleMeta(bundle)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot read bundle of image %s", from)
+	}
+	err = umoci.Repack(engineExt, to, bundle, meta, history, nil, false, mutator)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot repack step %s", history.CreatedBy)
+	}
+	return nil
+}
+
+// Build builds b, from the image base resolved to, in bundlePath. The
+// image after every step is kept in the OCI layout in cachePath, tagged
+// with its key, so that only the steps that changed, and the ones after
+// them, run again.
+func Build(cachePath string, b cue.Build, base string, bundlePath string) error {
+	keys := BuildKeys(b, base)
+	err := createCache(cachePath)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		engine, err := dir.Open(cachePath)
+		if err != nil {
+			return BuildError.Wrap(err, "cannot open build cache %s", cachePath)
+		}
+		engineExt := casext.NewEngine(engine)
+		defer engine.Close()
+		if !hasRef(engineExt, keys[0]) {
+			err = copy_("docker://" + b.From, "oci:" + cachePath + ":" + keys[0])
+			if err != nil {
+				return BuildError.Wrap(err, "cannot fetch image %s", b.From)
+			}
+		}
+		for n, step := range b.Steps {
+			if hasRef(engineExt, keys[n+1]) {
+				fmt.Printf("Step %d/%d: %s (cached)\n", n+1, len(b.Steps), describe(step))
+				continue
+			}
+			fmt.Printf("Step %d/%d: %s\n", n+1, len(b.Steps), describe(step))
+			err = applyStep(engineExt, keys[n], keys[n+1], step)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	// unpack next to the old bundle, which services may still be using
+	key := keys[len(keys)-1]
+	newPath := bundlePath + ".new"
+	os.RemoveAll(newPath)
+	err = os.MkdirAll(filepath.Dir(bundlePath), 0700)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot create directory for %s", bundlePath)
+	}
+	err = unpack(cachePath, key, newPath)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot unpack image %s", b.Tag)
+	}
+	err = os.WriteFile(filepath.Join(newPath, BuildKeyFile), []byte(key), 0600)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot write build key of %s", b.Tag)
+	}
+	err = os.RemoveAll(bundlePath)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot remove old bundle of %s", b.Tag)
+	}
+	err = os.Rename(newPath, bundlePath)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot move bundle of %s", b.Tag)
+	}
+	return nil
+}
+
+// GC removes from the build cache in cachePath the images whose key is
+// not in keep, with the blobs only they used
+func GC(cachePath string, keep []string) error {
+	if _, err := os.Stat(filepath.Join(cachePath, "index.json")); err != nil {
+		return nil
+	}
+	engine, err := dir.Open(cachePath)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot open build cache %s", cachePath)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+	ctx := context.Background()
+	refs, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot list build cache %s", cachePath)
+	}
+	kept := make(map[string]bool)
+	for _, k := range keep {
+		kept[k] = true
+	}
+	removed := false
+	for _, r := range refs {
+		if kept[r] {
+			continue
+		}
+		err = engineExt.DeleteReference(ctx, r)
+		if err != nil {
+			return BuildError.Wrap(err, "cannot remove %s from build cache", r)
+		}
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	err = engineExt.GC(ctx)
+	if err != nil {
+		return BuildError.Wrap(err, "cannot clean build cache %s", cachePath)
+	}
+	return nil
+}
@@ -8,4 +8,5 @@ var (
 	ImageErrors = errorx.NewNamespace("image")
 
 	MetadataError = ImageErrors.NewType("metadata")
+	BuildError = ImageErrors.NewType("build")
 )
@@ -0,0 +1,204 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/cgroup"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/systemd"
+)
+
+// Collector gathers metrics about the services, timers, bridges and images
+// of a configuration, in the Prometheus text format
+type Collector struct {
+	// Systemd is used to read unit states. If nil, they are not reported.
+	Systemd *dbus.Conn
+	// NetRoot is the directory with the network interfaces, usually /sys/class/net
+	NetRoot string
+}
+
+type sample struct {
+	labels map[string]string
+	value float64
+}
+
+type family struct {
+	name string
+	help string
+	typ string
+	samples []sample
+}
+
+type families struct {
+	list []*family
+	byName map[string]*family
+}
+
+func (fs *families) add(name string, typ string, help string, labels map[string]string, value float64) {
+	f, ok := fs.byName[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		fs.byName[name] = f
+		fs.list = append(fs.list, f)
+	}
+	f.samples = append(f.samples, sample{labels, value})
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func (fs *families) write(w io.Writer) error {
+	for _, f := range fs.list {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ); err != nil {
+			return err
+		}
+		for _, s := range f.samples {
+			keys := lo.Keys(s.labels)
+			sort.Strings(keys)
+			labels := lo.Map(keys, func(k string, _ int) string {
+				return fmt.Sprintf("%s=\"%s\"", k, escapeLabel(s.labels[k]))
+			})
+			value := strconv.FormatFloat(s.value, 'f', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s{%s} %s\n", f.name, strings.Join(labels, ","), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Collector) collectService(fs *families, s cue.Service) {
+	fs.add("sloop_service_info", "gauge", "Information about the service from the configuration",
+		map[string]string{"service": s.Name, "image": s.Image.From, "type": s.Type, "enabled": fmt.Sprint(s.Enable)}, 1)
+
+	instances := s.SortedInstances()
+	for i, unit := range s.Units() {
+		labels := map[string]string{"service": s.Name}
+		if len(instances) > 0 {
+			labels["instance"] = instances[i].Name
+		}
+		c.collectUnit(fs, unit, labels)
+	}
+}
+
+// collectUnit collects the metrics of one of the units of a service
+func (c *Collector) collectUnit(fs *families, unit string, labels map[string]string) {
+	with := func(k string, v string) map[string]string {
+		l := lo.Assign(labels)
+		l[k] = v
+		return l
+	}
+	stats, err := cgroup.ReadStats(strings.TrimSuffix(unit, ".service"))
+	if err == nil {
+		fs.add("sloop_service_memory_bytes", "gauge", "Memory used by the service", labels, float64(stats.MemoryCurrent))
+		fs.add("sloop_service_pids", "gauge", "Number of processes of the service", labels, float64(stats.PIDs))
+		fs.add("sloop_service_cpu_seconds_total", "counter", "CPU time used by the service",
+			with("mode", "user"), float64(stats.CPUUserUsec)/1e6)
+		fs.add("sloop_service_cpu_seconds_total", "counter", "CPU time used by the service",
+			with("mode", "system"), float64(stats.CPUSystemUsec)/1e6)
+		fs.add("sloop_service_io_read_bytes_total", "counter", "Bytes read by the service", labels, float64(stats.IOReadBytes))
+		fs.add("sloop_service_io_write_bytes_total", "counter", "Bytes written by the service", labels, float64(stats.IOWriteBytes))
+		fs.add("sloop_service_io_reads_total", "counter", "Read operations of the service", labels, float64(stats.IOReads))
+		fs.add("sloop_service_io_writes_total", "counter", "Write operations of the service", labels, float64(stats.IOWrites))
+	}
+
+	if c.Systemd == nil {
+		return
+	}
+	props, err := c.Systemd.GetAllPropertiesContext(context.Background(), unit)
+	if err != nil {
+		return
+	}
+	if state, ok := props["ActiveState"].(string); ok {
+		for _, st := range []string{"active", "reloading", "inactive", "failed", "activating", "deactivating"} {
+			fs.add("sloop_service_active_state", "gauge", "Active state of the service unit",
+				with("state", st), lo.Ternary(st == state, 1.0, 0.0))
+		}
+	}
+	if restarts, ok := props["NRestarts"].(uint32); ok {
+		fs.add("sloop_service_restarts_total", "counter", "Number of automatic restarts of the service", labels, float64(restarts))
+	}
+}
+
+func (c *Collector) collectTimer(fs *families, t cue.Timer) {
+	if c.Systemd == nil {
+		return
+	}
+	props, err := c.Systemd.GetUnitTypePropertiesContext(context.Background(), t.Name+".timer", "Timer")
+	if err != nil {
+		return
+	}
+	labels := map[string]string{"timer": t.Name}
+	if last, ok := props["LastTriggerUSec"].(uint64); ok && last != 0 {
+		fs.add("sloop_timer_last_trigger_timestamp_seconds", "gauge", "Last time the timer triggered", labels, float64(last)/1e6)
+	}
+	if next, ok := props["NextElapseUSecRealtime"].(uint64); ok && next != 0 {
+		fs.add("sloop_timer_next_trigger_timestamp_seconds", "gauge", "Next time the timer will trigger", labels, float64(next)/1e6)
+	}
+}
+
+func (c *Collector) collectBridge(fs *families, b cue.Bridge) {
+	labels := map[string]string{"bridge": b.Name}
+	counters := []struct{ file, name, help string }{
+		{"rx_bytes", "sloop_bridge_receive_bytes_total", "Bytes received on the bridge"},
+		{"tx_bytes", "sloop_bridge_transmit_bytes_total", "Bytes transmitted on the bridge"},
+		{"rx_packets", "sloop_bridge_receive_packets_total", "Packets received on the bridge"},
+		{"tx_packets", "sloop_bridge_transmit_packets_total", "Packets transmitted on the bridge"},
+	}
+	for _, counter := range counters {
+		n, err := cgroup.ReadUint(filepath.Join(c.NetRoot, b.Name, "statistics", counter.file))
+		if err != nil {
+			continue
+		}
+		fs.add(counter.name, "counter", counter.help, labels, float64(n))
+	}
+}
+
+func collectImage(fs *families, img string, now time.Time) {
+	info, err := os.Stat(filepath.Join(systemd.GetImagePath(img), "umoci.json"))
+	if err != nil {
+		return
+	}
+	fs.add("sloop_image_age_seconds", "gauge", "Time since the image was fetched",
+		map[string]string{"image": img}, now.Sub(info.ModTime()).Seconds())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := lo.Keys(m)
+	sort.Strings(keys)
+	return keys
+}
+
+// Write writes all the metrics for config to w
+func (c *Collector) Write(w io.Writer, config cue.Config) error {
+	fs := &families{byName: make(map[string]*family)}
+	for _, n := range sortedKeys(config.Services) {
+		c.collectService(fs, config.Services[n])
+	}
+	for _, n := range sortedKeys(config.Timers) {
+		c.collectTimer(fs, config.Timers[n])
+	}
+	for _, n := range sortedKeys(config.Bridges) {
+		c.collectBridge(fs, config.Bridges[n])
+	}
+	images := lo.Uniq(lo.Map(sortedKeys(config.Services), func(n string, _ int) string {
+		return config.Services[n].Image.From
+	}))
+	now := time.Now()
+	for _, img := range images {
+		collectImage(fs, img, now)
+	}
+	return fs.write(w)
+}
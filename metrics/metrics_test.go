@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"yuri91/sloop/cgroup"
+	"yuri91/sloop/cue"
+)
+
+// fakeSysfs returns the root of a fake sysfs with files relative to it,
+// and points cgroup.Root to its cgroup hierarchy
+func fakeSysfs(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for p, content := range files {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := cgroup.Root
+	cgroup.Root = filepath.Join(root, "fs", "cgroup")
+	t.Cleanup(func() { cgroup.Root = old })
+	return root
+}
+
+func serviceFiles(unit string, memory string) map[string]string {
+	p := "fs/cgroup/sloop.slice/" + unit + "/"
+	return map[string]string{
+		p + "memory.current": memory + "\n",
+		p + "pids.current": "3\n",
+		p + "cpu.stat": "usage_usec 3000000\nuser_usec 2000000\nsystem_usec 1000000\n",
+		p + "io.stat": "8:0 rbytes=100 wbytes=200 rios=1 wios=2 dbytes=0 dios=0\n8:16 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0\n",
+	}
+}
+
+func write(t *testing.T, root string, config cue.Config) string {
+	c := Collector{NetRoot: filepath.Join(root, "class", "net")}
+	var buf bytes.Buffer
+	if err := c.Write(&buf, config); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	for _, l := range lines {
+		if !strings.Contains(out, l + "\n") {
+			t.Errorf("missing %q in:\n%s", l, out)
+		}
+	}
+}
+
+func TestServiceMetrics(t *testing.T) {
+	root := fakeSysfs(t, serviceFiles("web.service", "1024"))
+	out := write(t, root, cue.Config{Services: map[string]cue.Service{
+		"web": {Name: "web", Type: "notify", Enable: true, Image: cue.Image{From: "nginx:latest"}},
+	}})
+	expectLines(t, out,
+		`sloop_service_info{enabled="true",image="nginx:latest",service="web",type="notify"} 1`,
+		`sloop_service_memory_bytes{service="web"} 1024`,
+		`sloop_service_pids{service="web"} 3`,
+		`sloop_service_cpu_seconds_total{mode="user",service="web"} 2`,
+		`sloop_service_cpu_seconds_total{mode="system",service="web"} 1`,
+		`sloop_service_io_read_bytes_total{service="web"} 101`,
+		`sloop_service_io_write_bytes_total{service="web"} 202`,
+		`sloop_service_io_reads_total{service="web"} 4`,
+		`sloop_service_io_writes_total{service="web"} 6`,
+	)
+}
+
+func TestInstanceMetrics(t *testing.T) {
+	files := serviceFiles("worker@1.service", "10")
+	for p, c := range serviceFiles("worker@2.service", "20") {
+		files[p] = c
+	}
+	root := fakeSysfs(t, files)
+	out := write(t, root, cue.Config{Services: map[string]cue.Service{
+		"worker": {Name: "worker", Instances: map[string]cue.Instance{"1": {Name: "1"}, "2": {Name: "2"}}},
+	}})
+	expectLines(t, out,
+		`sloop_service_memory_bytes{instance="1",service="worker"} 10`,
+		`sloop_service_memory_bytes{instance="2",service="worker"} 20`,
+	)
+}
+
+func TestStoppedServiceHasNoUsage(t *testing.T) {
+	root := fakeSysfs(t, nil)
+	out := write(t, root, cue.Config{Services: map[string]cue.Service{"web": {Name: "web"}}})
+	if strings.Contains(out, "sloop_service_memory_bytes") {
+		t.Errorf("usage of a stopped service in:\n%s", out)
+	}
+}
+
+func TestBridgeMetrics(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"class/net/br0/statistics/rx_bytes": "1000\n",
+		"class/net/br0/statistics/tx_bytes": "2000\n",
+		"class/net/br0/statistics/rx_packets": "10\n",
+		"class/net/br0/statistics/tx_packets": "20\n",
+	})
+	out := write(t, root, cue.Config{Bridges: map[string]cue.Bridge{
+		"br0": {Name: "br0"},
+		// not created yet
+		"br1": {Name: "br1"},
+	}})
+	expectLines(t, out,
+		`sloop_bridge_receive_bytes_total{bridge="br0"} 1000`,
+		`sloop_bridge_transmit_bytes_total{bridge="br0"} 2000`,
+		`sloop_bridge_receive_packets_total{bridge="br0"} 10`,
+		`sloop_bridge_transmit_packets_total{bridge="br0"} 20`,
+	)
+	if strings.Contains(out, `bridge="br1"`) {
+		t.Errorf("metrics of a missing bridge in:\n%s", out)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("got %s", got)
+	}
+}
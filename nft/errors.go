@@ -0,0 +1,12 @@
+package nft
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	NftErrors = errorx.NewNamespace("nft")
+
+	RulesError = NftErrors.NewType("rules")
+	NetlinkError = NftErrors.NewType("netlink")
+)
@@ -0,0 +1,156 @@
+package nft
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Helpers that build the expressions of common matches, in the same
+// way the nft command line tool does
+
+func ifname(name string) []byte {
+	b := make([]byte, 16)
+	copy(b, name)
+	return b
+}
+
+// matchIfname matches the input (or output) interface name
+func matchIfname(key expr.MetaKey, op expr.CmpOp, name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: ifname(name)},
+	}
+}
+
+func iifname(name string) []expr.Any {
+	return matchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, name)
+}
+
+func notOifname(name string) []expr.Any {
+	return matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, name)
+}
+
+// matchProto matches IPv4 (or IPv6) packets. In the bridge family the
+// ethertype has to be checked instead of the netfilter protocol.
+func matchProto(family nftables.TableFamily, ipv6 bool) []expr.Any {
+	if family == nftables.TableFamilyBridge {
+		ethertype := uint16(0x0800)
+		if ipv6 {
+			ethertype = 0x86dd
+		}
+		return []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyPROTOCOL, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(ethertype)},
+		}
+	}
+	proto := byte(unix.NFPROTO_IPV4)
+	if ipv6 {
+		proto = unix.NFPROTO_IPV6
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+// matchAddr matches the source (or destination) address of the packet
+// against prefix, which can be either IPv4 or IPv6
+func matchAddr(family nftables.TableFamily, source bool, prefix *net.IPNet) []expr.Any {
+	ip := prefix.IP.To4()
+	offset := uint32(12)
+	if ip == nil {
+		ip = prefix.IP.To16()
+		offset = 8
+	}
+	length := uint32(len(ip))
+	if !source {
+		offset += length
+	}
+	exprs := matchProto(family, length == net.IPv6len)
+	exprs = append(exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length})
+	if ones, bits := prefix.Mask.Size(); ones != bits {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister: 1,
+			Len: length,
+			Mask: prefix.Mask,
+			Xor: make([]byte, length),
+		})
+	}
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(prefix.Mask)})
+}
+
+func saddr(prefix *net.IPNet) []expr.Any {
+	return matchAddr(nftables.TableFamilyINet, true, prefix)
+}
+
+func daddr(prefix *net.IPNet) []expr.Any {
+	return matchAddr(nftables.TableFamilyINet, false, prefix)
+}
+
+// matchL4 matches the transport protocol and, if port is not zero,
+// the destination port
+func matchL4(proto string, port uint16) []expr.Any {
+	l4proto := byte(unix.IPPROTO_TCP)
+	if proto == "udp" {
+		l4proto = unix.IPPROTO_UDP
+	}
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+	}
+	if port == 0 {
+		return exprs
+	}
+	return append(exprs,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	)
+}
+
+// icmpv6 matches ICMPv6 packets, which carry the neighbor discovery
+func icmpv6() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+	}
+}
+
+// ctEstablished matches packets of established or related connections
+func ctEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister: 1,
+			Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor: binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func accept() []expr.Any {
+	return []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}
+}
+
+func drop() []expr.Any {
+	return []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}
+}
+
+func masquerade() []expr.Any {
+	return []expr.Any{&expr.Masq{}}
+}
+
+func concat(parts ...[]expr.Any) []expr.Any {
+	var exprs []expr.Any
+	for _, p := range parts {
+		exprs = append(exprs, p...)
+	}
+	return exprs
+}
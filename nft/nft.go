@@ -0,0 +1,176 @@
+package nft
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	"yuri91/sloop/cue"
+)
+
+// TableName is the name of the inet table owned by sloop
+const TableName = "sloop"
+
+type ruleset struct {
+	conn *nftables.Conn
+	table *nftables.Table
+	postrouting *nftables.Chain
+	forward *nftables.Chain
+	input *nftables.Chain
+
+	bridgeTable *nftables.Table
+	bridgeForward *nftables.Chain
+}
+
+func (r *ruleset) add(chain *nftables.Chain, exprs []expr.Any) {
+	r.conn.AddRule(&nftables.Rule{Table: r.table, Chain: chain, Exprs: exprs})
+}
+
+func (r *ruleset) addBridgeRule(exprs []expr.Any) {
+	r.conn.AddRule(&nftables.Rule{Table: r.bridgeTable, Chain: r.bridgeForward, Exprs: exprs})
+}
+
+// stack is one of the address families enabled on a bridge
+type stack struct {
+	ipv6 bool
+	prefix *net.IPNet
+}
+
+// bridgeStacks returns the subnets of a bridge, IPv4 first
+func bridgeStacks(b cue.Bridge) ([]stack, error) {
+	var stacks []stack
+	if b.Prefix != 0 {
+		_, prefix, err := net.ParseCIDR(fmt.Sprintf("%s/%d", b.Ip, b.Prefix))
+		if err != nil {
+			return nil, RulesError.Wrap(err, "invalid subnet for bridge %s", b.Name)
+		}
+		stacks = append(stacks, stack{ipv6: false, prefix: prefix})
+	}
+	if b.Prefix6 != 0 {
+		_, prefix, err := net.ParseCIDR(fmt.Sprintf("%s/%d", b.Ip6, b.Prefix6))
+		if err != nil {
+			return nil, RulesError.Wrap(err, "invalid IPv6 subnet for bridge %s", b.Name)
+		}
+		stacks = append(stacks, stack{ipv6: true, prefix: prefix})
+	}
+	return stacks, nil
+}
+
+// addBridge adds the rules that give the containers on a bridge access
+// to the outside. IPv6 subnets are masqueraded only in nat mode: in routed
+// mode the upstream network is expected to route the prefix to the host.
+func (r *ruleset) addBridge(b cue.Bridge) error {
+	stacks, err := bridgeStacks(b)
+	if err != nil {
+		return err
+	}
+	for _, s := range stacks {
+		if s.ipv6 && b.Mode6 == "routed" {
+			continue
+		}
+		r.add(r.postrouting, concat(saddr(s.prefix), notOifname(b.Name), masquerade()))
+	}
+	r.add(r.forward, concat(iifname(b.Name), accept()))
+	return nil
+}
+
+// resetTables queues the deletion of the sloop tables, if they exist
+func resetTables(conn *nftables.Conn, tables ...*nftables.Table) {
+	for _, table := range tables {
+		// Adding the table first makes the deletion succeed even if the
+		// table does not exist yet
+		conn.AddTable(table)
+		conn.DelTable(table)
+	}
+}
+
+// newConn returns a netlink connection, the inet table and the bridge
+// table owned by sloop
+func newConn() (*nftables.Conn, *nftables.Table, *nftables.Table, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, nil, nil, NetlinkError.Wrap(err, "cannot open netlink connection")
+	}
+	table := &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+	bridgeTable := &nftables.Table{Name: TableName, Family: nftables.TableFamilyBridge}
+	return conn, table, bridgeTable, nil
+}
+
+// Reconcile replaces the sloop tables with the rules generated from config.
+// All the changes are applied in a single netlink transaction, so the
+// tables are never observed in a partial state.
+func Reconcile(config cue.Config) error {
+	conn, table, bridgeTable, err := newConn()
+	if err != nil {
+		return err
+	}
+	resetTables(conn, table, bridgeTable)
+	conn.AddTable(table)
+	conn.AddTable(bridgeTable)
+
+	r := &ruleset{conn: conn, table: table, bridgeTable: bridgeTable}
+	r.postrouting = conn.AddChain(&nftables.Chain{
+		Name: "postrouting",
+		Table: table,
+		Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	r.forward = conn.AddChain(&nftables.Chain{
+		Name: "forward",
+		Table: table,
+		Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	r.input = conn.AddChain(&nftables.Chain{
+		Name: "input",
+		Table: table,
+		Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	r.bridgeForward = conn.AddChain(&nftables.Chain{
+		Name: "forward",
+		Table: bridgeTable,
+		Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	r.add(r.forward, concat(ctEstablished(), accept()))
+	r.add(r.input, concat(ctEstablished(), accept()))
+	// conntrack in the bridge family needs nf_conntrack_bridge, which
+	// the kernel loads for the rule
+	r.addBridgeRule(concat(ctEstablished(), accept()))
+
+	for _, n := range sortedBridges(config) {
+		if policy, ok := config.Policies[n]; ok {
+			if err := r.addPolicy(config, config.Bridges[n], policy); err != nil {
+				return err
+			}
+		}
+		if err := r.addBridge(config.Bridges[n]); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return NetlinkError.Wrap(err, "cannot program table %s", TableName)
+	}
+	return nil
+}
+
+// Flush deletes the sloop tables, with all their rules
+func Flush() error {
+	conn, table, bridgeTable, err := newConn()
+	if err != nil {
+		return err
+	}
+	resetTables(conn, table, bridgeTable)
+	if err := conn.Flush(); err != nil {
+		return NetlinkError.Wrap(err, "cannot delete table %s", TableName)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package nft
+
+import (
+	"net"
+	"sort"
+
+	"yuri91/sloop/cue"
+)
+
+// HostTarget is the name used in policy rules for the host itself
+const HostTarget = "host"
+
+type resolvedRule struct {
+	// from is nil for any service on the bridge
+	from *net.IPNet
+	// to is nil for the host, or for any destination of egress rules
+	to *net.IPNet
+	port uint16
+	proto string
+	// egress rules are about traffic leaving the bridge
+	egress bool
+}
+
+func hostNet(ip string) *net.IPNet {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}
+}
+
+// bridgeAddrs returns the IPv4 (or IPv6) addresses of the services
+// attached to a bridge, as assigned by the configuration. Replicated
+// services have one address for each instance. A service without an
+// address of the family has an empty list.
+func bridgeAddrs(config cue.Config, bridge string, ipv6 bool) map[string][]*net.IPNet {
+	addrs := make(map[string][]*net.IPNet)
+	add := func(n string, network cue.Network) {
+		for _, i := range network.Interfaces {
+			if i.Type == "bridge" && i.Bridge.Name == bridge {
+				ip := i.Ip
+				if ipv6 {
+					ip = i.Ip6
+				}
+				if _, ok := addrs[n]; !ok {
+					addrs[n] = nil
+				}
+				if addr := hostNet(ip); addr != nil {
+					addrs[n] = append(addrs[n], addr)
+				}
+			}
+		}
+	}
+	for n, s := range config.Services {
+		if !s.Net.Private {
+			continue
+		}
+		if len(s.Instances) == 0 {
+			add(n, s.Net)
+			continue
+		}
+		for _, i := range s.SortedInstances() {
+			add(n, i.Net)
+		}
+	}
+	return addrs
+}
+
+// resolvePolicy turns the service names in the rules of the policy of a
+// bridge into addresses. It returns an error for every name that does not
+// refer to a service attached to the bridge.
+func resolvePolicy(config cue.Config, bridge string, policy cue.Policy, ipv6 bool) ([]resolvedRule, []error) {
+	addrs := bridgeAddrs(config, bridge, ipv6)
+	lookup := func(name string) ([]*net.IPNet, error) {
+		if addr, ok := addrs[name]; ok {
+			if len(addr) == 0 {
+				family := "IPv4"
+				if ipv6 {
+					family = "IPv6"
+				}
+				return nil, RulesError.New("policy of bridge %s refers to service %s, which has no %s address on it", bridge, name, family)
+			}
+			return addr, nil
+		}
+		if _, ok := config.Services[name]; ok {
+			return nil, RulesError.New("policy of bridge %s refers to service %s, which is not attached to it", bridge, name)
+		}
+		return nil, RulesError.New("policy of bridge %s refers to service %s, which does not exist", bridge, name)
+	}
+	var rules []resolvedRule
+	var errs []error
+	for _, r := range policy.Allow {
+		// nil stands for any service, or the host
+		froms := []*net.IPNet{nil}
+		tos := []*net.IPNet{nil}
+		if r.From != "" {
+			addr, err := lookup(r.From)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			froms = addr
+		}
+		if r.To != HostTarget {
+			addr, err := lookup(r.To)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			tos = addr
+		}
+		for _, from := range froms {
+			for _, to := range tos {
+				rules = append(rules, resolvedRule{from: from, to: to, port: r.Port, proto: r.Proto})
+			}
+		}
+	}
+	for _, r := range policy.EgressAllow {
+		var to *net.IPNet
+		if r.To != "" {
+			_, prefix, err := net.ParseCIDR(r.To)
+			if err != nil {
+				errs = append(errs, RulesError.Wrap(err, "policy of bridge %s has invalid egress destination %s", bridge, r.To))
+				continue
+			}
+			// the rule is for the other family
+			if (prefix.IP.To4() == nil) != ipv6 {
+				continue
+			}
+			to = prefix
+		}
+		froms := []*net.IPNet{nil}
+		if r.From != "" {
+			addr, err := lookup(r.From)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			froms = addr
+		}
+		for _, from := range froms {
+			rules = append(rules, resolvedRule{from: from, to: to, port: r.Port, proto: r.Proto, egress: true})
+		}
+	}
+	return rules, errs
+}
+
+// CheckPolicy returns an error for every rule of the policy of a bridge
+// that refers to a service that does not exist, is not attached to the
+// bridge, or has no address in one of the subnets of the bridge, and for
+// the egress rules of a policy that allows all egress traffic
+func CheckPolicy(config cue.Config, bridge string) []error {
+	policy, ok := config.Policies[bridge]
+	if !ok {
+		return nil
+	}
+	var errs []error
+	if len(policy.EgressAllow) > 0 && policy.Egress != "deny" {
+		errs = append(errs, RulesError.New("policy of bridge %s has egress rules, but its egress is not \"deny\"", bridge))
+	}
+	stacks, err := bridgeStacks(config.Bridges[bridge])
+	if err != nil {
+		return append(errs, err)
+	}
+	seen := make(map[string]bool)
+	for _, s := range stacks {
+		_, stackErrs := resolvePolicy(config, bridge, policy, s.ipv6)
+		// the same name is wrong for both families
+		for _, err := range stackErrs {
+			if !seen[err.Error()] {
+				seen[err.Error()] = true
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+func sortedBridges(config cue.Config) []string {
+	names := make([]string, 0, len(config.Bridges))
+	for n := range config.Bridges {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addPolicy adds the rules that enforce the policy of a bridge.
+// Traffic between services on the same bridge never reaches the inet
+// hooks, so it is filtered in the bridge table. Frames are matched by
+// their addresses rather than by bridge. Allow rules only accept new
+// connections, replies are accepted by the conntrack rule of Reconcile.
+// Egress rules accept traffic leaving the bridge before the
+// egress deny drops it.
+func (r *ruleset) addPolicy(config cue.Config, b cue.Bridge, policy cue.Policy) error {
+	stacks, err := bridgeStacks(b)
+	if err != nil {
+		return err
+	}
+	family := r.bridgeTable.Family
+	for _, s := range stacks {
+		rules, errs := resolvePolicy(config, b.Name, policy, s.ipv6)
+		if len(errs) > 0 {
+			return errs[0]
+		}
+		for _, rule := range rules {
+			from := rule.from
+			if from == nil {
+				from = s.prefix
+			}
+			if rule.egress {
+				exprs := concat(iifname(b.Name), notOifname(b.Name), saddr(from))
+				if rule.to != nil {
+					exprs = concat(exprs, daddr(rule.to))
+				}
+				r.add(r.forward, concat(exprs, matchL4(rule.proto, rule.port), accept()))
+				continue
+			}
+			if rule.to == nil {
+				exprs := concat(iifname(b.Name), saddr(from), matchL4(rule.proto, rule.port), accept())
+				r.add(r.input, exprs)
+				continue
+			}
+			request := concat(matchAddr(family, true, from), matchAddr(family, false, rule.to))
+			r.addBridgeRule(concat(request, matchL4(rule.proto, rule.port), accept()))
+		}
+		if policy.Default == "deny" {
+			r.addBridgeRule(concat(matchAddr(family, true, s.prefix), matchAddr(family, false, s.prefix), drop()))
+			if s.ipv6 {
+				// Without neighbor discovery the host is unreachable
+				r.add(r.input, concat(iifname(b.Name), icmpv6(), accept()))
+			}
+		}
+	}
+	if policy.Default == "deny" {
+		r.add(r.input, concat(iifname(b.Name), drop()))
+	}
+	if policy.Egress == "deny" {
+		r.add(r.forward, concat(iifname(b.Name), drop()))
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package secret
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	SecretErrors = errorx.NewNamespace("secret")
+
+	KeyError = SecretErrors.NewType("key")
+	DecryptError = SecretErrors.NewType("decrypt")
+	EncryptError = SecretErrors.NewType("encrypt")
+)
@@ -0,0 +1,101 @@
+package secret
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Keygen creates a new host identity in keyPath, if it does not exist
+// yet, and returns its public recipient
+func Keygen(keyPath string) (string, error) {
+	if _, err := os.Stat(keyPath); err == nil {
+		identity, err := LoadIdentity(keyPath)
+		if err != nil {
+			return "", err
+		}
+		return identity.Recipient().String(), nil
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", KeyError.Wrap(err, "cannot generate key")
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return "", KeyError.Wrap(err, "cannot create key directory")
+	}
+	content := fmt.Sprintf("# public key: %s\n%s\n", identity.Recipient(), identity)
+	if err := os.WriteFile(keyPath, []byte(content), 0600); err != nil {
+		return "", KeyError.Wrap(err, "cannot write key %s", keyPath)
+	}
+	return identity.Recipient().String(), nil
+}
+
+// LoadIdentity reads the host identity from keyPath
+func LoadIdentity(keyPath string) (*age.X25519Identity, error) {
+	f, err := os.Open(keyPath)
+	if err != nil {
+		return nil, KeyError.Wrap(err, "cannot open key %s", keyPath)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, KeyError.Wrap(err, "cannot parse key %s", keyPath)
+	}
+	identity, ok := identities[0].(*age.X25519Identity)
+	if !ok {
+		return nil, KeyError.New("unsupported key type in %s", keyPath)
+	}
+	return identity, nil
+}
+
+// Decrypt decrypts an armored age message with the host identity in keyPath
+func Decrypt(keyPath string, armored string) ([]byte, error) {
+	identity, err := LoadIdentity(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(armored)), identity)
+	if err != nil {
+		return nil, DecryptError.Wrap(err, "cannot decrypt secret")
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, DecryptError.Wrap(err, "cannot decrypt secret")
+	}
+	return plain, nil
+}
+
+// Encrypt encrypts plain for the given age recipients, and returns an
+// armored message that can be put in the configuration
+func Encrypt(recipients []string, plain []byte) (string, error) {
+	var parsed []age.Recipient
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return "", EncryptError.Wrap(err, "invalid recipient %s", r)
+		}
+		parsed = append(parsed, recipient)
+	}
+	var buf bytes.Buffer
+	armorWriter := armor.NewWriter(&buf)
+	w, err := age.Encrypt(armorWriter, parsed...)
+	if err != nil {
+		return "", EncryptError.Wrap(err, "cannot encrypt secret")
+	}
+	if _, err := w.Write(plain); err != nil {
+		return "", EncryptError.Wrap(err, "cannot encrypt secret")
+	}
+	if err := w.Close(); err != nil {
+		return "", EncryptError.Wrap(err, "cannot encrypt secret")
+	}
+	if err := armorWriter.Close(); err != nil {
+		return "", EncryptError.Wrap(err, "cannot encrypt secret")
+	}
+	return buf.String(), nil
+}
@@ -15,6 +15,8 @@ var (
 	RemoveUnitError = SystemdErrors.NewType("remove_unit")
 
 	RuntimeServiceError = SystemdErrors.NewType("runtime_service")
+	RunJobError = SystemdErrors.NewType("run_job")
 
 	FilesystemError = SystemdErrors.NewType("filesystem")
+	RenderError = SystemdErrors.NewType("render")
 )
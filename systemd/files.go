@@ -0,0 +1,325 @@
+package systemd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/samber/lo"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/secret"
+)
+
+// FileData is what the templates of the files of a service are executed
+// with:
+//
+//	.Service     the service the file belongs to
+//	.Interfaces  the interfaces of the service by name, with their
+//	             addresses; empty for replicated services
+//	.Services    the addresses of every service, by name
+//	.Bridges     the bridges by name, their .Ip is the gateway of the
+//	             services on them
+//	.Host        facts about the host: .Hostname
+//	.Files       the content of the files of the service that are not
+//	             templates, by path
+//
+// Templates can also call secret "name", which returns the plain value of
+// a secret of the service, and hash, which returns the sha256 of a string
+// in hex, like {{hash (index .Files "/etc/app.css")}}. A file whose
+// template calls secret is never written on disk in clear: it is encrypted
+// as a systemd credential, like the secrets, and mounted read-only.
+type FileData struct {
+	Service cue.Service
+	Interfaces map[string]*cue.Interface
+	Services map[string]Peer
+	Bridges map[string]cue.Bridge
+	Host Host
+	Files map[string]string
+}
+
+// Peer has the addresses of a service
+type Peer struct {
+	Name string
+	// Ip and Ip6 are the first addresses of the service, taking the
+	// interfaces by name, or "" if it has none
+	Ip string
+	Ip6 string
+	Interfaces map[string]*cue.Interface
+	// Instances are the addresses of the instances of a replicated
+	// service, by instance name
+	Instances map[string]Peer
+}
+
+type Host struct {
+	Hostname string
+}
+
+func newPeer(name string, net cue.Network) Peer {
+	p := Peer{Name: name, Interfaces: net.Interfaces}
+	names := lo.Keys(net.Interfaces)
+	sort.Strings(names)
+	for _, n := range names {
+		i := net.Interfaces[n]
+		if p.Ip == "" && i.Ip != "" && i.Ip != "0.0.0.0" {
+			p.Ip = i.Ip
+		}
+		if p.Ip6 == "" && i.Ip6 != "" && i.Ip6 != "::" {
+			p.Ip6 = i.Ip6
+		}
+	}
+	return p
+}
+
+// peers returns the addresses of the services of config. Members of a
+// pod have the addresses of the pod.
+func peers(config cue.Config) map[string]Peer {
+	ps := make(map[string]Peer)
+	for n, s := range config.Services {
+		net := s.Net
+		if s.Pod != "" {
+			net = config.Pods[s.Pod].Net
+		}
+		p := newPeer(n, net)
+		if len(s.Instances) > 0 {
+			p.Instances = make(map[string]Peer)
+			for in, i := range s.Instances {
+				p.Instances[in] = newPeer(cue.InstanceHost(n, in), i.Net)
+			}
+		}
+		ps[n] = p
+	}
+	return ps
+}
+
+// fileData returns the data the templates of the files of s are
+// executed with
+func fileData(config cue.Config, s cue.Service) FileData {
+	hostname, _ := os.Hostname()
+	data := FileData{
+		Service: s,
+		Interfaces: s.Net.Interfaces,
+		Services: peers(config),
+		Bridges: config.Bridges,
+		Host: Host{hostname},
+		Files: make(map[string]string),
+	}
+	if s.Pod != "" {
+		data.Interfaces = config.Pods[s.Pod].Net.Interfaces
+	}
+	// the instances share the files, but not their addresses
+	if len(s.Instances) > 0 {
+		data.Interfaces = map[string]*cue.Interface{}
+	}
+	for path, f := range s.Image.Files {
+		if !f.Template {
+			data.Files[path] = f.Content
+		}
+	}
+	return data
+}
+
+// hasTemplates returns true if a file of s is a template
+func hasTemplates(s cue.Service) bool {
+	for _, f := range s.Image.Files {
+		if f.Template {
+			return true
+		}
+	}
+	return false
+}
+
+// templateSumsFile is the file of the directory of a service with the
+// hashes of its templates, rendered with secretsHashed
+const templateSumsFile = "templates.sum"
+
+// renderedFile is the content of a file of a service
+type renderedFile struct {
+	Content string
+}
+
+// usesSecret returns true if f is a template that calls secret, even if
+// only in some of its branches
+func usesSecret(f cue.File) bool {
+	if !f.Template {
+		return false
+	}
+	stubs := template.FuncMap{"secret": func(string) string { return "" }, "hash": func(string) string { return "" }}
+	tmpl, err := template.New("").Funcs(stubs).Parse(f.Content)
+	if err != nil {
+		// renderFiles reports it
+		return false
+	}
+	return lo.SomeBy(tmpl.Templates(), func(t *template.Template) bool {
+		return t.Tree != nil && callsSecret(t.Tree.Root)
+	})
+}
+
+func callsSecret(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.IdentifierNode:
+		return n.Ident == "secret"
+	case *parse.ListNode:
+		return n != nil && lo.SomeBy(n.Nodes, callsSecret)
+	case *parse.ActionNode:
+		return callsSecret(n.Pipe)
+	case *parse.PipeNode:
+		return n != nil && lo.SomeBy(n.Cmds, func(c *parse.CommandNode) bool { return callsSecret(c) })
+	case *parse.CommandNode:
+		return lo.SomeBy(n.Args, callsSecret)
+	case *parse.IfNode:
+		return callsSecret(n.Pipe) || callsSecret(n.List) || callsSecret(n.ElseList)
+	case *parse.RangeNode:
+		return callsSecret(n.Pipe) || callsSecret(n.List) || callsSecret(n.ElseList)
+	case *parse.WithNode:
+		return callsSecret(n.Pipe) || callsSecret(n.List) || callsSecret(n.ElseList)
+	case *parse.TemplateNode:
+		return callsSecret(n.Pipe)
+	}
+	return false
+}
+
+// secretFiles returns the paths of the files of s whose template calls
+// secret
+func secretFiles(s cue.Service) []string {
+	var paths []string
+	for path, f := range s.Image.Files {
+		if usesSecret(f) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// secretMode is what the secret function of templates does
+type secretMode int
+
+const (
+	// secrets cannot be used, like when rendering for another machine
+	secretsRefused secretMode = iota
+	// secrets are replaced by the hash of their encrypted value, which
+	// tells if the result changed without decrypting them
+	secretsHashed
+	// secrets are decrypted with the key of the machine
+	secretsDecrypted
+)
+
+// renderFiles returns the content of the files of s, with the templates
+// executed
+func renderFiles(config cue.Config, s cue.Service, mode secretMode) (map[string]renderedFile, error) {
+	funcs := template.FuncMap{
+		"hash": func(content string) string {
+			h := sha256.Sum256([]byte(content))
+			return hex.EncodeToString(h[:])
+		},
+		"secret": func(name string) (string, error) {
+			sec, ok := s.Image.Secrets[name]
+			if !ok {
+				return "", CreateServiceError.New("service %s has no secret %s", s.Name, name)
+			}
+			switch mode {
+			case secretsRefused:
+				return "", CreateServiceError.New("secret %s of service %s is only available when the configuration is applied", name, s.Name)
+			case secretsHashed:
+				h := sha256.Sum256([]byte(sec.Age))
+				return "secret:" + hex.EncodeToString(h[:]), nil
+			}
+			plain, err := secret.Decrypt(common.SecretKeyPath, sec.Age)
+			if err != nil {
+				return "", CreateServiceError.Wrap(err, "cannot decrypt secret %s of service %s", name, s.Name)
+			}
+			return string(plain), nil
+		},
+	}
+	files := make(map[string]renderedFile)
+	var data *FileData
+	for path, f := range s.Image.Files {
+		if !f.Template {
+			files[path] = renderedFile{Content: f.Content}
+			continue
+		}
+		if data == nil {
+			d := fileData(config, s)
+			data = &d
+		}
+		tmpl, err := template.New(path).Funcs(funcs).Option("missingkey=error").Parse(f.Content)
+		if err != nil {
+			return nil, CreateServiceError.Wrap(err, "cannot parse template of file %s of service %s", path, s.Name)
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, data)
+		if err != nil {
+			return nil, CreateServiceError.Wrap(err, "cannot execute template of file %s of service %s", path, s.Name)
+		}
+		files[path] = renderedFile{buf.String()}
+	}
+	return files, nil
+}
+
+// templateSums returns the hashes of the templates of s, from files
+// rendered with secretsHashed
+func templateSums(s cue.Service, hashed map[string]renderedFile) map[string]string {
+	sums := make(map[string]string)
+	for path, f := range s.Image.Files {
+		if f.Template {
+			h := sha256.Sum256([]byte(hashed[path].Content))
+			sums[path] = hex.EncodeToString(h[:])
+		}
+	}
+	return sums
+}
+
+// changedTemplates returns the paths of the templates of the files of s
+// whose result changed since the files were written in p, without
+// decrypting the secrets the templates use
+func changedTemplates(s cue.Service, hashed map[string]renderedFile, p string) []string {
+	sums := templateSums(s, hashed)
+	var old map[string]string
+	oldB, err := os.ReadFile(filepath.Join(p, templateSumsFile))
+	if err != nil || json.Unmarshal(oldB, &old) != nil {
+		old = nil
+	}
+	var changed []string
+	for path, sum := range sums {
+		if old[path] != sum {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// templatesChange returns what the change of the results of the
+// templates of s, since the files were written in p, needs. Files with
+// secrets are credentials, which are only loaded when the service starts.
+func templatesChange(s cue.Service, hashed map[string]renderedFile, p string) serviceChange {
+	changed := changedTemplates(s, hashed, p)
+	if len(changed) == 0 {
+		return serviceUnchanged
+	}
+	if lo.SomeBy(changed, func(path string) bool { return usesSecret(s.Image.Files[path]) }) {
+		return serviceRestart
+	}
+	return serviceReload
+}
+
+// writeTemplateSums records the hashes of the templates of s in p
+func writeTemplateSums(s cue.Service, hashed map[string]renderedFile, p string) error {
+	sumsB, err := json.MarshalIndent(templateSums(s, hashed), "", "\t")
+	if err != nil {
+		return CreateServiceError.Wrap(err, "cannot marshal template hashes of service %s", s.Name)
+	}
+	err = os.WriteFile(filepath.Join(p, templateSumsFile), sumsB, 0600)
+	if err != nil {
+		return CreateServiceError.Wrap(err, "cannot write template hashes of service %s", s.Name)
+	}
+	return nil
+}
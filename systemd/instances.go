@@ -0,0 +1,206 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+)
+
+// Replicated services are rendered as a template unit. What differs
+// between the instances is passed with an environment file for every
+// instance, and referenced as ${VAR} in the unit.
+
+// envName turns an interface name into something usable in a variable name
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func hostIfnames(prefix string, ifs map[string]*cue.Interface) map[string]string {
+	names := make(map[string]string)
+	for _, i := range ifs {
+		names[i.Name] = capStringLen(15, prefix + "-" + i.Name)
+	}
+	return names
+}
+
+// instanceEnvFile is the environment file of an instance, %i being the instance name
+func instanceEnvFile(serviceDir string, instance string) string {
+	return filepath.Join(serviceDir, "instances", instance + ".env")
+}
+
+// instanceEnvKeys returns the variables passed to the containers of the
+// instances of a service. Every instance defines all of them.
+func instanceEnvKeys(s cue.Service) []string {
+	keys := []string{"SLOOP_INSTANCE", "SLOOP_INSTANCE_INDEX"}
+	for _, i := range s.Instances {
+		keys = append(keys, lo.Keys(i.Env)...)
+	}
+	keys = lo.Uniq(keys)
+	sort.Strings(keys[2:])
+	return keys
+}
+
+// instanceNetns returns the network namespace of the template unit of
+// a service, with the addresses and interface names of the instance
+// replaced by variables
+func instanceNetns(s cue.Service) *NetnsConf {
+	ifs := make(map[string]*cue.Interface)
+	hostIfs := make(map[string]string)
+	for k, i := range s.Net.Interfaces {
+		iface := *i
+		if iface.Ip != "" {
+			iface.Ip = "${SLOOP_IP_" + envName(i.Name) + "}"
+		}
+		if iface.Ip6 != "" {
+			iface.Ip6 = "${SLOOP_IP6_" + envName(i.Name) + "}"
+		}
+		ifs[k] = &iface
+		hostIfs[i.Name] = "${SLOOP_HOSTIF_" + envName(i.Name) + "}"
+	}
+	return &NetnsConf{
+		Name: "sloop-" + s.Name + "-%i",
+		HostIfnames: hostIfs,
+		Exec: "ExecStartPre",
+		UtilsPath: common.UtilsPath,
+		Interfaces: ifs,
+	}
+}
+
+// envQuote quotes a value for an EnvironmentFile of systemd: within
+// double quotes, only these characters are escaped with a backslash, and
+// newlines are kept as they are
+func envQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", `$`, `\$`).Replace(value) + `"`
+}
+
+func instanceEnv(s cue.Service, inst cue.Instance) string {
+	env := map[string]string{
+		"SLOOP_INSTANCE": inst.Name,
+		"SLOOP_INSTANCE_INDEX": strconv.Itoa(inst.Index),
+	}
+	for _, k := range instanceEnvKeys(s)[2:] {
+		env[k] = inst.Env[k]
+	}
+	host := cue.InstanceHost(s.Name, inst.Name)
+	for _, i := range inst.Net.Interfaces {
+		env["SLOOP_IP_" + envName(i.Name)] = i.Ip
+		env["SLOOP_IP6_" + envName(i.Name)] = i.Ip6
+		env["SLOOP_HOSTIF_" + envName(i.Name)] = capStringLen(15, host + "-" + i.Name)
+	}
+	keys := lo.Keys(env)
+	sort.Strings(keys)
+	str := ""
+	for _, k := range keys {
+		str += fmt.Sprintf("%s=%s\n", k, envQuote(env[k]))
+	}
+	return str
+}
+
+// handleInstances writes the environment files of the instances of
+// a service
+func handleInstances(s cue.Service, serviceDir string) error {
+	if len(s.Instances) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Join(serviceDir, "instances"), 0700)
+	if err != nil {
+		return CreateServiceError.Wrap(err, "cannot create instances directory for service %s", s.Name)
+	}
+	for _, inst := range s.SortedInstances() {
+		err = os.WriteFile(instanceEnvFile(serviceDir, inst.Name), []byte(instanceEnv(s, inst)), 0600)
+		if err != nil {
+			return CreateServiceError.Wrap(err, "cannot write environment of instance %s of service %s", inst.Name, s.Name)
+		}
+	}
+	// the files of the instances removed by scaling down
+	files, _ := filepath.Glob(instanceEnvFile(serviceDir, "*"))
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".env")
+		if _, ok := s.Instances[name]; !ok {
+			os.Remove(f)
+		}
+	}
+	return nil
+}
+
+// handleInstanceVolumes creates the volume directories of the instances
+// of a service, for its volumes that are per instance
+func handleInstanceVolumes(s cue.Service) error {
+	for _, inst := range s.SortedInstances() {
+		for _, v := range s.Image.Volumes {
+			if !v.PerInstance {
+				continue
+			}
+			err := createVolumeDir(v.Volume, filepath.Join(volumePath(v.Name), inst.Name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enableInstances enables the instances of a replicated service, and
+// stops and disables the ones that are no longer in the configuration
+func enableInstances(systemd *dbus.Conn, s cue.Service) error {
+	units := s.Units()
+	if s.Enable {
+		fmt.Printf("Enabling %s...\n", strings.Join(units, " "))
+		_, _, err := systemd.EnableUnitFilesContext(context.Background(), units, false, true)
+		if err != nil {
+			return RuntimeServiceError.Wrap(err, "cannot enable instances of %s", s.Name)
+		}
+	}
+	cur, err := templateInstances(systemd, s.UnitFile())
+	if err != nil {
+		return err
+	}
+	stale, _ := lo.Difference(cur, units)
+	for _, u := range stale {
+		err = stopDisableUnit(systemd, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateInstances returns the instances of a template unit that
+// systemd knows about: the loaded ones, and the enabled ones, which are
+// not loaded when they are stopped
+func templateInstances(systemd *dbus.Conn, template string) ([]string, error) {
+	pattern := strings.Replace(template, "@.", "@*.", 1)
+	statuses, err := systemd.ListUnitsByPatternsContext(context.Background(), nil, []string{pattern})
+	if err != nil {
+		return nil, RuntimeServiceError.Wrap(err, "cannot list instances of %s", template)
+	}
+	instances := lo.Map(statuses, func(s dbus.UnitStatus, _ int) string {
+		return s.Name
+	})
+	links, _ := filepath.Glob(filepath.Join(SystemdConfPath, "*.wants", pattern))
+	for _, l := range links {
+		instances = append(instances, filepath.Base(l))
+	}
+	instances = lo.Uniq(instances)
+	sort.Strings(instances)
+	return instances, nil
+}
+
+func isTemplate(unit string) bool {
+	return strings.Contains(unit, "@.")
+}
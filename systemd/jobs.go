@@ -0,0 +1,236 @@
+package systemd
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	sdunit "github.com/coreos/go-systemd/v22/unit"
+	godbus "github.com/godbus/dbus/v5"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+)
+
+// Jobs are services that run to completion. Their unit is installed like
+// the one of a service, so that services can depend on them, and "sloop
+// job run" starts a transient copy of it, connected to the terminal.
+
+// jobUnit is the transient unit of a run of a job. A job can only run once
+// at a time, since all the runs would share the same network namespace
+// and machine name, including the ones of its installed unit.
+func jobUnit(name string) string {
+	return "sloop-job-" + name + ".service"
+}
+
+// execCommand is the D-Bus representation of an Exec* option
+type execCommand struct {
+	Path string
+	Args []string
+	IgnoreFailure bool
+}
+
+type credential struct {
+	Name string
+	Path string
+}
+
+// splitExec splits a command line of a unit in its arguments. Only
+// the quoting produced by the templates is supported.
+func splitExec(line string) ([]string, error) {
+	var args []string
+	line = strings.TrimSpace(strings.ReplaceAll(line, "\\\n", " "))
+	for line != "" {
+		end := strings.IndexAny(line, " \t\n")
+		if line[0] == '"' {
+			end = 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, RunJobError.New("unterminated quote in %s", line)
+			}
+			end++
+		}
+		if end == -1 {
+			end = len(line)
+		}
+		arg := line[:end]
+		if arg[0] == '"' {
+			var err error
+			arg, err = strconv.Unquote(arg)
+			if err != nil {
+				return nil, RunJobError.Wrap(err, "invalid argument %s", line[:end])
+			}
+		}
+		args = append(args, arg)
+		line = strings.TrimSpace(line[end:])
+	}
+	return args, nil
+}
+
+// unitProperties turns a unit rendered from the service template into the
+// properties of the transient unit called unit
+func unitProperties(unit string, unitStr string) ([]dbus.Property, error) {
+	opts, err := sdunit.DeserializeOptions(strings.NewReader(unitStr))
+	if err != nil {
+		return nil, RunJobError.Wrap(err, "cannot parse unit %s", unit)
+	}
+	var props []dbus.Property
+	lists := make(map[string][]string)
+	execs := make(map[string][]execCommand)
+	var creds []credential
+	for _, o := range opts {
+		if o.Section == "Install" {
+			continue
+		}
+		// transient units do not expand specifiers
+		value := strings.ReplaceAll(o.Value, "%d", "/run/credentials/" + unit)
+		switch o.Name {
+		case "Description", "Slice", "Type", "NotifyAccess", "KillMode", "Restart":
+			props = append(props, dbus.Property{Name: o.Name, Value: godbus.MakeVariant(value)})
+		case "Delegate":
+			props = append(props, dbus.Property{Name: o.Name, Value: godbus.MakeVariant(value == "yes")})
+		case "PartOf", "Before":
+			// a run of a job is not part of sloop.target
+		case "Wants", "Requires", "BindsTo", "After", "Environment":
+			lists[o.Name] = append(lists[o.Name], value)
+		case "LoadCredentialEncrypted":
+			name, path, _ := strings.Cut(value, ":")
+			creds = append(creds, credential{name, path})
+		case "ExecStartPre", "ExecStart", "ExecStopPost":
+			args, err := splitExec(strings.TrimPrefix(value, "-"))
+			if err != nil {
+				return nil, err
+			}
+			if len(args) == 0 {
+				return nil, RunJobError.New("empty %s in unit %s", o.Name, unit)
+			}
+			// like systemd-run, look up the executable here
+			path, err := exec.LookPath(args[0])
+			if err != nil {
+				path = args[0]
+			}
+			execs[o.Name] = append(execs[o.Name], execCommand{path, args, strings.HasPrefix(value, "-")})
+		default:
+			return nil, RunJobError.New("option %s of unit %s is not supported in a transient unit", o.Name, unit)
+		}
+	}
+	for n, l := range lists {
+		props = append(props, dbus.Property{Name: n, Value: godbus.MakeVariant(l)})
+	}
+	for n, e := range execs {
+		props = append(props, dbus.Property{Name: n, Value: godbus.MakeVariant(e)})
+	}
+	if len(creds) > 0 {
+		props = append(props, dbus.Property{Name: "LoadCredentialEncrypted", Value: godbus.MakeVariant(creds)})
+	}
+	return props, nil
+}
+
+func fdProperty(name string, f *os.File) dbus.Property {
+	return dbus.Property{Name: name, Value: godbus.MakeVariant(godbus.UnixFD(f.Fd()))}
+}
+
+// RunJob runs a job in a transient unit, with args as the command if they
+// are not empty, and returns the exit status of the command. The unit is
+// removed once the command exits, or when sloop is interrupted.
+func RunJob(systemd *dbus.Conn, s cue.Service, args []string) (int, error) {
+	if !s.Job {
+		return 0, RunJobError.New("%s is a service, not a job", s.Name)
+	}
+	_, err := os.Stat(filepath.Join(common.ServicePath, s.Name, "config.json"))
+	if err != nil {
+		return 0, RunJobError.Wrap(err, "job %s is not installed, run the configuration first", s.Name)
+	}
+	installed := s.Units()[0]
+	prop, err := systemd.GetUnitPropertyContext(context.Background(), installed, "ActiveState")
+	if err != nil {
+		return 0, RunJobError.Wrap(err, "cannot get state of %s", installed)
+	}
+	if state, _ := prop.Value.Value().(string); state != "inactive" && state != "failed" {
+		return 0, RunJobError.New("job %s is already running in %s, wait for it to finish", s.Name, installed)
+	}
+	if len(args) > 0 {
+		s.Exec.Start = args
+	}
+	unitStr, err := renderService(s)
+	if err != nil {
+		return 0, err
+	}
+	unit := jobUnit(s.Name)
+	props, err := unitProperties(unit, unitStr)
+	if err != nil {
+		return 0, err
+	}
+	props = append(props,
+		// keep the unit around to read the exit status
+		dbus.PropRemainAfterExit(true),
+		fdProperty("StandardInputFileDescriptor", os.Stdin),
+		fdProperty("StandardOutputFileDescriptor", os.Stdout),
+		fdProperty("StandardErrorFileDescriptor", os.Stderr),
+	)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	ctx := context.Background()
+	wait := make(chan string, 1)
+	_, err = systemd.StartTransientUnitContext(ctx, unit, "fail", props, wait)
+	if err != nil {
+		return 0, RunJobError.Wrap(err, "cannot start job %s", s.Name)
+	}
+	res := ""
+	for res == "" {
+		select {
+		case res = <-wait:
+		case <-sig:
+			_, err = systemd.StopUnitContext(ctx, unit, "replace", nil)
+			if err != nil {
+				return 0, RunJobError.Wrap(err, "cannot stop job %s", s.Name)
+			}
+		}
+	}
+
+	status := 0
+	prop, err = systemd.GetServicePropertyContext(ctx, unit, "ExecMainStatus")
+	if err != nil {
+		return 0, RunJobError.Wrap(err, "cannot get exit status of job %s", s.Name)
+	}
+	if v, ok := prop.Value.Value().(int32); ok {
+		status = int(v)
+	}
+	if res != "done" && status == 0 {
+		// the command did not run at all
+		status = 1
+	}
+
+	prop, err = systemd.GetUnitPropertyContext(ctx, unit, "ActiveState")
+	if err != nil {
+		return status, RunJobError.Wrap(err, "cannot get state of job %s", s.Name)
+	}
+	if prop.Value.Value() == "failed" {
+		err = systemd.ResetFailedUnitContext(ctx, unit)
+		if err != nil {
+			return status, RunJobError.Wrap(err, "cannot remove unit of job %s", s.Name)
+		}
+		return status, nil
+	}
+	stopped := make(chan string, 1)
+	_, err = systemd.StopUnitContext(ctx, unit, "replace", stopped)
+	if err != nil {
+		return status, RunJobError.Wrap(err, "cannot remove unit of job %s", s.Name)
+	}
+	<-stopped
+	return status, nil
+}
@@ -0,0 +1,140 @@
+package systemd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+)
+
+// dhcpStr is the udhcpc script used by macvlan and ipvlan interfaces
+// without a static address. Unlike the default one it only configures
+// the interface, and leaves resolv.conf of the host alone.
+const dhcpStr string = `#!/bin/sh
+case "$1" in
+deconfig)
+	ip addr flush dev "$interface"
+	;;
+bound|renew)
+	ip addr flush dev "$interface"
+	ip addr add "$ip/$mask" dev "$interface"
+	if [ -n "$router" ]; then
+		ip route replace default via "${router%% *}" dev "$interface"
+	fi
+	;;
+esac
+`
+func handleDhcp() error {
+	p := filepath.Join(common.UtilsPath, "dhcp")
+	oldScript, _ := os.ReadFile(p)
+	if bytes.Equal(oldScript, []byte(dhcpStr)) {
+		return nil
+	}
+	err := os.WriteFile(p, []byte(dhcpStr), 0777)
+	if err != nil {
+		return CreateImageError.Wrap(err, "failed to write dhcp script")
+	}
+	return nil
+}
+
+// forward6Str enables IPv6 forwarding. With forwarding on, the kernel
+// ignores router advertisements on interfaces with accept_ra=1, and the
+// host would lose the addresses and routes it got with SLAAC: they are
+// set to accept_ra=2 first. Nothing is done if forwarding is already on.
+const forward6Str string = `#!/bin/sh
+[ "$(cat /proc/sys/net/ipv6/conf/all/forwarding)" = 1 ] && exit 0
+for f in /proc/sys/net/ipv6/conf/*/accept_ra; do
+	[ "$(cat "$f")" = 1 ] && echo 2 > "$f"
+done
+sysctl -q net.ipv6.conf.all.forwarding=1
+`
+func handleForward6() error {
+	p := filepath.Join(common.UtilsPath, "forward6")
+	oldScript, _ := os.ReadFile(p)
+	if bytes.Equal(oldScript, []byte(forward6Str)) {
+		return nil
+	}
+	err := os.WriteFile(p, []byte(forward6Str), 0777)
+	if err != nil {
+		return CreateImageError.Wrap(err, "failed to write forward6 script")
+	}
+	return nil
+}
+
+// netnsTemplateStr sets up a network namespace and its interfaces, for
+// a service or for a pod
+const netnsTemplateStr = `
+{{- define "netns" }}
+{{$.Exec}} = ip netns add {{.Name}}
+{{$.Exec}} = ip netns exec {{.Name}} ip link set lo up
+
+{{- range $n := .Interfaces }}
+{{- with $ifname := index $.HostIfnames $n.Name }}
+{{- if eq $n.Type "bridge" }}
+{{$.Exec}} = ip link add {{ $ifname }} type veth peer {{$n.Name}} netns {{$.Name}}
+{{$.Exec}} = ip link set dev {{ $ifname }} up
+{{$.Exec}} = ip link set dev {{ $ifname }} master {{$n.Bridge.Name}}
+{{$.Exec}} = ip netns exec {{$.Name}} ip link set {{$n.Name}} up
+{{- if $n.Bridge.Prefix }}
+{{$.Exec}} = ip netns exec {{$.Name}} ip addr add {{$n.Ip}}/{{$n.Bridge.Prefix}} dev {{$n.Name}}
+{{$.Exec}} = ip netns exec {{$.Name}} ip route add default via {{$n.Bridge.Ip}}
+{{- end }}
+{{- if $n.Bridge.Prefix6 }}
+{{$.Exec}} = ip netns exec {{$.Name}} ip -6 addr add {{$n.Ip6}}/{{$n.Bridge.Prefix6}} dev {{$n.Name}} nodad
+{{$.Exec}} = ip netns exec {{$.Name}} ip -6 route add default via {{$n.Bridge.Ip6}}
+{{- end }}
+{{- else if eq $n.Type "routed" }}
+{{$.Exec}} = ip link add {{ $ifname }} type veth peer {{$n.Name}} netns {{$.Name}}
+{{$.Exec}} = ip link set dev {{ $ifname }} up
+{{$.Exec}} = sysctl net.ipv4.ip_forward=1
+{{$.Exec}} = sysctl net.ipv4.conf.{{ $ifname }}.proxy_arp=1
+{{$.Exec}} = ip route add {{$n.Ip}}/32 dev {{ $ifname }}
+{{$.Exec}} = ip netns exec {{$.Name}} ip link set {{$n.Name}} up
+{{$.Exec}} = ip netns exec {{$.Name}} ip addr add {{$n.Ip}}/32 dev {{$n.Name}}
+{{$.Exec}} = ip netns exec {{$.Name}} ip route add default via 169.254.1.1 dev {{$n.Name}} onlink
+{{- if $n.Ip6 }}
+{{$.Exec}} = {{$.UtilsPath}}/forward6
+{{$.Exec}} = ip -6 addr add fe80::1/64 dev {{ $ifname }} nodad
+{{$.Exec}} = ip -6 route add {{$n.Ip6}}/128 dev {{ $ifname }}
+{{$.Exec}} = ip netns exec {{$.Name}} ip -6 addr add {{$n.Ip6}}/128 dev {{$n.Name}} nodad
+{{$.Exec}} = ip netns exec {{$.Name}} ip -6 route add default via fe80::1 dev {{$n.Name}}
+{{- end }}
+{{- else }}
+{{$.Exec}} = ip link add {{ $ifname }} link {{$n.Parent}} type {{$n.Type}} mode {{$n.Mode}}
+{{$.Exec}} = ip link set dev {{ $ifname }} netns {{$.Name}}
+{{$.Exec}} = ip netns exec {{$.Name}} ip link set dev {{ $ifname }} name {{$n.Name}}
+{{$.Exec}} = ip netns exec {{$.Name}} ip link set {{$n.Name}} up
+{{- if $n.Ip }}
+{{$.Exec}} = ip netns exec {{$.Name}} ip addr add {{$n.Ip}}/{{$n.Prefix}} dev {{$n.Name}}
+{{- if $n.Gateway }}
+{{$.Exec}} = ip netns exec {{$.Name}} ip route add default via {{$n.Gateway}}
+{{- end }}
+{{- else }}
+{{$.Exec}} = ip netns exec {{$.Name}} busybox udhcpc -b -i {{$n.Name}} -s {{$.UtilsPath}}/dhcp
+{{- end }}
+{{- end }}
+
+ExecStopPost = -ip netns exec {{$.Name}} ip link delete {{$n.Name}}
+{{- end }}
+{{- end }}
+
+ExecStopPost = -ip netns delete {{.Name}}
+{{- end }}
+`
+
+// NetnsConf describes a network namespace owned by a unit
+type NetnsConf struct {
+	// Name of the namespace in /var/run/netns
+	Name string
+	// HostIfnames maps the interfaces to their names on the host side
+	HostIfnames map[string]string
+	// Exec is the directive that runs the setup commands
+	Exec string
+	UtilsPath string
+	Interfaces map[string]*cue.Interface
+}
+
+var netnsTemplate *template.Template = template.Must(template.New("netnsDefs").Parse(netnsTemplateStr))
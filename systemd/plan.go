@@ -0,0 +1,181 @@
+package systemd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/samber/lo"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/image"
+)
+
+// Plan describes what Apply would change, without changing anything
+type Plan struct {
+	RemoveUnits []string `json:"removeUnits"`
+	WriteUnits []string `json:"writeUnits"`
+	Services []string `json:"services"`
+	// ReloadServices are the services whose files change, but which
+	// are not rebuilt. Services without exec.reload are restarted
+	// instead, they are in Services.
+	ReloadServices []string `json:"reloadServices"`
+	FetchImages []string `json:"fetchImages"`
+	// BuildImages are the images built by sloop that are missing, or
+	// whose steps changed since they were built
+	BuildImages []string `json:"buildImages"`
+	RemoveImages []string `json:"removeImages"`
+}
+
+func (p *Plan) Empty() bool {
+	return len(p.RemoveUnits) == 0 && len(p.WriteUnits) == 0 && len(p.Services) == 0 &&
+		len(p.ReloadServices) == 0 && len(p.FetchImages) == 0 && len(p.BuildImages) == 0 && len(p.RemoveImages) == 0
+}
+
+func unitDiffers(name string, content string) bool {
+	oldContent, err := os.ReadFile(filepath.Join(common.UnitPath, name))
+	return err != nil || string(oldContent) != content
+}
+
+// serviceFilesChange returns what handleServiceFiles would do to s
+func serviceFilesChange(config cue.Config, s cue.Service) (serviceChange, error) {
+	p := filepath.Join(common.ServicePath, s.Name)
+	oldConf, _ := os.ReadFile(filepath.Join(p, "conf.cue"))
+	newConf, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return serviceUnchanged, CreateServiceError.Wrap(err, "cannot marshal config %s", string(newConf))
+	}
+	change := classifyChange(oldConf, newConf, s)
+	if change > serviceReload {
+		return change, nil
+	}
+	hashed, err := renderFiles(config, s, secretsHashed)
+	if err != nil {
+		return serviceUnchanged, err
+	}
+	if t := templatesChange(s, hashed, p); t > change {
+		return t, nil
+	}
+	return change, nil
+}
+
+// GetPlan computes the changes that Apply would make for config
+func GetPlan(config cue.Config) (*Plan, error) {
+	plan := &Plan{}
+
+	curUnits, err := getCurUnits()
+	if err != nil && !os.IsNotExist(errorCause(err)) {
+		return nil, err
+	}
+	plan.RemoveUnits, _ = lo.Difference(curUnits, ConfigUnits(config))
+
+	curImages, err := getCurImages()
+	if err != nil && !os.IsNotExist(errorCause(err)) {
+		return nil, err
+	}
+	builds, err := gatherBuilds(config.Services)
+	if err != nil {
+		return nil, err
+	}
+	var addImages []string
+	plan.RemoveImages, addImages = lo.Difference(curImages, gatherImages(config.Services))
+	plan.FetchImages = lo.Filter(addImages, func(i string, _ int) bool {
+		_, ok := builds[i]
+		return !ok
+	})
+	for tag, b := range builds {
+		if buildChanged(b) {
+			plan.BuildImages = append(plan.BuildImages, tag)
+		}
+	}
+
+	if unitDiffers("sloop.slice", sliceStr) {
+		plan.WriteUnits = append(plan.WriteUnits, "sloop.slice")
+	}
+	if unitDiffers("sloop.target", targetStr) {
+		plan.WriteUnits = append(plan.WriteUnits, "sloop.target")
+	}
+	for n, b := range config.Bridges {
+		unitStr, err := renderBridge(b)
+		if err != nil {
+			return nil, err
+		}
+		if name := "sloop-bridge-" + n + ".service"; unitDiffers(name, unitStr) {
+			plan.WriteUnits = append(plan.WriteUnits, name)
+		}
+	}
+	for n, p := range config.Pods {
+		unitStr, err := renderPod(p)
+		if err != nil {
+			return nil, err
+		}
+		if name := podUnit(n); unitDiffers(name, unitStr) {
+			plan.WriteUnits = append(plan.WriteUnits, name)
+		}
+	}
+	for n, s := range config.Services {
+		change, err := serviceFilesChange(config, s)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case change == serviceReload && len(s.Exec.Reload) > 0:
+			plan.ReloadServices = append(plan.ReloadServices, n)
+		case change != serviceUnchanged:
+			plan.Services = append(plan.Services, n)
+		}
+		for _, sock := range s.Sockets {
+			unitStr, err := renderSocket(s, sock)
+			if err != nil {
+				return nil, err
+			}
+			if name := socketUnit(n, sock.Name); unitDiffers(name, unitStr) {
+				plan.WriteUnits = append(plan.WriteUnits, name)
+			}
+		}
+		if lo.Contains(addImages, s.Image.From) {
+			// The unit can only be rendered once the image is available
+			plan.WriteUnits = append(plan.WriteUnits, s.UnitFile())
+			continue
+		}
+		unitStr, err := renderService(s)
+		if err != nil {
+			return nil, err
+		}
+		if unitDiffers(s.UnitFile(), unitStr) {
+			plan.WriteUnits = append(plan.WriteUnits, s.UnitFile())
+		}
+	}
+	for n, t := range config.Timers {
+		timerStr, timerServiceStr, err := renderTimer(t, config.Services)
+		if err != nil {
+			return nil, err
+		}
+		if unitDiffers(n+".timer", timerStr) {
+			plan.WriteUnits = append(plan.WriteUnits, n+".timer")
+		}
+		if unitDiffers(n+".service", timerServiceStr) {
+			plan.WriteUnits = append(plan.WriteUnits, n+".service")
+		}
+	}
+	for _, l := range [][]string{plan.RemoveUnits, plan.WriteUnits, plan.Services, plan.ReloadServices,
+		plan.FetchImages, plan.BuildImages, plan.RemoveImages} {
+		sort.Strings(l)
+	}
+	return plan, nil
+}
+
+// buildChanged returns true if handleBuild would build b. The base image
+// is the one it last resolved to: a new one in the registry is only
+// found when building.
+func buildChanged(b cue.Build) bool {
+	built := image.BuiltKey(GetImagePath(b.Tag))
+	base, ok := image.LastBase(common.BuildPath, b.From)
+	if built == "" || !ok {
+		return true
+	}
+	keys := image.BuildKeys(b, base)
+	return built != keys[len(keys)-1]
+}
@@ -0,0 +1,78 @@
+package systemd
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+)
+
+const podTemplateStr = `
+[Unit]
+Description = Sloop pod {{.Name}}
+StopWhenUnneeded = yes
+{{- range $u := .Requires }}
+Requires = {{$u}}
+After = {{$u}}
+{{- end }}
+
+[Service]
+Slice=sloop.slice
+Type = oneshot
+RemainAfterExit = true
+{{- template "netns" .Netns }}
+
+[Install]
+WantedBy=sloop.target
+`
+
+var podTemplate *template.Template = template.Must(template.Must(netnsTemplate.Clone()).New("pod").Parse(podTemplateStr))
+
+type PodConf struct {
+	Name string
+	Netns *NetnsConf
+	Requires []string
+}
+
+func podUnit(name string) string {
+	return "sloop-pod-" + name + ".service"
+}
+
+func podNetns(name string) string {
+	return "sloop-pod-" + name
+}
+
+func renderPod(p cue.Pod) (string, error) {
+	conf := PodConf{
+		Name: p.Name,
+		Netns: &NetnsConf{
+			Name: podNetns(p.Name),
+			HostIfnames: hostIfnames("pod-" + p.Name, p.Net.Interfaces),
+			Exec: "ExecStart",
+			UtilsPath: common.UtilsPath,
+			Interfaces: p.Net.Interfaces,
+		},
+	}
+	for _, i := range p.Net.Interfaces {
+		if i.Type == "bridge" {
+			conf.Requires = append(conf.Requires, "sloop-bridge-" + i.Bridge.Name + ".service")
+		}
+	}
+	var buf bytes.Buffer
+	err := podTemplate.Execute(&buf, conf)
+	if err != nil {
+		return "", CreateServiceError.Wrap(err, "failed to execute template for pod %s", p.Name)
+	}
+	return buf.String(), nil
+}
+
+func handlePod(systemd *dbus.Conn, p cue.Pod) (bool, error) {
+	unitStr, err := renderPod(p)
+	if err != nil {
+		return false, err
+	}
+	return writeLinkUnit(systemd, podUnit(p.Name), unitStr, false)
+}
@@ -0,0 +1,275 @@
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+
+	"yuri91/sloop/catatonit"
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+)
+
+// SystemdConfPath is where units are linked and enabled, relative to
+// the root of a machine
+const SystemdConfPath = "/etc/systemd/system"
+
+// rendered are the units of a configuration, and the ones to enable
+type rendered struct {
+	units map[string]string
+	enabled []string
+}
+
+func (r *rendered) add(name string, content string, enable bool) {
+	r.units[name] = content
+	if enable {
+		r.enabled = append(r.enabled, name)
+	}
+}
+
+// renderUnits renders all the units of config, enabled like Apply does
+func renderUnits(config cue.Config) (*rendered, error) {
+	r := &rendered{units: make(map[string]string)}
+	r.add("sloop.slice", sliceStr, false)
+	r.add("sloop.target", targetStr, true)
+	for _, b := range config.Bridges {
+		unitStr, err := renderBridge(b)
+		if err != nil {
+			return nil, err
+		}
+		r.add("sloop-bridge-" + b.Name + ".service", unitStr, false)
+	}
+	for _, p := range config.Pods {
+		unitStr, err := renderPod(p)
+		if err != nil {
+			return nil, err
+		}
+		r.add(podUnit(p.Name), unitStr, false)
+	}
+	for _, s := range config.Services {
+		unitStr, err := renderService(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.Instances) > 0 {
+			r.add(s.UnitFile(), unitStr, false)
+			if s.Enable {
+				r.enabled = append(r.enabled, s.Units()...)
+			}
+			continue
+		}
+		r.add(s.UnitFile(), unitStr, s.Enable && len(s.Sockets) == 0)
+		for _, sock := range s.Sockets {
+			sockStr, err := renderSocket(s, sock)
+			if err != nil {
+				return nil, err
+			}
+			r.add(socketUnit(s.Name, sock.Name), sockStr, s.Enable)
+		}
+	}
+	for _, t := range config.Timers {
+		timerStr, timerServiceStr, err := renderTimer(t, config.Services)
+		if err != nil {
+			return nil, err
+		}
+		r.add(t.Name + ".timer", timerStr, true)
+		r.add(t.Name + ".service", timerServiceStr, false)
+	}
+	sort.Strings(r.enabled)
+	return r, nil
+}
+
+// wantedBy returns the units in the WantedBy of the install section of
+// a unit
+func wantedBy(unitStr string) []string {
+	var targets []string
+	scanner := bufio.NewScanner(strings.NewReader(unitStr))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && strings.TrimSpace(key) == "WantedBy" {
+			targets = append(targets, strings.Fields(value)...)
+		}
+	}
+	return targets
+}
+
+// templateFile returns the unit file of a unit, which is the template
+// for an instance
+func templateFile(unit string) string {
+	at := strings.Index(unit, "@")
+	if at < 0 {
+		return unit
+	}
+	return unit[:at+1] + filepath.Ext(unit)
+}
+
+// renderTree writes files under a root directory
+type renderTree struct {
+	root string
+}
+
+func (t renderTree) write(p string, content []byte, perm os.FileMode) error {
+	fullP := filepath.Join(t.root, p)
+	err := os.MkdirAll(filepath.Dir(fullP), 0755)
+	if err != nil {
+		return FilesystemError.Wrap(err, "cannot create directory for %s", fullP)
+	}
+	err = os.WriteFile(fullP, content, perm)
+	if err != nil {
+		return FilesystemError.Wrap(err, "cannot write %s", fullP)
+	}
+	return nil
+}
+
+// link makes p a symbolic link to target, which is a path on the
+// machine the tree is for
+func (t renderTree) link(p string, target string) error {
+	fullP := filepath.Join(t.root, p)
+	err := os.MkdirAll(filepath.Dir(fullP), 0755)
+	if err != nil {
+		return FilesystemError.Wrap(err, "cannot create directory for %s", fullP)
+	}
+	os.Remove(fullP)
+	err = os.Symlink(target, fullP)
+	if err != nil {
+		return FilesystemError.Wrap(err, "cannot link %s", fullP)
+	}
+	return nil
+}
+
+// Render writes the files that Create would produce for config under
+// out, which stands for the root of the machine that runs them. Units
+// are linked and enabled with symbolic links in /etc/systemd/system.
+// The state of sloop is in prefix instead of /var/lib/sloop, if it is
+// not empty.
+//
+// Nothing is asked to systemd and no image is fetched: the metadata of
+// images is read from the local image store, so they must have been
+// fetched, or built, before. The directories of named volumes are
+// created. Secrets, which are encrypted for the machine that runs them,
+// and firewall rules, which are loaded with netlink and have no file,
+// are left to Create.
+func Render(config cue.Config, out string, prefix string) error {
+	cache := common.ImagePath
+	err := checkImages(config, cache)
+	if err != nil {
+		return err
+	}
+	if prefix != "" {
+		defer common.SetBaseDir(common.BaseDir())
+		common.SetBaseDir(prefix)
+	}
+	imageCachePath = cache
+	defer func() { imageCachePath = "" }()
+
+	tree := renderTree{out}
+	utils := map[string][]byte{
+		"catatonit": catatonit.Bin,
+		"nsenter": []byte(nsenterStr),
+		"secretenv": []byte(secretEnvStr),
+		"dhcp": []byte(dhcpStr),
+		"forward6": []byte(forward6Str),
+		"freezer": []byte(freezerStr),
+		"withnetns": []byte(withNetnsStr),
+	}
+	for n, content := range utils {
+		err = tree.write(filepath.Join(common.UtilsPath, n), content, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	r, err := renderUnits(config)
+	if err != nil {
+		return err
+	}
+	for name, unitStr := range r.units {
+		unitP := filepath.Join(common.UnitPath, name)
+		err = tree.write(unitP, []byte(unitStr), 0644)
+		if err != nil {
+			return err
+		}
+		err = tree.link(filepath.Join(SystemdConfPath, name), unitP)
+		if err != nil {
+			return err
+		}
+	}
+	for _, u := range r.enabled {
+		unitP := filepath.Join(common.UnitPath, templateFile(u))
+		for _, t := range wantedBy(r.units[templateFile(u)]) {
+			err = tree.link(filepath.Join(SystemdConfPath, t + ".wants", u), unitP)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	names := lo.Keys(config.Services)
+	sort.Strings(names)
+	for _, n := range names {
+		s := config.Services[n]
+		if len(s.Image.Secrets) > 0 {
+			fmt.Printf("Skipping secrets of %s, they are encrypted when the configuration is applied\n", s.Name)
+		}
+		p := filepath.Join(out, common.ServicePath, s.Name)
+		err = os.MkdirAll(filepath.Join(p, "files"), 0700)
+		if err != nil {
+			return FilesystemError.Wrap(err, "cannot create service %s directory", s.Name)
+		}
+		files, err := renderFiles(config, s, secretsRefused)
+		if err != nil {
+			return err
+		}
+		err = writeServiceFiles(s, files, p)
+		if err != nil {
+			return err
+		}
+		err = writeTemplateSums(s, files, p)
+		if err != nil {
+			return err
+		}
+	}
+	for n, hostsStr := range etcHosts(config.Services, config.Pods) {
+		err = tree.write(filepath.Join(common.ServicePath, n, "hosts"), []byte(hostsStr), 0666)
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range config.Volumes {
+		if v.Type != "named" {
+			continue
+		}
+		err = createVolumeDir(v, filepath.Join(out, volumePath(v.Name)))
+		if err != nil {
+			return err
+		}
+	}
+	if len(config.Bridges) > 0 {
+		fmt.Printf("Skipping firewall rules, they are loaded when the configuration is applied\n")
+	}
+	return nil
+}
+
+// checkImages returns an error for the first service whose image is not
+// in the image store in cache, which Render reads their metadata from
+func checkImages(config cue.Config, cache string) error {
+	names := lo.Keys(config.Services)
+	sort.Strings(names)
+	for _, n := range names {
+		s := config.Services[n]
+		p := filepath.Join(cache, replaceLast(s.Image.From, ":", "-"), "config.json")
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		if s.Image.Build != nil {
+			return RenderError.New("image %s of service %s is not built yet: apply the configuration with \"sloop run\" before rendering it", s.Image.From, n)
+		}
+		return RenderError.New("image %s of service %s is not in the image store %s: fetch it, or apply the configuration with \"sloop run\", before rendering it", s.Image.From, n, cache)
+	}
+	return nil
+}
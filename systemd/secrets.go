@@ -0,0 +1,128 @@
+package systemd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/secret"
+)
+
+// secretEnvStr exports the credentials given as VAR=credential arguments
+// as environment variables, then runs the command after "--"
+const secretEnvStr string = `#!/bin/bash
+while [ "$1" != "--" ]; do
+	export "${1%%=*}=$(cat "${CREDENTIALS_DIRECTORY}/${1#*=}")"
+	shift
+done
+shift
+exec "$@"
+`
+func handleSecretEnv() error {
+	p := filepath.Join(common.UtilsPath, "secretenv")
+	oldScript, _ := os.ReadFile(p)
+	if bytes.Equal(oldScript, []byte(secretEnvStr)) {
+		return nil
+	}
+	err := os.WriteFile(p, []byte(secretEnvStr), 0777)
+	if err != nil {
+		return CreateImageError.Wrap(err, "failed to write secretenv script")
+	}
+	return nil
+}
+
+func credentialName(secretName string) string {
+	return "secret-" + secretName
+}
+
+func credentialPath(serviceDir string, secretName string) string {
+	return filepath.Join(serviceDir, "credentials", credentialName(secretName))
+}
+
+// handleSecrets decrypts the secrets of a service with the host key, and
+// encrypts them again as systemd credentials, so that the plain text only
+// ever exists in the credentials directory of the running unit
+func handleSecrets(s cue.Service, serviceDir string) error {
+	if len(s.Image.Secrets) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Join(serviceDir, "credentials"), 0700)
+	if err != nil {
+		return CreateServiceError.Wrap(err, "cannot create credentials directory for service %s", s.Name)
+	}
+	for n, sec := range s.Image.Secrets {
+		if sec.File == "" && sec.Env == "" {
+			return CreateServiceError.New("secret %s of service %s has neither a file nor an env", n, s.Name)
+		}
+		plain, err := secret.Decrypt(common.SecretKeyPath, sec.Age)
+		if err != nil {
+			return CreateServiceError.Wrap(err, "cannot decrypt secret %s of service %s", n, s.Name)
+		}
+		err = encryptCredential(credentialName(n), plain, credentialPath(serviceDir, n))
+		if err != nil {
+			return CreateServiceError.Wrap(err, "cannot encrypt credential for secret %s of service %s", n, s.Name)
+		}
+	}
+	return nil
+}
+
+// fileCredentialName returns the name of the credential of a file of
+// service whose template calls secret. Paths are hashed, since they are
+// not valid credential names.
+func fileCredentialName(service string, path string) string {
+	h := sha256.Sum256([]byte(service + ":" + path))
+	return "file-" + hex.EncodeToString(h[:8])
+}
+
+// fileCredentials maps the credential names of the files of s whose
+// template calls secret to their encrypted files
+func fileCredentials(s cue.Service, serviceDir string) map[string]string {
+	creds := make(map[string]string)
+	for _, path := range secretFiles(s) {
+		n := fileCredentialName(s.Name, path)
+		creds[n] = filepath.Join(serviceDir, "credentials", n)
+	}
+	return creds
+}
+
+// handleFileCredentials encrypts the files of a service whose template
+// calls secret as systemd credentials, so that their content, like the
+// secrets, is only in clear in the credentials directory of the running
+// unit
+func handleFileCredentials(s cue.Service, files map[string]renderedFile, serviceDir string) error {
+	paths := secretFiles(s)
+	if len(paths) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Join(serviceDir, "credentials"), 0700)
+	if err != nil {
+		return CreateServiceError.Wrap(err, "cannot create credentials directory for service %s", s.Name)
+	}
+	for _, path := range paths {
+		n := fileCredentialName(s.Name, path)
+		err = encryptCredential(n, []byte(files[path].Content), filepath.Join(serviceDir, "credentials", n))
+		if err != nil {
+			return CreateServiceError.Wrap(err, "cannot encrypt credential for file %s of service %s", path, s.Name)
+		}
+	}
+	return nil
+}
+
+// encryptCredential encrypts plain with the key of the host, for the
+// credential name
+func encryptCredential(name string, plain []byte, p string) error {
+	cmd := exec.Command("systemd-creds", "encrypt", "--name=" + name, "-", p)
+	cmd.Stdin = bytes.NewReader(plain)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
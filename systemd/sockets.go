@@ -0,0 +1,118 @@
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/template"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/cue"
+)
+
+const socketTemplateStr = `
+[Unit]
+Description = Sloop socket {{.Name}} of service {{.Service}}
+PartOf = sloop.target
+Before = sloop.target
+{{- if .Bridge }}
+Requires = sloop-bridge-{{.Bridge}}.service
+After = sloop-bridge-{{.Bridge}}.service
+{{- end }}
+
+[Socket]
+{{- if eq .Type "datagram" }}
+ListenDatagram = {{.Listen}}
+{{- else }}
+ListenStream = {{.Listen}}
+{{- end }}
+{{- if ne .Type "unix" }}
+FreeBind = yes
+{{- end }}
+Service = {{.Service}}.service
+FileDescriptorName = {{.Name}}
+
+{{- if .Enable }}
+[Install]
+WantedBy=sloop.target
+{{- end }}
+`
+
+var socketTemplate *template.Template = template.Must(template.New("socket").Parse(socketTemplateStr))
+
+type SocketConf struct {
+	Name string
+	Service string
+	Type string
+	Listen string
+	Bridge string
+	Enable bool
+}
+
+func socketUnit(service string, socket string) string {
+	return service + "-" + socket + ".socket"
+}
+
+// socketUnits returns the socket units of a service, sorted by name
+func socketUnits(s cue.Service) []string {
+	units := lo.MapToSlice(s.Sockets, func(_ string, sock cue.Socket) string {
+		return socketUnit(s.Name, sock.Name)
+	})
+	sort.Strings(units)
+	return units
+}
+
+func renderSocket(s cue.Service, sock cue.Socket) (string, error) {
+	conf := SocketConf{
+		Name: sock.Name,
+		Service: s.Name,
+		Type: sock.Type,
+		Enable: s.Enable,
+	}
+	switch {
+	case sock.Type == "unix":
+		conf.Listen = sock.Path
+	case sock.Bridge == nil:
+		conf.Listen = fmt.Sprint(sock.Port)
+	case sock.Bridge.Prefix != 0:
+		conf.Listen = fmt.Sprintf("%s:%d", sock.Bridge.Ip, sock.Port)
+		conf.Bridge = sock.Bridge.Name
+	case sock.Bridge.Prefix6 != 0:
+		conf.Listen = fmt.Sprintf("[%s]:%d", sock.Bridge.Ip6, sock.Port)
+		conf.Bridge = sock.Bridge.Name
+	default:
+		return "", CreateServiceError.New("socket %s of service %s is on bridge %s, which has no address", sock.Name, s.Name, sock.Bridge.Name)
+	}
+	var buf bytes.Buffer
+	err := socketTemplate.Execute(&buf, conf)
+	if err != nil {
+		return "", CreateServiceError.Wrap(err, "failed to execute template for socket %s of service %s", sock.Name, s.Name)
+	}
+	return buf.String(), nil
+}
+
+// handleSockets writes the socket units of a service. Changed sockets
+// are stopped, so that they are started again with the new settings.
+func handleSockets(systemd *dbus.Conn, s cue.Service) (bool, error) {
+	changed := false
+	for _, sock := range s.Sockets {
+		unitStr, err := renderSocket(s, sock)
+		if err != nil {
+			return false, err
+		}
+		unitChanged, err := writeLinkUnit(systemd, socketUnit(s.Name, sock.Name), unitStr, s.Enable)
+		if err != nil {
+			return false, err
+		}
+		if unitChanged {
+			err = stopUnit(systemd, socketUnit(s.Name, sock.Name))
+			if err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,97 @@
+package systemd
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/joomcode/errorx"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/cue"
+)
+
+type UnitStatus struct {
+	Name string `json:"name"`
+	LoadState string `json:"loadState"`
+	ActiveState string `json:"activeState"`
+	SubState string `json:"subState"`
+}
+
+type UnitEvent struct {
+	Name string `json:"name"`
+	SubState string `json:"subState"`
+}
+
+func errorCause(err error) error {
+	if errx, ok := err.(*errorx.Error); ok {
+		return errx.Cause()
+	}
+	return err
+}
+
+// Status returns the state of all the units generated from config. For
+// replicated services, it returns the state of every instance.
+func Status(systemd *dbus.Conn, config cue.Config) ([]UnitStatus, error) {
+	units := lo.Filter(ConfigUnits(config), func(u string, _ int) bool {
+		return !isTemplate(u)
+	})
+	for _, s := range config.Services {
+		if len(s.Instances) > 0 {
+			units = append(units, s.Units()...)
+		}
+	}
+	statuses, err := systemd.ListUnitsByNamesContext(context.Background(), units)
+	if err != nil {
+		return nil, RuntimeServiceError.Wrap(err, "cannot list units")
+	}
+	return lo.Map(statuses, func(s dbus.UnitStatus, _ int) UnitStatus {
+		return UnitStatus{s.Name, s.LoadState, s.ActiveState, s.SubState}
+	}), nil
+}
+
+// Restart restarts the given unit and waits for the job to complete
+func Restart(systemd *dbus.Conn, name string) error {
+	wait := make(chan string)
+	_, err := systemd.RestartUnitContext(context.Background(), name, "replace", wait)
+	if err != nil {
+		return RuntimeServiceError.Wrap(err, "cannot restart unit %s", name)
+	}
+	res := <-wait
+	if res != "done" {
+		return RuntimeServiceError.New("cannot restart unit %s: %s", name, res)
+	}
+	return nil
+}
+
+// Logs returns the last lines of the journal of the given unit
+func Logs(name string, lines int) ([]string, error) {
+	out, err := exec.Command("journalctl", "--no-pager", "-o", "short-iso", "-n", strconv.Itoa(lines), "-u", name).Output()
+	if err != nil {
+		return nil, RuntimeServiceError.Wrap(err, "cannot read journal of unit %s", name)
+	}
+	return strings.Split(strings.TrimRight(string(out), "\n"), "\n"), nil
+}
+
+// Subscribe sends an event on events every time the state of a unit
+// changes, as reported by systemd signals. Only units for which filter
+// returns true are reported.
+func Subscribe(systemd *dbus.Conn, filter func(string) bool, events chan<- UnitEvent) (<-chan error, error) {
+	err := systemd.Subscribe()
+	if err != nil {
+		return nil, RuntimeServiceError.Wrap(err, "cannot subscribe to systemd signals")
+	}
+	updates := make(chan *dbus.SubStateUpdate, 64)
+	errs := make(chan error, 1)
+	systemd.SetSubStateSubscriber(updates, errs)
+	go func() {
+		for u := range updates {
+			if filter(u.UnitName) {
+				events <- UnitEvent{u.UnitName, u.SubState}
+			}
+		}
+	}()
+	return errs, nil
+}
@@ -10,12 +10,15 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"text/template"
 	"yuri91/sloop/catatonit"
 	"yuri91/sloop/common"
 	"yuri91/sloop/cue"
 	"yuri91/sloop/image"
+	"yuri91/sloop/nft"
 
 	"github.com/coreos/go-systemd/v22/dbus"
 	"github.com/opencontainers/runtime-spec/specs-go"
@@ -29,13 +32,25 @@ func replaceLast(orig, old, new_ string) string {
 	}
 	return orig[:i] + new_ + orig[i+len(old):]
 }
-func getImagePath(from string) string {
+// GetImagePath returns the directory of the bundle of the image from
+func GetImagePath(from string) string {
 	from = replaceLast(from, ":", "-")
 	path := filepath.Join(common.ImagePath, from)
 	return path
 }
+// imageCachePath is where the metadata of images is read from when it
+// is not the image store, like when rendering for another root
+var imageCachePath string
+
+// readImageMetadata reads the OCI config of the bundle of an image
+func readImageMetadata(from string) (*specs.Spec, error) {
+	if imageCachePath != "" {
+		return image.ReadMetadata(filepath.Join(imageCachePath, replaceLast(from, ":", "-")))
+	}
+	return image.ReadMetadata(GetImagePath(from))
+}
 func getImageRootPath(from string) string {
-	path := filepath.Join(getImagePath(from), "rootfs")
+	path := filepath.Join(GetImagePath(from), "rootfs")
 	return path
 }
 
@@ -78,16 +93,48 @@ const hostsBaseStr string = `
 ::1		localhost.localdomain	localhost
 
 `
-func handleEtcHosts(hosts map[string]cue.Service, bridges map[string]cue.Bridge) error {
+// etcHosts returns the content of the /etc/hosts file of every service
+func etcHosts(hosts map[string]cue.Service, pods map[string]cue.Pod) map[string]string {
+	files := make(map[string]string)
 	bridgeHosts := make(map[string]string)
+	// services with a routed interface, or a static address on the LAN,
+	// are reachable from every service
+	lanHosts := ""
+	// the members of a pod share its addresses, and the pod itself can
+	// be reached by name too
+	nets := make(map[string]cue.Network)
 	for n,h := range hosts {
-		if !h.Net.Private {
+		if len(h.Instances) == 0 {
+			nets[n] = h.Net
 			continue
 		}
-		for _, i := range h.Net.Interfaces {
-			if i.Type == "bridge" {
+		for _, i := range h.Instances {
+			nets[cue.InstanceHost(n, i.Name)] = i.Net
+		}
+	}
+	for n,p := range pods {
+		nets[n] = p.Net
+	}
+	for n,net := range nets {
+		if !net.Private {
+			continue
+		}
+		for _, i := range net.Interfaces {
+			if i.Type != "bridge" {
+				if i.Ip != "" {
+					lanHosts += fmt.Sprintf("%s\t%s\n", i.Ip, n)
+				}
+				if i.Ip6 != "" {
+					lanHosts += fmt.Sprintf("%s\t%s\n", i.Ip6, n)
+				}
+				continue
+			}
+			if i.Bridge.Prefix != 0 {
 				bridgeHosts[i.Bridge.Name] += fmt.Sprintf("%s\t%s\n", i.Ip, n)
 			}
+			if i.Bridge.Prefix6 != 0 {
+				bridgeHosts[i.Bridge.Name] += fmt.Sprintf("%s\t%s\n", i.Ip6, n)
+			}
 		}
 	}
 	for n,h := range hosts {
@@ -103,6 +150,13 @@ func handleEtcHosts(hosts map[string]cue.Service, bridges map[string]cue.Bridge)
 				}
 			}
 		}
+		files[n] = hostsStr + lanHosts
+	}
+	return files
+}
+
+func handleEtcHosts(hosts map[string]cue.Service, pods map[string]cue.Pod) error {
+	for n, hostsStr := range etcHosts(hosts, pods) {
 		p := filepath.Join(common.ServicePath, n, "hosts")
 		err := os.WriteFile(p, []byte(hostsStr), 0666)
 		if err != nil {
@@ -113,14 +167,56 @@ func handleEtcHosts(hosts map[string]cue.Service, bridges map[string]cue.Bridge)
 }
 
 func handleVolume(v cue.Volume) error {
-	if v.Name[0] == '/' {
+	if v.Type != "named" {
+		return nil
+	}
+	return createVolumeDir(v, volumePath(v.Name))
+}
+
+// fileMode converts a mode in the octal notation of chmod
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	if mode & 01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	if mode & 02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode & 04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	return m
+}
+
+// createVolumeDir creates a directory of a volume. The owner and mode are
+// only set on creation, since services often change them on their own.
+func createVolumeDir(v cue.Volume, p string) error {
+	if _, err := os.Stat(p); err == nil {
 		return nil
 	}
-	p := filepath.Join(common.VolumePath, v.Name)
 	err := os.MkdirAll(p, 0777)
 	if err != nil {
 		return CreateVolumeError.Wrap(err, "cannot create volume directory %s", p)
 	}
+	if v.Mode != nil {
+		err = os.Chmod(p, fileMode(*v.Mode))
+		if err != nil {
+			return CreateVolumeError.Wrap(err, "cannot set mode of volume directory %s", p)
+		}
+	}
+	if v.Uid != nil || v.Gid != nil {
+		uid, gid := -1, -1
+		if v.Uid != nil {
+			uid = *v.Uid
+		}
+		if v.Gid != nil {
+			gid = *v.Gid
+		}
+		err = os.Chown(p, uid, gid)
+		if err != nil {
+			return CreateVolumeError.Wrap(err, "cannot set owner of volume directory %s", p)
+		}
+	}
 	return nil
 }
 
@@ -129,7 +225,7 @@ func handleImage(img string) error {
 	from := parts[0]
 	ver := parts[1]
 
-	p := getImagePath(img)
+	p := GetImagePath(img)
 
 	err := image.Fetch(from, ver, p)
 	if err != nil {
@@ -138,6 +234,27 @@ func handleImage(img string) error {
 
 	return nil
 }
+
+// handleBuild builds the image b, unless its bundle was built from the
+// same steps and base image. It returns the keys of the build, which
+// are kept in the build cache.
+func handleBuild(b cue.Build) ([]string, error) {
+	p := GetImagePath(b.Tag)
+	base, err := image.ResolveBase(common.BuildPath, b.From)
+	if err != nil {
+		return nil, CreateImageError.Wrap(err, "cannot build image %s", b.Tag)
+	}
+	keys := image.BuildKeys(b, base)
+	if image.BuiltKey(p) == keys[len(keys)-1] {
+		return keys, nil
+	}
+	fmt.Printf("Building image %s...\n", b.Tag)
+	err = image.Build(common.BuildPath, b, base, p)
+	if err != nil {
+		return nil, CreateImageError.Wrap(err, "cannot build image %s", b.Tag)
+	}
+	return keys, nil
+}
 const unitTemplateStr = `
 [Unit]
 Description= Sloop service {{.Name}}
@@ -149,6 +266,13 @@ Wants = {{$u}}
 {{ range $u := .Requires}}
 Requires = {{$u}}
 {{end}}
+{{- range $u := .BindsTo}}
+BindsTo = {{$u}}
+{{- end }}
+{{- range $u := .Sockets}}
+Requires = {{$u}}
+After = {{$u}}
+{{- end }}
 {{ range $u := .After}}
 After = {{$u}}
 {{end}}
@@ -165,30 +289,26 @@ NotifyAccess=all
 RestartForceExitStatus=133
 SuccessExitStatus=133
 {{- end }}
+{{- if and .Restart (ne .Restart "no") }}
+Restart = {{.Restart}}
+{{- end }}
 KillMode=mixed
 Delegate=yes
+{{- range $k, $v := .Credentials }}
+LoadCredentialEncrypted = {{$k}}:{{$v}}
+{{- end }}
 
-{{- if .Net.Private }}
-ExecStartPre = ip netns add sloop-{{.Name}}
-ExecStartPre = ip netns exec sloop-{{.Name}} ip link set lo up
-
-{{- range $n := .Net.Interfaces }}
-{{- with $ifname := printf "%s-%s" $.Name $n.Name | capStringLen 15 }}
-ExecStartPre = ip link add {{ $ifname }} type veth peer {{$n.Name}} netns sloop-{{$.Name}}
-ExecStartPre = ip link set dev {{ $ifname }} up
-ExecStartPre = ip link set dev {{ $ifname }} master {{$n.Bridge.Name}}
-ExecStartPre = ip netns exec sloop-{{$.Name}} ip link set {{$n.Name}} up
-ExecStartPre = ip netns exec sloop-{{$.Name}} ip addr add {{$n.Ip}}/{{$n.Bridge.Prefix}} dev {{$n.Name}}
-ExecStartPre = ip netns exec sloop-{{$.Name}} ip route add default via {{$n.Bridge.Ip}}
-
-ExecStopPost = -ip netns exec sloop-{{$.Name}} ip link delete {{$n.Name}}
+{{- if .Sockets }}
+Sockets ={{ range $u := .Sockets }} {{$u}}{{ end }}
 {{- end }}
+{{- if .Instanced }}
+EnvironmentFile = {{.ServicePath}}/instances/%i.env
 {{- end }}
-
-ExecStopPost = -ip netns delete sloop-{{.Name}}
+{{- if .Netns }}
+{{- template "netns" .Netns }}
 {{- end }}
 
-ExecStart = systemd-nspawn \
+ExecStart = {{ if .SecretEnv }}{{.UtilsPath}}/secretenv {{ range $k, $v := .SecretEnv }}{{$k}}={{$v}} {{ end }}-- {{ end }}systemd-nspawn \
 	--quiet \
 	--volatile=overlay \
 	--keep-unit \
@@ -197,13 +317,25 @@ ExecStart = systemd-nspawn \
 	--bind={{.UtilsPath}}/catatonit:/catatonit \
 	--kill-signal=SIGTERM \
 	--oci-bundle={{.ServicePath}} \
-	-M {{.Name}} \
+	-M {{.Machine}} \
 	--resolv-conf=bind-uplink \
 {{- if .Net.Private }}
-	--network-namespace-path=/var/run/netns/sloop-{{.Name}} \
+	--network-namespace-path=/var/run/netns/{{.NetnsName}} \
 {{- end }}
-{{- range $k, $v := .Binds }}
-	--bind={{$k}}:{{$v}} \
+{{- range $m := .Mounts }}
+	{{$m}} \
+{{- end }}
+{{- range $k, $v := .SecretFiles }}
+	--bind-ro=%d/{{$k}}:{{$v}} \
+{{- end }}
+{{- range $k, $v := .SecretEnv }}
+	--setenv={{$k}} \
+{{- end }}
+{{- range $k := .InstanceEnv }}
+	--setenv={{$k}} \
+{{- end }}
+{{- if .Sockets }}
+	--setenv=LISTEN_FDNAMES \
 {{- end }}
 {{- if eq .Type "notify" }}
 	--bind=/run/systemd/notify \
@@ -214,7 +346,7 @@ ExecStart = systemd-nspawn \
 	/catatonit -- {{.Start}}
 
 {{- if ne .Reload "" }}
-ExecReload = {{.UtilsPath}}/nsenter {{.Name}} {{.Reload}}
+ExecReload = {{.UtilsPath}}/nsenter {{.Unit}} {{.Reload}}
 {{- end }}
 
 {{- if eq .Type "notify" }}
@@ -238,13 +370,17 @@ Slice=sloop.slice
 Type = oneshot
 RemainAfterExit = true
 
-ExecStart = sysctl net.ipv4.ip_forward=1
 ExecStart = ip link add {{.Name}} type bridge
 ExecStart = ip link set {{.Name}} up
+{{- if .Prefix }}
+ExecStart = sysctl net.ipv4.ip_forward=1
 ExecStart = ip addr add {{.Ip}}/{{.Prefix}} dev {{.Name}}
-ExecStart = iptables -t nat -A POSTROUTING -s {{.Ip}}/{{.Prefix}} ! -o {{.Name}} -j MASQUERADE
+{{- end }}
+{{- if .Prefix6 }}
+ExecStart = {{.UtilsPath}}/forward6
+ExecStart = ip -6 addr add {{.Ip6}}/{{.Prefix6}} dev {{.Name}} nodad
+{{- end }}
 
-ExecStop = iptables -t nat -D POSTROUTING -s {{.Ip}}/{{.Prefix}} ! -o {{.Name}} -j MASQUERADE
 ExecStop = ip link delete {{.Name}}
 
 [Install]
@@ -263,6 +399,15 @@ OnCalendar = {{$cal}}
 {{- range $act := .OnActiveSec }}
 OnActiveSec = {{$act}}
 {{- end }}
+{{- range $boot := .OnBootSec }}
+OnBootSec = {{$boot}}
+{{- end }}
+{{- if .RandomizedDelaySec }}
+RandomizedDelaySec = {{.RandomizedDelaySec}}
+{{- end }}
+{{- if .AccuracySec }}
+AccuracySec = {{.AccuracySec}}
+{{- end }}
 Persistent = {{.Persistent}}
 
 [Install]
@@ -275,12 +420,21 @@ Description = Sloop timer unit {{.Name}}
 
 [Service]
 Type = oneshot
-{{- range $r := .Run }}
-{{- if eq $r.Action "start" }}
-ExecStart = systemctl start {{$r.Service}}
-{{- else if eq $r.Action "reload" }}
-ExecStart = systemctl reload {{$r.Service}}
-{{- end}}
+{{- if .Delegate }}
+Slice=sloop.slice
+Delegate=yes
+{{- end }}
+{{- range $k, $v := .Credentials }}
+LoadCredentialEncrypted = {{$k}}:{{$v}}
+{{- end }}
+{{- if .Freeze }}
+ExecStartPre = -{{.UtilsPath}}/freezer freeze {{.FreezeState}} {{ join .Freeze " " }}
+{{- end }}
+{{- range $e := .Exec }}
+ExecStart = {{$e}}
+{{- end }}
+{{- if .Freeze }}
+ExecStopPost = -{{.UtilsPath}}/freezer thaw {{.FreezeState}}
 {{- end }}
 
 [Install]
@@ -302,35 +456,68 @@ func capStringLen(length int, source string) string {
 	return prefix + b64[0:4]
 }
 
-var unitTemplate *template.Template = template.Must(template.New("unit").Funcs(template.FuncMap{"capStringLen": capStringLen,}).Parse(unitTemplateStr))
+var unitTemplate *template.Template = template.Must(template.Must(netnsTemplate.Clone()).New("unit").Parse(unitTemplateStr))
 var bridgeTemplate *template.Template = template.Must(template.New("bridge").Funcs(template.FuncMap{}).Parse(bridgeTemplateStr))
 var timerTemplate *template.Template = template.Must(template.New("timer").Funcs(template.FuncMap{}).Parse(timerTemplateStr))
-var timerServiceTemplate *template.Template = template.Must(template.New("timerService").Funcs(template.FuncMap{}).Parse(timerServiceTemplateStr))
+var timerServiceTemplate *template.Template = template.Must(template.New("timerService").Funcs(template.FuncMap{"join": strings.Join}).Parse(timerServiceTemplateStr))
 
 type UnitConf struct {
 	Name string
+	// Unit is the unit name without the .service suffix
+	Unit string
+	Machine string
+	// Instanced is true for the template units of replicated services
+	Instanced bool
+	// InstanceEnv are the variables of the instance passed to the container
+	InstanceEnv []string
+	// Sockets are the socket units that activate the service
+	Sockets []string
 	UtilsPath string
 	ServicePath string
-	Binds map[string]string
+	// Mounts are the options that mount the volumes and files
+	Mounts []string
+	// Credentials maps credential names to their encrypted files
+	Credentials map[string]string
+	// SecretFiles maps credential names to paths in the container
+	SecretFiles map[string]string
+	// SecretEnv maps environment variables to credential names
+	SecretEnv map[string]string
 	Capabilities string
 	Start string
 	Reload string
 	Host string
 	Type string
+	Restart string
 	Enable bool
 	Net cue.Network
+	// Netns is nil if the service does not own its network namespace
+	Netns *NetnsConf
+	NetnsName string
 	Wants []string
 	Requires []string
+	BindsTo []string
 	After []string
 }
 
-func handleBridge(systemd *dbus.Conn, b cue.Bridge) (bool, error) {
+type BridgeConf struct {
+	cue.Bridge
+	UtilsPath string
+}
+
+func renderBridge(b cue.Bridge) (string, error) {
 	var buf bytes.Buffer
-	err := bridgeTemplate.Execute(&buf, b)
+	err := bridgeTemplate.Execute(&buf, BridgeConf{b, common.UtilsPath})
 	if err != nil {
-		return false, CreateServiceError.Wrap(err, "failed to execute template for bridge %s", b.Name)
+		return "", CreateServiceError.Wrap(err, "failed to execute template for bridge %s", b.Name)
+	}
+	return buf.String(), nil
+}
+
+func handleBridge(systemd *dbus.Conn, b cue.Bridge) (bool, error) {
+	unitStr, err := renderBridge(b)
+	if err != nil {
+		return false, err
 	}
-	unitStr := buf.String()
 
 	unitName := "sloop-bridge-" + b.Name + ".service"
 
@@ -341,7 +528,53 @@ func handleBridge(systemd *dbus.Conn, b cue.Bridge) (bool, error) {
 	return changed, nil
 }
 
-func handleServiceFiles(systemd *dbus.Conn, s cue.Service) (bool, error) {
+// serviceChange is what must be done to a service for its new files
+type serviceChange int
+
+const (
+	serviceUnchanged serviceChange = iota
+	// only the content of files changed, they are written in place
+	serviceReload
+	// the container changed, it is created again
+	serviceRestart
+	// the service is new
+	serviceCreate
+)
+
+// classifyChange tells what the change of the configuration of a service
+// from oldConf, as written in conf.cue, to newConf needs. Changes to the
+// content and the permissions of the files need a reload. Anything else,
+// like the environment, the image, the network, the commands or the paths
+// of the files, needs a restart.
+func classifyChange(oldConf []byte, newConf []byte, s cue.Service) serviceChange {
+	if oldConf == nil {
+		return serviceCreate
+	}
+	if bytes.Equal(oldConf, newConf) {
+		return serviceUnchanged
+	}
+	var old cue.Service
+	if err := json.Unmarshal(oldConf, &old); err != nil {
+		return serviceRestart
+	}
+	oldPaths := lo.Keys(old.Image.Files)
+	newPaths := lo.Keys(s.Image.Files)
+	sort.Strings(oldPaths)
+	sort.Strings(newPaths)
+	if !reflect.DeepEqual(oldPaths, newPaths) {
+		return serviceRestart
+	}
+	old.Image.Files = nil
+	s.Image.Files = nil
+	oldRest, err1 := json.Marshal(old)
+	newRest, err2 := json.Marshal(s)
+	if err1 != nil || err2 != nil || !bytes.Equal(oldRest, newRest) {
+		return serviceRestart
+	}
+	return serviceReload
+}
+
+func handleServiceFiles(systemd *dbus.Conn, config cue.Config, s cue.Service) (serviceChange, error) {
 
 	p := filepath.Join(common.ServicePath, s.Name)
 	confP := filepath.Join(p, "conf.cue")
@@ -350,41 +583,135 @@ func handleServiceFiles(systemd *dbus.Conn, s cue.Service) (bool, error) {
 
 	newConf, err := json.MarshalIndent(s, "", "\t")
 	if err != nil {
-		return false, CreateServiceError.Wrap(err, "cannot marshal config %s", string(newConf))
+		return serviceUnchanged, CreateServiceError.Wrap(err, "cannot marshal config %s", string(newConf))
 	}
-	if bytes.Compare(oldConf,newConf) == 0 {
-		return false, nil
+	hashed, err := renderFiles(config, s, secretsHashed)
+	if err != nil {
+		return serviceUnchanged, err
+	}
+	change := classifyChange(oldConf, newConf, s)
+	// the templates depend on more than the service
+	if t := templatesChange(s, hashed, p); change <= serviceReload && t > change {
+		change = t
+	}
+	if change == serviceUnchanged {
+		return serviceUnchanged, nil
+	}
+	files, err := renderFiles(config, s, secretsDecrypted)
+	if err != nil {
+		return serviceUnchanged, err
+	}
+	switch change {
+	case serviceReload:
+		err = writeFiles(s, files, p)
+		if err != nil {
+			return serviceUnchanged, err
+		}
+		err = writeTemplateSums(s, hashed, p)
+		if err != nil {
+			return serviceUnchanged, err
+		}
+		err = os.WriteFile(confP, newConf, 0666)
+		if err != nil {
+			return serviceUnchanged, CreateServiceError.Wrap(err, "cannot update conf for service %s", s.Name)
+		}
+		return serviceReload, nil
 	}
 
-	err = stopUnit(systemd, s.Name + ".service")
+	err = stopService(systemd, s)
 	if err != nil {
-		return false, err
+		return serviceUnchanged, err
 	}
 
 	err = os.RemoveAll(p)
 	if err != nil {
-		return false, CreateServiceError.Wrap(err, "cannot remove service %s files", s.Name)
+		return serviceUnchanged, CreateServiceError.Wrap(err, "cannot remove service %s files", s.Name)
 	}
 
 	err = os.MkdirAll(filepath.Join(p, "files"), 700)
 	if err != nil {
-		return false, CreateServiceError.Wrap(err, "cannot create service %s directory", s.Name)
+		return serviceUnchanged, CreateServiceError.Wrap(err, "cannot create service %s directory", s.Name)
+	}
+
+	err = handleSecrets(s, p)
+	if err != nil {
+		return serviceUnchanged, err
+	}
+
+	err = handleFileCredentials(s, files, p)
+	if err != nil {
+		return serviceUnchanged, err
 	}
 
+	err = handleInstanceVolumes(s)
+	if err != nil {
+		return serviceUnchanged, err
+	}
+
+	err = writeServiceFiles(s, files, p)
+	if err != nil {
+		return serviceUnchanged, err
+	}
+
+	err = writeTemplateSums(s, hashed, p)
+	if err != nil {
+		return serviceUnchanged, err
+	}
+
+	err = os.WriteFile(confP, newConf, 0666)
+	if err != nil {
+		return serviceUnchanged, CreateImageError.Wrap(err, "cannot create conf for service %s", s.Name)
+	}
+
+	return change, nil
+}
+
+// writeFiles writes the files of a service in the files tree of p, with
+// the content in files. Existing files are truncated rather than replaced,
+// so that the bind mounts of a running service see the new content.
+// Files with secrets are credentials, they are not in the tree.
+func writeFiles(s cue.Service, files map[string]renderedFile, p string) error {
 	for path, file := range s.Image.Files {
 		fullP := filepath.Join(p, "files", path)
+		if usesSecret(file) {
+			// written in clear by older versions
+			os.Remove(fullP)
+			continue
+		}
 		if err := os.MkdirAll(filepath.Dir(fullP), 0777); err != nil {
-			return false, err
+			return err
 		}
-		err := os.WriteFile(fullP, []byte(file.Content), fs.FileMode(file.Permissions))
+		perm := fs.FileMode(file.Permissions)
+		err := os.WriteFile(fullP, []byte(files[path].Content), perm)
 		if err != nil {
-			return false, CreateServiceError.Wrap(err, "cannot add file %s to service %s", path, s.Name)
+			return CreateServiceError.Wrap(err, "cannot add file %s to service %s", path, s.Name)
 		}
+		// WriteFile only sets the permissions of new files, minus the umask
+		err = os.Chmod(fullP, perm)
+		if err != nil {
+			return CreateServiceError.Wrap(err, "cannot set permissions of file %s of service %s", path, s.Name)
+		}
+	}
+	return nil
+}
+
+// writeServiceFiles writes the files of a service in p: the environment
+// of its instances, the files tree with the content in files and the OCI
+// config
+func writeServiceFiles(s cue.Service, files map[string]renderedFile, p string) error {
+	err := handleInstances(s, p)
+	if err != nil {
+		return err
 	}
 
-	meta, err := image.ReadMetadata(getImagePath(s.Image.From))
+	err = writeFiles(s, files, p)
 	if err != nil {
-		return false, err
+		return err
+	}
+
+	meta, err := readImageMetadata(s.Image.From)
+	if err != nil {
+		return err
 	}
 	for k,v := range s.Image.Env {
 		meta.Process.Env = append(meta.Process.Env, strings.Join([]string{k,v}, "="))
@@ -402,43 +729,99 @@ func handleServiceFiles(systemd *dbus.Conn, s cue.Service) (bool, error) {
 
 	metaB, err := json.MarshalIndent(meta, "", "\t")
 	if err != nil {
-		return false, CreateImageError.Wrap(err, "cannot marshal OCI config for service %s", s.Name)
+		return CreateImageError.Wrap(err, "cannot marshal OCI config for service %s", s.Name)
 	}
 	err = os.WriteFile(filepath.Join(p, "config.json"), metaB, 0666)
 	if err != nil {
-		return false, CreateImageError.Wrap(err, "cannot add OCI config file to service %s", s.Name)
+		return CreateImageError.Wrap(err, "cannot add OCI config file to service %s", s.Name)
 	}
+	return nil
+}
 
-	err = os.WriteFile(confP, newConf, 0666)
-	if err != nil {
-		return false, CreateImageError.Wrap(err, "cannot create conf for service %s", s.Name)
+func volumePath(name string) string {
+	if name[0] != '/' {
+		return filepath.Join(common.VolumePath, name)
 	}
+	return name
+}
 
-	return true, nil
+// volumeMount returns the systemd-nspawn option that mounts a volume
+func volumeMount(s cue.Service, v cue.VolumeMapping) string {
+	if v.Type == "tmpfs" {
+		var opts []string
+		if v.Mode != nil {
+			opts = append(opts, fmt.Sprintf("mode=%o", *v.Mode))
+		}
+		if v.Uid != nil {
+			opts = append(opts, fmt.Sprintf("uid=%d", *v.Uid))
+		}
+		if v.Gid != nil {
+			opts = append(opts, fmt.Sprintf("gid=%d", *v.Gid))
+		}
+		if v.Size != "" {
+			opts = append(opts, "size=" + v.Size)
+		}
+		if len(opts) == 0 {
+			return "--tmpfs=" + v.Dest
+		}
+		return "--tmpfs=" + v.Dest + ":" + strings.Join(opts, ",")
+	}
+	n := volumePath(v.Name)
+	if len(s.Instances) > 0 && v.PerInstance {
+		n = filepath.Join(n, "%i")
+	}
+	opt := "--bind="
+	if v.ReadOnly {
+		opt = "--bind-ro="
+	}
+	var opts []string
+	if !v.Recursive {
+		opts = append(opts, "norbind")
+	}
+	if v.Idmap {
+		opts = append(opts, "idmap")
+	}
+	if len(opts) == 0 {
+		return opt + n + ":" + v.Dest
+	}
+	return opt + n + ":" + v.Dest + ":" + strings.Join(opts, ",")
 }
 
-func handleService(systemd *dbus.Conn, s cue.Service) (bool, error) {
-	serviceDir := filepath.Join(common.ServicePath, s.Name)
-	bindsMap := make(map[string]string)
+// serviceMounts returns the systemd-nspawn options that mount the
+// volumes and files of a service in the container, sorted by their
+// destination so that nested mounts come after their parent
+func serviceMounts(s cue.Service) []string {
+	mounts := make(map[string]string)
 	for _,v := range s.Image.Volumes {
-		var n string
-		if v.Name[0] != '/' {
-			n = filepath.Join(common.VolumePath, v.Name)
-		} else {
-			n = v.Name
-		}
-		bindsMap[n] = v.Dest
+		mounts[v.Dest] = volumeMount(s, v)
 	}
-	for path := range s.Image.Files {
+	for path, f := range s.Image.Files {
+		if usesSecret(f) {
+			mounts[path] = "--bind-ro=%d/" + fileCredentialName(s.Name, path) + ":" + path
+			continue
+		}
 		fullP := filepath.Join(common.ServicePath, s.Name, "files", path)
-		bindsMap[fullP] = path
+		mounts[path] = "--bind=" + fullP + ":" + path
+	}
+	dests := lo.Keys(mounts)
+	sort.Strings(dests)
+	return lo.Map(dests, func(d string, _ int) string {
+		return mounts[d]
+	})
+}
+
+func renderService(s cue.Service) (string, error) {
+	serviceDir := filepath.Join(common.ServicePath, s.Name)
+	instanced := len(s.Instances) > 0
+	if instanced && len(s.Sockets) > 0 {
+		return "", CreateServiceError.New("service %s is replicated, it cannot have sockets", s.Name)
 	}
 
 	startVec := s.Exec.Start
 	if len(startVec) == 0 {
-		meta, err := image.ReadMetadata(getImagePath(s.Image.From))
+		meta, err := readImageMetadata(s.Image.From)
 		if err != nil {
-			return false, CreateServiceError.Wrap(err, "failed to get metadata for image %s for service %s", s.Image.From, s.Name)
+			return "", CreateServiceError.Wrap(err, "failed to get metadata for image %s for service %s", s.Image.From, s.Name)
 		}
 		startVec = meta.Process.Args
 	}
@@ -450,7 +833,34 @@ func handleService(systemd *dbus.Conn, s cue.Service) (bool, error) {
 	for _,c := range s.Exec.Reload {
 		reloadStr += fmt.Sprintf("%q ", c)
 	}
-	if s.Net.Private {
+	unit := s.Name
+	machine := s.Name
+	var instanceEnv []string
+	if instanced {
+		unit = s.Name + "@%i"
+		machine = s.Name + "-%i"
+		instanceEnv = instanceEnvKeys(s)
+	}
+	var netns *NetnsConf
+	var bindsTo []string
+	netnsName := "sloop-" + s.Name
+	if s.Pod != "" {
+		netnsName = podNetns(s.Pod)
+		bindsTo = append(bindsTo, podUnit(s.Pod))
+		s.After = append(s.After, podUnit(s.Pod))
+	} else if s.Net.Private {
+		if instanced {
+			netns = instanceNetns(s)
+			netnsName = netns.Name
+		} else {
+			netns = &NetnsConf{
+				Name: netnsName,
+				HostIfnames: hostIfnames(s.Name, s.Net.Interfaces),
+				Exec: "ExecStartPre",
+				UtilsPath: common.UtilsPath,
+				Interfaces: s.Net.Interfaces,
+			}
+		}
 		for _, i := range s.Net.Interfaces {
 			if i.Type == "bridge" {
 				s.Requires = append(s.Requires, "sloop-bridge-" + i.Bridge.Name + ".service")
@@ -458,55 +868,150 @@ func handleService(systemd *dbus.Conn, s cue.Service) (bool, error) {
 			}
 		}
 	}
+	credentials := make(map[string]string)
+	secretFiles := make(map[string]string)
+	secretEnv := make(map[string]string)
+	for n, sec := range s.Image.Secrets {
+		cred := credentialName(n)
+		credentials[cred] = credentialPath(serviceDir, n)
+		if sec.File != "" {
+			secretFiles[cred] = sec.File
+		}
+		if sec.Env != "" {
+			secretEnv[sec.Env] = cred
+		}
+	}
+	for k, v := range fileCredentials(s, serviceDir) {
+		credentials[k] = v
+	}
 	var buf bytes.Buffer
 	conf := UnitConf {
 		Name: s.Name,
+		Unit: unit,
+		Machine: machine,
+		Instanced: instanced,
+		InstanceEnv: instanceEnv,
+		Sockets: socketUnits(s),
 		UtilsPath: common.UtilsPath,
 		ServicePath: serviceDir,
-		Binds: bindsMap,
+		Mounts: serviceMounts(s),
+		Credentials: credentials,
+		SecretFiles: secretFiles,
+		SecretEnv: secretEnv,
 		Capabilities: strings.Join(s.Capabilities, ","),
 		Start: startStr,
 		Reload: reloadStr,
 		Net: s.Net,
+		Netns: netns,
+		NetnsName: netnsName,
 		Type: s.Type,
-		Enable: s.Enable,
+		Restart: s.Restart,
+		// Socket activated services are started by their sockets
+		Enable: s.Enable && len(s.Sockets) == 0,
 		Wants: s.Wants,
 		Requires: s.Requires,
+		BindsTo: bindsTo,
 		After: s.After,
 	}
 	err := unitTemplate.Execute(&buf, conf)
 	if err != nil {
-		return false, CreateServiceError.Wrap(err, "failed to execute template for service %s", s.Name)
+		return "", CreateServiceError.Wrap(err, "failed to execute template for service %s", s.Name)
+	}
+	return buf.String(), nil
+}
+
+func handleService(systemd *dbus.Conn, s cue.Service) (bool, error) {
+	unitStr, err := renderService(s)
+	if err != nil {
+		return false, err
+	}
+
+	if len(s.Instances) > 0 {
+		// Templates cannot be enabled, only their instances
+		changed, err := writeLinkUnit(systemd, s.UnitFile(), unitStr, false)
+		if err != nil {
+			return false, err
+		}
+		return changed, enableInstances(systemd, s)
 	}
-	unitStr := buf.String()
 
-	changed, err := writeLinkUnit(systemd, s.Name+".service", unitStr, s.Enable)
+	changed, err := writeLinkUnit(systemd, s.UnitFile(), unitStr, s.Enable && len(s.Sockets) == 0)
 	if err != nil {
 		return false, err;
 	}
 
-	return changed, nil
+	socketsChanged, err := handleSockets(systemd, s)
+	if err != nil {
+		return false, err
+	}
+
+	return changed || socketsChanged, nil
 }
 
-func handleTimer(systemd *dbus.Conn, t cue.Timer) (bool, error) {
-	var buf bytes.Buffer
-	err := timerTemplate.Execute(&buf, t)
+// reloadService reloads the running units of a service with its
+// exec.reload, or restarts them if it has none
+func reloadService(systemd *dbus.Conn, s cue.Service) error {
+	for _, u := range s.Units() {
+		wait := make(chan string)
+		_, err := systemd.ReloadOrTryRestartUnitContext(context.Background(), u, "replace", wait)
+		if err != nil {
+			return RuntimeServiceError.Wrap(err, "cannot reload unit %s", u)
+		}
+		if len(s.Exec.Reload) > 0 {
+			fmt.Printf("reloading %s...\n", u)
+		} else {
+			fmt.Printf("restarting %s...\n", u)
+		}
+		res := <- wait
+		if res != "done" {
+			return RuntimeServiceError.New("cannot reload unit %s", u)
+		}
+		fmt.Printf("done\n")
+	}
+	return nil
+}
+
+// stopService stops all the units of a service
+func stopService(systemd *dbus.Conn, s cue.Service) error {
+	for _, u := range s.Units() {
+		err := stopUnit(systemd, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderTimer(t cue.Timer, services map[string]cue.Service) (string, string, error) {
+	var timerBuf bytes.Buffer
+	err := timerTemplate.Execute(&timerBuf, t)
+	if err != nil {
+		return "", "", CreateServiceError.Wrap(err, "failed to execute template for timer %s", t.Name)
+	}
+	conf, err := timerServiceConf(t, services)
 	if err != nil {
-		return false, CreateServiceError.Wrap(err, "failed to execute template for timer %s", t.Name)
+		return "", "", err
 	}
-	timerStr := buf.String()
-	err = timerServiceTemplate.Execute(&buf, t)
+	var serviceBuf bytes.Buffer
+	err = timerServiceTemplate.Execute(&serviceBuf, conf)
 	if err != nil {
-		return false, CreateServiceError.Wrap(err, "failed to execute template for timer service %s", t.Name)
+		return "", "", CreateServiceError.Wrap(err, "failed to execute template for timer service %s", t.Name)
+	}
+	return timerBuf.String(), serviceBuf.String(), nil
+}
+
+func handleTimer(systemd *dbus.Conn, t cue.Timer, services map[string]cue.Service) (bool, error) {
+	timerStr, timerServiceStr, err := renderTimer(t, services)
+	if err != nil {
+		return false, err
 	}
-	timerServiceStr := buf.String()
 
 	timerP := filepath.Join(common.UnitPath, t.Name + ".timer")
 	serviceP := filepath.Join(common.UnitPath, t.Name + ".service")
 
 	oldTimer, _ := os.ReadFile(timerP)
 	oldService, _ := os.ReadFile(serviceP)
-	if timerServiceStr == string(oldTimer) && timerStr == string(oldService) {
+	if timerStr == string(oldTimer) && timerServiceStr == string(oldService) {
 		return false, nil
 	}
 
@@ -612,6 +1117,30 @@ func stopUnit(systemd *dbus.Conn, name string) error {
 	return nil
 }
 func stopDisableDeleteUnit(systemd *dbus.Conn, name string) error {
+	if isTemplate(name) {
+		instances, err := templateInstances(systemd, name)
+		if err != nil {
+			return err
+		}
+		for _, i := range instances {
+			err = stopDisableUnit(systemd, i)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := stopDisableUnit(systemd, name)
+	if err != nil {
+		return err
+	}
+	// Remove unit file
+	err = os.RemoveAll(filepath.Join(common.UnitPath, name))
+	if err != nil {
+		return  RemoveUnitError.Wrap(err, "cannot remove unit %s", name) 
+	}
+	return nil
+}
+func stopDisableUnit(systemd *dbus.Conn, name string) error {
 	fmt.Printf("Stopping and disabling %s...\n", name)
 	statuses, err := systemd.ListUnitsByNamesContext(context.Background(), []string{name})
 	if err != nil {
@@ -637,11 +1166,6 @@ func stopDisableDeleteUnit(systemd *dbus.Conn, name string) error {
 		}
 		fmt.Printf("\t\tdone\n")
 	}
-	// Remove unit file
-	err = os.RemoveAll(filepath.Join(common.UnitPath, name))
-	if err != nil {
-		return  RemoveUnitError.Wrap(err, "cannot remove unit %s", name) 
-	}
 	return nil
 }
 
@@ -653,6 +1177,22 @@ func gatherImages(services map[string]cue.Service) []string {
 	return lo.Keys(imgMap)
 }
 
+// gatherBuilds returns the builds of the images of services, by tag
+func gatherBuilds(services map[string]cue.Service) (map[string]cue.Build, error) {
+	builds := map[string]cue.Build{}
+	for _, s := range services {
+		b := s.Image.Build
+		if b == nil {
+			continue
+		}
+		if other, ok := builds[b.Tag]; ok && !reflect.DeepEqual(other, *b) {
+			return nil, CreateImageError.New("image %s is built with different steps by service %s and another service", b.Tag, s.Name)
+		}
+		builds[b.Tag] = *b
+	}
+	return builds, nil
+}
+
 func getCurImages() ([]string, error) {
 	var curImages []string
 	err := filepath.WalkDir(common.ImagePath, func(path string, info fs.DirEntry, err error) error {
@@ -687,7 +1227,89 @@ func getCurUnits() ([]string, error) {
 	return curUnits, nil
 }
 
-func Create(config cue.Config) error {
+// ConfigUnits returns the names of all the units generated from config
+func ConfigUnits(config cue.Config) []string {
+	configUnits := []string{"sloop.target", "sloop.slice"}
+	configUnits = append(configUnits, lo.MapToSlice(config.Services, func (_ string, s cue.Service) string {
+		return s.UnitFile()
+	})...)
+	for _, s := range config.Services {
+		configUnits = append(configUnits, socketUnits(s)...)
+	}
+	configUnits = append(configUnits, lo.Map(lo.Keys(config.Timers), func (s string, _ int) string {
+		return s+".timer"
+	})...)
+	configUnits = append(configUnits, lo.Map(lo.Keys(config.Timers), func (s string, _ int) string {
+		return s+".service"
+	})...)
+	configUnits = append(configUnits, lo.Map(lo.Keys(config.Bridges), func (s string, _ int) string {
+		return "sloop-bridge-"+s+".service"
+	})...)
+	configUnits = append(configUnits, lo.Map(lo.Keys(config.Pods), func (s string, _ int) string {
+		return podUnit(s)
+	})...)
+	return configUnits
+}
+
+// Connect opens a connection to the systemd D-Bus API
+func Connect() (*dbus.Conn, error) {
+	systemd, err := dbus.NewSystemConnectionContext(context.Background())
+	if err != nil {
+		return nil, RuntimeServiceError.Wrap(err, "cannot connect to systemd dbus")
+	}
+	return systemd, nil
+}
+
+func Create(config cue.Config) (*Changes, error) {
+	systemd, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer systemd.Close()
+	return Apply(systemd, config)
+}
+
+// CreateServices is like Create, but only the services in names are
+// updated, with the ones that have templates, since their files may
+// depend on the other services. Everything else is applied as usual.
+func CreateServices(config cue.Config, names []string) (*Changes, error) {
+	systemd, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer systemd.Close()
+	return applyChanges(systemd, config, lo.SliceToMap(names, func(n string) (string, bool) {
+		return n, true
+	}))
+}
+
+// Changes are the running services that Apply restarted, because their
+// container changed, or reloaded, because only their files changed
+type Changes struct {
+	Restarted []string `json:"restarted"`
+	Reloaded []string `json:"reloaded"`
+}
+
+// Apply makes the state of the system match config, using an existing
+// connection to systemd
+func Apply(systemd *dbus.Conn, config cue.Config) (*Changes, error) {
+	return applyChanges(systemd, config, nil)
+}
+
+// applyChanges applies config, updating only the services in only, if
+// it is not nil
+func applyChanges(systemd *dbus.Conn, config cue.Config, only map[string]bool) (*Changes, error) {
+	changes := &Changes{}
+	err := apply(systemd, config, changes, only)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(changes.Restarted)
+	sort.Strings(changes.Reloaded)
+	return changes, nil
+}
+
+func apply(systemd *dbus.Conn, config cue.Config, changes *Changes, only map[string]bool) error {
 	err := os.MkdirAll(common.VolumePath, 0700)
 	if err != nil {
 		return  FilesystemError.Wrap(err, "cannot create volumes directory") 
@@ -711,24 +1333,7 @@ func Create(config cue.Config) error {
 
 	reload := false
 
-	systemd, err := dbus.NewSystemConnectionContext(context.Background())
-	if err != nil {
-		return  RuntimeServiceError.Wrap(err, "cannot connect to systemd dbus") 
-	}
-
-	configUnits := []string{"sloop.target", "sloop.slice"}
-	configUnits = append(configUnits, lo.Map(lo.Keys(config.Services), func (s string, _ int) string {
-		return s+".service"
-	})...)
-	configUnits = append(configUnits, lo.Map(lo.Keys(config.Timers), func (s string, _ int) string {
-		return s+".timer"
-	})...)
-	configUnits = append(configUnits, lo.Map(lo.Keys(config.Timers), func (s string, _ int) string {
-		return s+".service"
-	})...)
-	configUnits = append(configUnits, lo.Map(lo.Keys(config.Bridges), func (s string, _ int) string {
-		return "sloop-bridge-"+s+".service"
-	})...)
+	configUnits := ConfigUnits(config)
 	curImages, err := getCurImages();
 	if err != nil {
 		return err
@@ -757,6 +1362,31 @@ func Create(config cue.Config) error {
 		return err
 	}
 
+	err = handleSecretEnv()
+	if err != nil {
+		return err
+	}
+
+	err = handleDhcp()
+	if err != nil {
+		return err
+	}
+
+	err = handleForward6()
+	if err != nil {
+		return err
+	}
+
+	err = handleFreezer()
+	if err != nil {
+		return err
+	}
+
+	err = handleWithNetns()
+	if err != nil {
+		return err
+	}
+
 	changed, err := handleSlice(systemd)
 	if err != nil {
 		return err
@@ -788,6 +1418,27 @@ func Create(config cue.Config) error {
 		}
 	}
 
+	err = nft.Reconcile(config)
+	if err != nil {
+		return err
+	}
+
+	for n, p := range config.Pods {
+		changed, err := handlePod(systemd, p)
+		if err != nil {
+			return err
+		}
+		if changed {
+			// Stopping the pod also stops its members, since they are
+			// bound to it
+			err = stopUnit(systemd, podUnit(n))
+			if err != nil {
+				return err
+			}
+			reload = true
+		}
+	}
+
 	for _, v := range config.Volumes {
 		err := handleVolume(v)
 		if err != nil {
@@ -796,13 +1447,35 @@ func Create(config cue.Config) error {
 	}
 
 	images := gatherImages(config.Services)
+	builds, err := gatherBuilds(config.Services)
+	if err != nil {
+		return err
+	}
 	imagesToRemove, imagesToAdd := lo.Difference(curImages, images)
 	for _,i := range imagesToAdd {
+		if _, ok := builds[i]; ok {
+			continue
+		}
 		err := handleImage(i)
 		if err != nil {
 			return err
 		}
 	}
+	tags := lo.Keys(builds)
+	sort.Strings(tags)
+	var buildKeys []string
+	for _, t := range tags {
+		keys, err := handleBuild(builds[t])
+		if err != nil {
+			return err
+		}
+		buildKeys = append(buildKeys, keys...)
+	}
+	// the steps of builds that changed, or were removed
+	err = image.GC(common.BuildPath, buildKeys)
+	if err != nil {
+		return err
+	}
 	for _, ci := range imagesToRemove {
 		err = os.RemoveAll(filepath.Join(common.ImagePath, ci))
 		if err != nil {
@@ -810,26 +1483,45 @@ func Create(config cue.Config) error {
 		}
 	}
 
-	for n, s := range config.Services {
-		changed, err := handleServiceFiles(systemd, s)
+	for _, s := range config.Services {
+		if only != nil && !only[s.Name] && !hasTemplates(s) {
+			continue
+		}
+		change, err := handleServiceFiles(systemd, config, s)
 		if err != nil {
 			return err
 		}
+		changed := change == serviceRestart || change == serviceCreate
 		changed2, err := handleService(systemd, s)
 		if err != nil {
 			return err
 		}
 		if changed2 && !changed {
-			err = stopUnit(systemd, n+".service")
+			err = stopService(systemd, s)
+			if err != nil {
+				return err
+			}
+		}
+		if change == serviceReload && !changed2 {
+			err = reloadService(systemd, s)
 			if err != nil {
 				return err
 			}
 		}
+		// jobs are not running, and new services are only started
+		if !s.Job && change != serviceCreate {
+			// without exec.reload, reloadService restarts the service
+			if changed || changed2 || (change == serviceReload && len(s.Exec.Reload) == 0) {
+				changes.Restarted = append(changes.Restarted, s.Name)
+			} else if change == serviceReload {
+				changes.Reloaded = append(changes.Reloaded, s.Name)
+			}
+		}
 		reload = reload || changed || changed2
 	}
 
 	for n, t := range config.Timers {
-		changed, err := handleTimer(systemd, t)
+		changed, err := handleTimer(systemd, t, config.Services)
 		if err != nil {
 			return err
 		}
@@ -846,7 +1538,7 @@ func Create(config cue.Config) error {
 		}
 	}
 
-	err = handleEtcHosts(config.Services, config.Bridges)
+	err = handleEtcHosts(config.Services, config.Pods)
 	if err != nil {
 		return err
 	}
@@ -870,12 +1562,17 @@ func Purge(images bool) error {
 		if err != nil {
 			return RemoveImageError.Wrap(err, "cannot remove image directory")
 		}
+		err = os.RemoveAll(common.BuildPath)
+		if err != nil {
+			return RemoveImageError.Wrap(err, "cannot remove build cache")
+		}
 	}
 
-	systemd, err := dbus.NewSystemConnectionContext(context.Background())
+	systemd, err := Connect()
 	if err != nil {
-		return  RuntimeServiceError.Wrap(err, "cannot connect to systemd dbus") 
+		return err
 	}
+	defer systemd.Close()
 
 	curUnits, err := os.ReadDir(common.UnitPath)
 	if err == nil {
@@ -896,6 +1593,11 @@ func Purge(images bool) error {
 		return RemoveUnitError.Wrap(err, "cannot remove service directory")
 	}
 
+	err = nft.Flush()
+	if err != nil {
+		return err
+	}
+
 	systemd.ReloadContext(context.Background())
 
 	return nil
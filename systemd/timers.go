@@ -0,0 +1,215 @@
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+)
+
+type TimerServiceConf struct {
+	Name string
+	Exec []string
+	// Delegate is needed by the ephemeral containers, which run in the
+	// cgroup of the timer unit
+	Delegate bool
+	// Freeze are the units frozen while the commands run
+	Freeze []string
+	// FreezeState lists the units the timer froze, which are the only
+	// ones it thaws
+	FreezeState string
+	UtilsPath string
+	// Credentials are the files with secrets of the services run in
+	// ephemeral containers
+	Credentials map[string]string
+}
+
+// freezerStr freezes the units of a timer with the cgroup freezer, like
+// "sloop pause". Units that are not running, or that are already frozen,
+// are skipped: they are not in the state file, so the thaw after the
+// commands of the timer does not resume services paused by the user.
+const freezerStr string = `#!/bin/sh
+action=$1
+state=$2
+shift 2
+wait_frozen() {
+	i=0
+	while ! grep -qx "frozen $2" "$1/cgroup.events"; do
+		i=$((i+1))
+		if [ $i -gt 100 ]; then
+			echo "timeout waiting for $1" >&2
+			return 1
+		fi
+		sleep 0.1
+	done
+}
+case "$action" in
+freeze)
+	mkdir -p "$(dirname "$state")"
+	: > "$state"
+	for u in "$@"; do
+		cg=/sys/fs/cgroup/sloop.slice/$u
+		[ -f "$cg/cgroup.freeze" ] || continue
+		grep -qx "frozen 1" "$cg/cgroup.events" && continue
+		echo "$u" >> "$state"
+		echo 1 > "$cg/cgroup.freeze"
+		wait_frozen "$cg" 1 || exit 1
+	done
+	;;
+thaw)
+	[ -f "$state" ] || exit 0
+	while read -r u; do
+		cg=/sys/fs/cgroup/sloop.slice/$u
+		[ -f "$cg/cgroup.freeze" ] && echo 0 > "$cg/cgroup.freeze"
+	done < "$state"
+	rm -f "$state"
+	;;
+esac
+`
+func handleFreezer() error {
+	p := filepath.Join(common.UtilsPath, "freezer")
+	oldScript, _ := os.ReadFile(p)
+	if bytes.Equal(oldScript, []byte(freezerStr)) {
+		return nil
+	}
+	err := os.WriteFile(p, []byte(freezerStr), 0777)
+	if err != nil {
+		return CreateImageError.Wrap(err, "failed to write freezer script")
+	}
+	return nil
+}
+
+// quoteArgs quotes the arguments of a command of a timer, which are
+// passed as they are written: a shell, like sh -c, is needed for
+// variables and command substitutions
+func quoteArgs(args []string) string {
+	str := ""
+	for _, a := range args {
+		str += quoteLiteral(a) + " "
+	}
+	return str
+}
+
+// quoteLiteral quotes an argument of a command line of a unit that is
+// taken as it is, like a path: specifiers and variables are escaped
+func quoteLiteral(arg string) string {
+	return strings.NewReplacer("%", "%%", "$", "$$").Replace(fmt.Sprintf("%q", arg))
+}
+
+// withNetnsStr runs systemd-nspawn in the network namespace of a service,
+// which only exists while the service runs. Otherwise the container gets
+// a private network, with only a loopback interface.
+const withNetnsStr string = `#!/bin/sh
+netns=/var/run/netns/$1
+shift
+cmd=$1
+shift
+if [ -e "$netns" ]; then
+	exec "$cmd" --network-namespace-path="$netns" "$@"
+fi
+echo "$netns does not exist, running with a private network" >&2
+exec "$cmd" --private-network "$@"
+`
+func handleWithNetns() error {
+	p := filepath.Join(common.UtilsPath, "withnetns")
+	oldScript, _ := os.ReadFile(p)
+	if bytes.Equal(oldScript, []byte(withNetnsStr)) {
+		return nil
+	}
+	err := os.WriteFile(p, []byte(withNetnsStr), 0777)
+	if err != nil {
+		return CreateImageError.Wrap(err, "failed to write withnetns script")
+	}
+	return nil
+}
+
+// serviceNetns returns the network namespace a service runs in, or an
+// empty string if it uses the one of the host
+func serviceNetns(s cue.Service) string {
+	if s.Pod != "" {
+		return podNetns(s.Pod)
+	}
+	if s.Net.Private {
+		return "sloop-" + s.Name
+	}
+	return ""
+}
+
+// ephemeralCommand returns the command that runs args in a new container
+// of the image of the service, with its volumes and files
+func ephemeralCommand(t cue.Timer, s cue.Service, args []string) (string, error) {
+	if len(s.Instances) > 0 {
+		return "", CreateServiceError.New("timer %s cannot run an ephemeral container of %s, which is replicated", t.Name, s.Name)
+	}
+	serviceDir := filepath.Join(common.ServicePath, s.Name)
+	var cmd []string
+	if netns := serviceNetns(s); netns != "" {
+		cmd = append(cmd, filepath.Join(common.UtilsPath, "withnetns"), netns)
+	}
+	cmd = append(cmd,
+		"systemd-nspawn",
+		"--quiet",
+		"--volatile=overlay",
+		"--keep-unit",
+		"--register=no",
+		"--bind-ro=" + serviceDir + "/hosts:/etc/hosts",
+		"--bind=" + common.UtilsPath + "/catatonit:/catatonit",
+		"--oci-bundle=" + serviceDir,
+		"-M", s.Name + "-" + t.Name,
+		"--resolv-conf=bind-uplink",
+	)
+	// the specifier would be escaped by quoteLiteral
+	credsDir := "/run/credentials/" + t.Name + ".service"
+	for _, m := range serviceMounts(s) {
+		cmd = append(cmd, strings.ReplaceAll(m, "%d", credsDir))
+	}
+	cmd = append(cmd, "/catatonit", "--")
+	return strings.Join(lo.Map(cmd, func(a string, _ int) string {
+		return quoteLiteral(a)
+	}), " ") + " " + quoteArgs(args), nil
+}
+
+// timerServiceConf turns the actions of a timer into the commands of its
+// service unit
+func timerServiceConf(t cue.Timer, services map[string]cue.Service) (TimerServiceConf, error) {
+	conf := TimerServiceConf{
+		Name: t.Name,
+		Freeze: t.Freeze,
+		FreezeState: filepath.Join(common.FreezePath, t.Name),
+		UtilsPath: common.UtilsPath,
+		Credentials: make(map[string]string),
+	}
+	for _, r := range t.Run {
+		if r.Action != "exec" {
+			conf.Exec = append(conf.Exec, "systemctl " + r.Action + " " + strings.Join(r.Units, " "))
+			continue
+		}
+		if r.Container == "running" {
+			for _, u := range r.Units {
+				unit := strings.TrimSuffix(u, ".service")
+				conf.Exec = append(conf.Exec, common.UtilsPath + "/nsenter " + unit + " " + quoteArgs(r.Command))
+			}
+			continue
+		}
+		s, ok := services[strings.TrimSuffix(r.Service, ".service")]
+		if !ok {
+			return conf, CreateServiceError.New("timer %s runs unknown service %s", t.Name, r.Service)
+		}
+		cmd, err := ephemeralCommand(t, s, r.Command)
+		if err != nil {
+			return conf, err
+		}
+		for k, v := range fileCredentials(s, filepath.Join(common.ServicePath, s.Name)) {
+			conf.Credentials[k] = v
+		}
+		conf.Exec = append(conf.Exec, cmd)
+		conf.Delegate = true
+	}
+	return conf, nil
+}
@@ -0,0 +1,107 @@
+package systemd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+)
+
+// appliedServices returns the services of the configuration that was
+// last run, from the copy of their configuration in their directory
+func appliedServices() ([]cue.Service, error) {
+	dirs, err := os.ReadDir(common.ServicePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, FilesystemError.Wrap(err, "cannot list services")
+	}
+	var services []cue.Service
+	for _, d := range dirs {
+		b, err := os.ReadFile(filepath.Join(common.ServicePath, d.Name(), "conf.cue"))
+		if err != nil {
+			continue
+		}
+		var s cue.Service
+		err = json.Unmarshal(b, &s)
+		if err != nil {
+			return nil, FilesystemError.Wrap(err, "invalid configuration of service %s", d.Name())
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// VolumeConsumers returns the services that mount a volume, both in
+// config and in the configuration that is running, sorted by name
+func VolumeConsumers(config cue.Config, volume string) ([]cue.Service, error) {
+	applied, err := appliedServices()
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]cue.Service)
+	for _, s := range applied {
+		services[s.Name] = s
+	}
+	for n, s := range config.Services {
+		services[n] = s
+	}
+	consumers := lo.Filter(lo.Values(services), func(s cue.Service, _ int) bool {
+		return lo.ContainsBy(s.Image.Volumes, func(v cue.VolumeMapping) bool {
+			return v.Name == volume
+		})
+	})
+	sort.Slice(consumers, func(a, b int) bool {
+		return consumers[a].Name < consumers[b].Name
+	})
+	return consumers, nil
+}
+
+// StopServices stops the services and their sockets, so that they are
+// not started again by a connection. It returns the units that were
+// active, to start them again with StartUnits.
+func StopServices(systemd *dbus.Conn, services []cue.Service) ([]string, error) {
+	var units []string
+	for _, s := range services {
+		units = append(units, socketUnits(s)...)
+		units = append(units, s.Units()...)
+	}
+	if len(units) == 0 {
+		return nil, nil
+	}
+	statuses, err := systemd.ListUnitsByNamesContext(context.Background(), units)
+	if err != nil {
+		return nil, RuntimeServiceError.Wrap(err, "cannot list units")
+	}
+	var active []string
+	for _, st := range statuses {
+		if st.ActiveState != "active" {
+			continue
+		}
+		err = stopUnit(systemd, st.Name)
+		if err != nil {
+			return active, err
+		}
+		active = append(active, st.Name)
+	}
+	return active, nil
+}
+
+// StartUnits starts units, in reverse order
+func StartUnits(systemd *dbus.Conn, units []string) error {
+	for i := len(units) - 1; i >= 0; i-- {
+		err := startUnit(systemd, units[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
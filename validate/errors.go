@@ -0,0 +1,15 @@
+package validate
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	ValidateErrors = errorx.NewNamespace("validate")
+
+	ValidationError = ValidateErrors.NewType("rules")
+
+	// ViolationsProperty holds all the []Violation of a ValidationError,
+	// warnings included
+	ViolationsProperty = errorx.RegisterProperty("violations")
+)
@@ -0,0 +1,84 @@
+package validate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ProcRoot is where procfs is mounted, the routes of the host are read
+// from it
+var ProcRoot = "/proc"
+
+type route struct {
+	dev string
+	prefix netip.Prefix
+}
+
+// hostRoutes returns the network routes of the host. Default routes and
+// routes to single addresses, like the ones of routed interfaces, are
+// left out. Without procfs there are no routes.
+func hostRoutes() []route {
+	var routes []route
+	keep := func(dev string, prefix netip.Prefix) {
+		if dev == "lo" || prefix.Bits() == 0 || prefix.IsSingleIP() {
+			return
+		}
+		addr := prefix.Addr()
+		if addr.IsLinkLocalUnicast() || addr.IsMulticast() {
+			return
+		}
+		routes = append(routes, route{dev, prefix.Masked()})
+	}
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	readFields(filepath.Join(ProcRoot, "net", "route"), true, func(f []string) {
+		if len(f) < 8 {
+			return
+		}
+		dest, err1 := strconv.ParseUint(f[1], 16, 32)
+		mask, err2 := strconv.ParseUint(f[7], 16, 32)
+		if err1 != nil || err2 != nil {
+			return
+		}
+		// the addresses are in host order, which is little endian on
+		// all the architectures sloop runs on
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(dest))
+		keep(f[0], netip.PrefixFrom(netip.AddrFrom4(b), bits.OnesCount32(uint32(mask))))
+	})
+	// Destination PrefixLength Source SourcePrefixLength NextHop Metric
+	// RefCnt Use Flags Iface
+	readFields(filepath.Join(ProcRoot, "net", "ipv6_route"), false, func(f []string) {
+		if len(f) < 10 {
+			return
+		}
+		dest, err1 := hex.DecodeString(f[0])
+		length, err2 := strconv.ParseUint(f[1], 16, 8)
+		if err1 != nil || err2 != nil || len(dest) != 16 {
+			return
+		}
+		keep(f[9], netip.PrefixFrom(netip.AddrFrom16(*(*[16]byte)(dest)), int(length)))
+	})
+	return routes
+}
+
+func readFields(path string, header bool, line func(fields []string)) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if header {
+		scanner.Scan()
+	}
+	for scanner.Scan() {
+		line(strings.Fields(scanner.Text()))
+	}
+}
@@ -0,0 +1,384 @@
+package validate
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/common"
+	"yuri91/sloop/cue"
+	"yuri91/sloop/nft"
+)
+
+// ifnameLen is the maximum length of the name of a network device
+const ifnameLen = 15
+
+// UnitDirs are the directories where systemd looks for unit files
+var UnitDirs = []string{"/etc/systemd/system", "/run/systemd/system", "/usr/lib/systemd/system", "/lib/systemd/system"}
+
+// a host is a network namespace: a service, an instance of a replicated
+// service or a pod
+type host struct {
+	kind string
+	// owner is the name of the service or pod in the configuration
+	owner string
+	name string
+	// prefix is the prefix of the names of the interfaces on the host side
+	prefix string
+	net cue.Network
+}
+
+func serviceKind(s cue.Service) string {
+	if s.Job {
+		return "$job"
+	}
+	return "$service"
+}
+
+func hosts(conf cue.Config) []host {
+	var hs []host
+	for _, s := range conf.Services {
+		// the network of a pod belongs to the pod
+		if s.Pod != "" {
+			continue
+		}
+		if len(s.Instances) == 0 {
+			hs = append(hs, host{serviceKind(s), s.Name, s.Name, s.Name, s.Net})
+			continue
+		}
+		for _, i := range s.Instances {
+			name := cue.InstanceHost(s.Name, i.Name)
+			hs = append(hs, host{serviceKind(s), s.Name, name, name, i.Net})
+		}
+	}
+	for _, p := range conf.Pods {
+		hs = append(hs, host{"$pod", p.Name, p.Name, "pod-" + p.Name, p.Net})
+	}
+	sort.Slice(hs, func(a, b int) bool {
+		return hs[a].name < hs[b].name
+	})
+	return hs
+}
+
+func sortedInterfaces(net cue.Network) []*cue.Interface {
+	ifs := lo.Values(net.Interfaces)
+	sort.Slice(ifs, func(a, b int) bool {
+		return ifs[a].Name < ifs[b].Name
+	})
+	return ifs
+}
+
+func checkInterfaceNames(conf cue.Config) []finding {
+	var fs []finding
+	for _, b := range conf.Bridges {
+		if len(b.Name) > ifnameLen {
+			fs = append(fs, finding{"$bridge", b.Name, nil, fmt.Sprintf("bridge name %s is longer than %d characters", b.Name, ifnameLen)})
+		}
+	}
+	for _, h := range hosts(conf) {
+		for _, i := range sortedInterfaces(h.net) {
+			if len(i.Name) > ifnameLen {
+				fs = append(fs, finding{h.kind, h.owner, []string{h.name}, fmt.Sprintf("interface %s of %s is longer than %d characters", i.Name, h.name, ifnameLen)})
+			}
+		}
+	}
+	return fs
+}
+
+// checkHostInterfaceNames warns about the interfaces whose name on the
+// host is shortened with a hash, and so is hard to recognize
+func checkHostInterfaceNames(conf cue.Config) []finding {
+	var fs []finding
+	for _, h := range hosts(conf) {
+		for _, i := range sortedInterfaces(h.net) {
+			if name := h.prefix + "-" + i.Name; len(name) > ifnameLen {
+				fs = append(fs, finding{h.kind, h.owner, []string{h.name}, fmt.Sprintf("host side %s of interface %s of %s is longer than %d characters and is shortened with a hash", name, i.Name, h.name, ifnameLen)})
+			}
+		}
+	}
+	return fs
+}
+
+func checkDuplicateIps(conf cue.Config) []finding {
+	type user struct {
+		h host
+		iface string
+	}
+	// the addresses of every network, the ones of routed interfaces
+	// all end up in the routing table of the host
+	networks := map[string]map[string][]user{}
+	add := func(network string, ip string, u user) {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || addr.IsUnspecified() {
+			return
+		}
+		if networks[network] == nil {
+			networks[network] = map[string][]user{}
+		}
+		networks[network][addr.String()] = append(networks[network][addr.String()], u)
+	}
+	for _, b := range conf.Bridges {
+		bridge := host{kind: "$bridge", owner: b.Name, name: "bridge " + b.Name}
+		if b.Prefix != 0 {
+			add("bridge " + b.Name, b.Ip, user{bridge, ""})
+		}
+		if b.Prefix6 != 0 {
+			add("bridge " + b.Name, b.Ip6, user{bridge, ""})
+		}
+	}
+	for _, h := range hosts(conf) {
+		for _, i := range sortedInterfaces(h.net) {
+			network := "the host"
+			switch i.Type {
+			case "bridge":
+				network = "bridge " + i.Bridge.Name
+			case "macvlan", "ipvlan":
+				network = "the network of " + i.Parent
+			}
+			add(network, i.Ip, user{h, i.Name})
+			add(network, i.Ip6, user{h, i.Name})
+		}
+	}
+	var fs []finding
+	for network, addrs := range networks {
+		for addr, users := range addrs {
+			if len(users) < 2 {
+				continue
+			}
+			names := lo.Map(users, func(u user, _ int) string {
+				if u.iface == "" {
+					return u.h.name
+				}
+				return u.h.name + "." + u.iface
+			})
+			others := lo.Map(users[1:], func(u user, _ int) string { return u.h.name })
+			fs = append(fs, finding{users[0].h.kind, users[0].h.owner, append([]string{users[0].h.name}, others...), fmt.Sprintf("address %s is used by %s on %s", addr, strings.Join(names, ", "), network)})
+		}
+	}
+	return fs
+}
+
+func bridgePrefixes(b cue.Bridge) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, p := range []struct{ ip string; bits int }{{b.Ip, b.Prefix}, {b.Ip6, b.Prefix6}} {
+		if p.bits == 0 {
+			continue
+		}
+		if addr, err := netip.ParseAddr(p.ip); err == nil {
+			if prefix, err := addr.Prefix(p.bits); err == nil {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// checkBridgeOverlaps finds the bridges whose subnet overlaps the one of
+// another bridge or a route of the host, which would make part of the
+// network unreachable
+func checkBridgeOverlaps(conf cue.Config) []finding {
+	var fs []finding
+	bridges := lo.Values(conf.Bridges)
+	sort.Slice(bridges, func(a, b int) bool {
+		return bridges[a].Name < bridges[b].Name
+	})
+	routes := hostRoutes()
+	for n, b := range bridges {
+		for _, prefix := range bridgePrefixes(b) {
+			for _, o := range bridges[n+1:] {
+				for _, other := range bridgePrefixes(o) {
+					if prefix.Overlaps(other) {
+						fs = append(fs, finding{"$bridge", b.Name, []string{o.Name}, fmt.Sprintf("subnet %s of bridge %s overlaps subnet %s of bridge %s", prefix, b.Name, other, o.Name)})
+					}
+				}
+			}
+			for _, r := range routes {
+				// the routes of the bridges, from a previous run
+				if _, ok := conf.Bridges[r.dev]; ok {
+					continue
+				}
+				if prefix.Overlaps(r.prefix) {
+					fs = append(fs, finding{"$bridge", b.Name, nil, fmt.Sprintf("subnet %s of bridge %s overlaps route %s of %s", prefix, b.Name, r.prefix, r.dev)})
+					break
+				}
+			}
+		}
+	}
+	return fs
+}
+
+// unitExists returns true if a unit file for unit is installed. For an
+// instance of a template, the template is enough.
+func unitExists(unit string) bool {
+	names := []string{unit}
+	if at := strings.Index(unit, "@"); at >= 0 {
+		names = append(names, unit[:at+1] + filepath.Ext(unit))
+	}
+	for _, dir := range UnitDirs {
+		for _, n := range names {
+			if _, err := os.Stat(filepath.Join(dir, n)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sloopUnits are the units created by sloop for conf
+func sloopUnits(conf cue.Config) map[string]bool {
+	units := map[string]bool{"sloop.target": true, "sloop.slice": true}
+	for _, s := range conf.Services {
+		for _, u := range append(s.Units(), s.UnitFile()) {
+			units[u] = true
+		}
+		for _, sock := range s.Sockets {
+			units[s.Name + "-" + sock.Name + ".socket"] = true
+		}
+	}
+	for _, b := range conf.Bridges {
+		units["sloop-bridge-" + b.Name + ".service"] = true
+	}
+	for _, p := range conf.Pods {
+		units["sloop-pod-" + p.Name + ".service"] = true
+	}
+	for _, t := range conf.Timers {
+		units[t.Name + ".service"] = true
+		units[t.Name + ".timer"] = true
+	}
+	return units
+}
+
+// checkDependencies finds the required units that do not exist, which
+// would prevent the service from starting. Missing wanted units and
+// orderings are ignored by systemd.
+func checkDependencies(conf cue.Config) []finding {
+	// without systemd, as when checking in CI, nothing can be said
+	if !lo.SomeBy(UnitDirs, func(d string) bool { _, err := os.Stat(d); return err == nil }) {
+		return nil
+	}
+	units := sloopUnits(conf)
+	unitLink := func(u string) bool {
+		_, err := os.Stat(filepath.Join(common.UnitPath, u))
+		return err == nil
+	}
+	var fs []finding
+	for _, s := range conf.Services {
+		for _, r := range s.Requires {
+			if !units[r] && !unitLink(r) && !unitExists(r) {
+				fs = append(fs, finding{serviceKind(s), s.Name, nil, fmt.Sprintf("%s requires unit %s, which does not exist", s.Name, r)})
+			}
+		}
+	}
+	return fs
+}
+
+// unitOwners returns the service every unit of a service belongs to
+func unitOwners(conf cue.Config) map[string]string {
+	owners := map[string]string{}
+	for _, s := range conf.Services {
+		for _, u := range s.Units() {
+			owners[u] = s.Name
+		}
+	}
+	return owners
+}
+
+// checkCycles finds the cycles in the ordering of the services, which
+// systemd breaks by not starting some of them
+func checkCycles(conf cue.Config) []finding {
+	owners := unitOwners(conf)
+	edges := map[string][]string{}
+	for _, s := range conf.Services {
+		for _, a := range s.After {
+			if o, ok := owners[a]; ok && !lo.Contains(edges[s.Name], o) {
+				edges[s.Name] = append(edges[s.Name], o)
+			}
+		}
+		sort.Strings(edges[s.Name])
+	}
+	names := lo.Keys(conf.Services)
+	sort.Strings(names)
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	var stack []string
+	var fs []finding
+	var visit func(n string)
+	visit = func(n string) {
+		state[n] = visiting
+		stack = append(stack, n)
+		for _, m := range edges[n] {
+			switch state[m] {
+			case unvisited:
+				visit(m)
+			case visiting:
+				cycle := append(stack[lo.IndexOf(stack, m):], m)
+				s := conf.Services[m]
+				fs = append(fs, finding{serviceKind(s), m, cycle, fmt.Sprintf("dependency cycle %s", strings.Join(cycle, " -> "))})
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[n] = done
+	}
+	for _, n := range names {
+		if state[n] == unvisited {
+			visit(n)
+		}
+	}
+	return fs
+}
+
+// checkTimers finds timers that act on a running service which is never
+// started, since it is not enabled
+func checkTimers(conf cue.Config) []finding {
+	owners := unitOwners(conf)
+	var fs []finding
+	for _, t := range conf.Timers {
+		for _, r := range t.Run {
+			s := conf.Services[strings.TrimSuffix(r.Service, ".service")]
+			if s.Name == "" || s.Enable {
+				continue
+			}
+			if r.Action == "reload" || (r.Action == "exec" && r.Container == "running") {
+				fs = append(fs, finding{"$timer", t.Name, []string{s.Name}, fmt.Sprintf("timer %s runs %s on service %s, which is not enabled", t.Name, r.Action, s.Name)})
+			}
+		}
+		// replicated services have a unit for every instance
+		frozen := lo.Uniq(lo.FilterMap(t.Freeze, func(u string, _ int) (string, bool) {
+			o, ok := owners[u]
+			return o, ok
+		}))
+		for _, n := range frozen {
+			if !conf.Services[n].Enable {
+				fs = append(fs, finding{"$timer", t.Name, []string{n}, fmt.Sprintf("timer %s freezes service %s, which is not enabled", t.Name, n)})
+			}
+		}
+	}
+	return fs
+}
+
+// checkPolicies finds the rules of the policies of the bridges that
+// cannot be turned into firewall rules, which would make the apply
+// fail after the services are created
+func checkPolicies(conf cue.Config) []finding {
+	var fs []finding
+	for b := range conf.Policies {
+		for _, err := range nft.CheckPolicy(conf, b) {
+			msg := err.Error()
+			if errx, ok := err.(*errorx.Error); ok {
+				msg = errx.Message()
+			}
+			fs = append(fs, finding{"$bridge", b, nil, msg})
+		}
+	}
+	return fs
+}
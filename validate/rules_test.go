@@ -0,0 +1,280 @@
+package validate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/samber/lo"
+)
+
+// fakeHost points ProcRoot and UnitDirs to a fake host, with the given
+// files relative to its root. The units of the host are in etc/systemd/system.
+func fakeHost(t *testing.T, files map[string]string) {
+	root := t.TempDir()
+	units := filepath.Join(root, "etc", "systemd", "system")
+	if err := os.MkdirAll(units, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for p, content := range files {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldProc, oldUnits := ProcRoot, UnitDirs
+	ProcRoot = filepath.Join(root, "proc")
+	UnitDirs = []string{units}
+	t.Cleanup(func() { ProcRoot, UnitDirs = oldProc, oldUnits })
+}
+
+// load validates the configuration src
+func load(t *testing.T, src string) ([]Violation, error) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.cue"), []byte("package main\n" + src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, violations, err := Load(dir)
+	return violations, err
+}
+
+// messages returns the messages of the violations of rule
+func messages(violations []Violation, rule string) []string {
+	return lo.FilterMap(violations, func(v Violation, _ int) (string, bool) {
+		return v.Message, v.Rule == rule
+	})
+}
+
+const br0 = `$bridge: br0: {ip: "10.0.0.1", prefix: 24}
+`
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name string
+		src string
+		// the files of the host
+		host map[string]string
+		rule string
+		want []string
+	}{
+		{
+			name: "long bridge name",
+			src: `$bridge: averyverylongbridge: {ip: "10.1.0.1", prefix: 24}`,
+			rule: "interface-name-length",
+			want: []string{"bridge name averyverylongbridge is longer than 15 characters"},
+		},
+		{
+			name: "long interface name",
+			src: br0 + `$service: web: {image: from: "nginx", net: ifs: averyverylonglink: {type: "bridge", bridge: $bridge.br0}}`,
+			rule: "interface-name-length",
+			want: []string{"interface averyverylonglink of web is longer than 15 characters"},
+		},
+		{
+			name: "short names",
+			src: br0 + `$service: web: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br0}}`,
+			rule: "interface-name-length",
+		},
+		{
+			name: "long host side",
+			src: br0 + `$service: frontend: {image: from: "nginx", net: ifs: internal: {type: "bridge", bridge: $bridge.br0}}`,
+			rule: "host-interface-name",
+			want: []string{"host side frontend-internal of interface internal of frontend is longer than 15 characters and is shortened with a hash"},
+		},
+		{
+			name: "long host side of an instance",
+			src: br0 + `$service: webapp: {image: from: "nginx", replicas: 2, net: ifs: internal: {type: "bridge", bridge: $bridge.br0}}`,
+			rule: "host-interface-name",
+			want: []string{
+				"host side webapp-0-internal of interface internal of webapp-0 is longer than 15 characters and is shortened with a hash",
+				"host side webapp-1-internal of interface internal of webapp-1 is longer than 15 characters and is shortened with a hash",
+			},
+		},
+		{
+			name: "same address on a bridge",
+			src: br0 + `$service: a: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br0, ip: "10.0.0.5"}}
+$service: b: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br0, ip: "10.0.0.5"}}`,
+			rule: "duplicate-ip",
+			want: []string{"address 10.0.0.5 is used by a.eth0, b.eth0 on bridge br0"},
+		},
+		{
+			name: "address of the bridge",
+			src: br0 + `$service: a: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br0, ip: "10.0.0.1"}}`,
+			rule: "duplicate-ip",
+			want: []string{"address 10.0.0.1 is used by bridge br0, a.eth0 on bridge br0"},
+		},
+		{
+			name: "same address on different bridges",
+			src: br0 + `$bridge: br1: {ip: "10.0.0.1", prefix: 24}
+$service: a: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br0, ip: "10.0.0.5"}}
+$service: b: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br1, ip: "10.0.0.5"}}`,
+			rule: "duplicate-ip",
+		},
+		{
+			name: "overlapping bridges",
+			src: br0 + `$bridge: br1: {ip: "10.0.0.129", prefix: 25}`,
+			rule: "bridge-subnet-overlap",
+			want: []string{"subnet 10.0.0.0/24 of bridge br0 overlaps subnet 10.0.0.128/25 of bridge br1"},
+		},
+		{
+			name: "route of the host",
+			src: br0,
+			host: map[string]string{
+				"proc/net/route": "Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\tMTU\tWindow\tIRTT\n" +
+					"eth0\t00000000\t0100000A\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+					"eth0\t0000000A\t00000000\t0001\t0\t0\t100\t0000FFFF\t0\t0\t0\n",
+			},
+			rule: "bridge-subnet-overlap",
+			want: []string{"subnet 10.0.0.0/24 of bridge br0 overlaps route 10.0.0.0/16 of eth0"},
+		},
+		{
+			name: "IPv6 route of the host",
+			src: `$bridge: br0: {ip6: "fd00:1::1", prefix6: 64}`,
+			host: map[string]string{
+				"proc/net/ipv6_route": "fd000001000000000000000000000000 20 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001 eth0\n",
+			},
+			rule: "bridge-subnet-overlap",
+			want: []string{"subnet fd00:1::/64 of bridge br0 overlaps route fd00:1::/32 of eth0"},
+		},
+		{
+			name: "route of the bridge itself",
+			src: br0,
+			host: map[string]string{
+				"proc/net/route": "Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\tMTU\tWindow\tIRTT\n" +
+					"br0\t0000000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+			},
+			rule: "bridge-subnet-overlap",
+		},
+		{
+			name: "missing required unit",
+			src: `$service: web: {image: from: "nginx", requires: ["missing.service", "present.service", "other@x.service"]}`,
+			host: map[string]string{
+				"etc/systemd/system/present.service": "",
+				"etc/systemd/system/other@.service": "",
+			},
+			rule: "unknown-dependency",
+			want: []string{"web requires unit missing.service, which does not exist"},
+		},
+		{
+			name: "required unit of sloop",
+			src: `$service: db: image: from: "postgres"
+$service: web: {image: from: "nginx", requires: ["db.service", "sloop.target"]}`,
+			rule: "unknown-dependency",
+		},
+		{
+			name: "ordering cycle",
+			src: `$service: a: {image: from: "nginx", after: ["b.service"]}
+$service: b: {image: from: "nginx", after: ["c.service"]}
+$service: c: {image: from: "nginx", after: ["a.service"]}`,
+			rule: "dependency-cycle",
+			want: []string{"dependency cycle a -> b -> c -> a"},
+		},
+		{
+			name: "ordering on an instance",
+			src: `$service: a: {image: from: "nginx", after: ["b@0.service"]}
+$service: b: {image: from: "nginx", replicas: 2, after: ["a.service"]}`,
+			rule: "dependency-cycle",
+			want: []string{"dependency cycle a -> b -> a"},
+		},
+		{
+			name: "ordering without cycles",
+			src: `$service: a: {image: from: "nginx", after: ["b.service"]}
+$service: b: {image: from: "nginx", after: ["c.service"]}
+$service: c: image: from: "nginx"`,
+			rule: "dependency-cycle",
+		},
+		{
+			name: "timer on a disabled service",
+			src: `$service: web: {image: from: "nginx", enable: false}
+$timer: t: {run: [{service: $service.web, action: "reload"}, {service: $service.web, action: "restart"}], onCalendar: ["daily"], freeze: [$service.web]}`,
+			rule: "timer-disabled-service",
+			want: []string{
+				"timer t freezes service web, which is not enabled",
+				"timer t runs reload on service web, which is not enabled",
+			},
+		},
+		{
+			name: "timer on an enabled service",
+			src: `$service: web: image: from: "nginx"
+$timer: t: {run: [{service: $service.web, action: "reload"}], onCalendar: ["daily"], freeze: [$service.web]}`,
+			rule: "timer-disabled-service",
+		},
+		{
+			name: "policy with an unknown service",
+			src: br0 + `$service: web: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br0}}
+$bridge: br0: policy: allow: [{from: "web", to: "db", port: 5432}]`,
+			rule: "bridge-policy",
+			want: []string{"policy of bridge br0 refers to service db, which does not exist"},
+		},
+		{
+			name: "egress rules with egress allowed",
+			src: br0 + `$bridge: br0: policy: egressAllow: [{to: "192.0.2.0/24"}]`,
+			rule: "bridge-policy",
+			want: []string{"policy of bridge br0 has egress rules, but its egress is not \"deny\""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeHost(t, test.host)
+			violations, err := load(t, test.src)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if got := messages(violations, test.rule); !reflect.DeepEqual(got, test.want) && len(got) + len(test.want) > 0 {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	fakeHost(t, nil)
+	violations, err := load(t, br0 + `$service: a: {image: from: "nginx", net: ifs: averyverylonglink: {type: "bridge", bridge: $bridge.br0, ip: "10.0.0.5"}}
+$service: b: {image: from: "nginx", net: ifs: eth0: {type: "bridge", bridge: $bridge.br0, ip: "10.0.0.5"}}
+$service: c: {image: from: "nginx", net: ifs: averyverylonglink: {type: "bridge", bridge: $bridge.br0}}
+$validation: "duplicate-ip": severity: "warning"
+$validation: "interface-name-length": ignore: ["a*"]
+$validation: "host-interface-name": severity: "off"
+$validation: "no-such-rule": {}`)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	got := lo.Map(violations, func(v Violation, _ int) string {
+		return v.Severity + " " + v.Rule + ": " + v.Message
+	})
+	want := []string{
+		"error validation: unknown rule no-such-rule",
+		"error interface-name-length: interface averyverylonglink of c is longer than 15 characters",
+		"warning duplicate-ip: address 10.0.0.5 is used by a.averyverylonglink, b.eth0 on bridge br0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	for _, v := range violations {
+		if !v.Pos.IsValid() || filepath.Base(v.Pos.Filename()) != "main.cue" {
+			t.Errorf("violation %q is at %v", v.Message, v.Pos)
+		}
+	}
+	if err := Error(violations); err == nil || !strings.Contains(err.Error(), "2 errors") {
+		t.Errorf("expected 2 errors, got %v", err)
+	}
+}
+
+func TestReferenceCycle(t *testing.T) {
+	fakeHost(t, nil)
+	_, err := load(t, `$service: a: {image: from: "nginx", after: [$service.b]}
+$service: b: {image: from: "nginx", after: [$service.a]}`)
+	if !errorx.IsOfType(err, ValidationError) {
+		t.Fatalf("expected a ValidationError, got %+v", err)
+	}
+	violations, _ := errorx.ExtractProperty(err, ViolationsProperty)
+	got := messages(violations.([]Violation), "dependency-cycle")
+	if len(got) != 1 || !strings.HasPrefix(got[0], "dependency cycle a -> b") {
+		t.Errorf("expected a dependency cycle, got %q", got)
+	}
+}
@@ -0,0 +1,225 @@
+package validate
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	cuelang "cuelang.org/go/cue"
+	cueerrors "cuelang.org/go/cue/errors"
+	"cuelang.org/go/cue/token"
+	"github.com/joomcode/errorx"
+	"github.com/samber/lo"
+
+	"yuri91/sloop/cue"
+)
+
+// A Rule checks the configuration for a problem that CUE cannot see,
+// because it needs the whole configuration or the state of the host
+type Rule struct {
+	Name string
+	// Severity is "error" or "warning", it can be changed in $validation
+	Severity string
+	check func(conf cue.Config) []finding
+}
+
+// a finding is a violation of a rule, before its severity is known
+type finding struct {
+	// Kind and Name are the field of the configuration the finding
+	// is about, like "$service" and "web"
+	Kind string
+	Name string
+	// Others are the other names involved, a finding is ignored if any
+	// of them is in the ignore list of the rule
+	Others []string
+	Message string
+}
+
+// A Violation is a finding of a rule, with its severity
+type Violation struct {
+	Rule string
+	Severity string
+	Message string
+	Pos token.Pos
+}
+
+// Rules are all the rules, in the order they run
+var Rules = []Rule{
+	{"interface-name-length", "error", checkInterfaceNames},
+	{"host-interface-name", "warning", checkHostInterfaceNames},
+	{"duplicate-ip", "error", checkDuplicateIps},
+	{"bridge-subnet-overlap", "error", checkBridgeOverlaps},
+	{"unknown-dependency", "error", checkDependencies},
+	{"dependency-cycle", "error", checkCycles},
+	{"timer-disabled-service", "error", checkTimers},
+	{"bridge-policy", "error", checkPolicies},
+}
+
+// Run runs the rules on conf, with the severities and the suppressions
+// of $validation. value is the configuration the positions are taken from.
+func Run(value cuelang.Value, conf cue.Config) []Violation {
+	var violations []Violation
+	names := lo.Keys(conf.Validation)
+	sort.Strings(names)
+	for _, name := range names {
+		if !lo.ContainsBy(Rules, func(r Rule) bool { return r.Name == name }) {
+			violations = append(violations, Violation{
+				Rule: "validation",
+				Severity: "error",
+				Message: fmt.Sprintf("unknown rule %s", name),
+				Pos: userPos(value.LookupPath(cuelang.MakePath(cuelang.Str("$validation"), cuelang.Str(name)))),
+			})
+		}
+	}
+	for _, r := range Rules {
+		severity, ignore := r.Severity, []string{}
+		if c, ok := conf.Validation[r.Name]; ok {
+			if c.Severity != "" {
+				severity = c.Severity
+			}
+			ignore = c.Ignore
+		}
+		if severity == "off" {
+			continue
+		}
+		findings := r.check(conf)
+		sort.SliceStable(findings, func(a, b int) bool {
+			return findings[a].Message < findings[b].Message
+		})
+		for _, f := range findings {
+			names := append([]string{f.Name}, f.Others...)
+			if lo.SomeBy(names, func(n string) bool { return ignored(ignore, n) }) {
+				continue
+			}
+			violations = append(violations, Violation{r.Name, severity, f.Message, locate(value, f.Kind, f.Name)})
+		}
+	}
+	return violations
+}
+
+// ignored returns true if name matches one of the patterns of ignore,
+// which are shell patterns like "web-*"
+func ignored(ignore []string, name string) bool {
+	return lo.SomeBy(ignore, func(pattern string) bool {
+		ok, err := filepath.Match(pattern, name)
+		return err == nil && ok
+	})
+}
+
+// locate returns the position of the entry of kind with the given name
+func locate(value cuelang.Value, kind string, name string) token.Pos {
+	if kind == "" {
+		return token.NoPos
+	}
+	iter, err := value.LookupPath(cuelang.MakePath(cuelang.Str(kind))).Fields()
+	if err != nil {
+		return token.NoPos
+	}
+	for iter.Next() {
+		n, err := iter.Value().LookupPath(cuelang.ParsePath("name")).String()
+		if err == nil && n == name {
+			return userPos(iter.Value())
+		}
+	}
+	return token.NoPos
+}
+
+// userPos returns the position of v in the configuration, rather than
+// in the schema of sloop
+func userPos(v cuelang.Value) token.Pos {
+	for _, c := range v.Split() {
+		if pos := c.Pos(); pos.IsValid() && !strings.HasPrefix(pos.Filename(), "sloop_") {
+			return pos
+		}
+	}
+	return v.Pos()
+}
+
+// Error returns a ValidationError if some of violations are errors
+func Error(violations []Violation) error {
+	errors := lo.CountBy(violations, func(v Violation) bool { return v.Severity == "error" })
+	if errors == 0 {
+		return nil
+	}
+	return ValidationError.New("%d errors in validation", errors).WithProperty(ViolationsProperty, violations)
+}
+
+// Load reads the configuration in path and validates it. The error is
+// only about reading the configuration: the caller decides what to do
+// with the violations, for example with Error.
+func Load(path string) (*cue.Config, []Violation, error) {
+	value, err := cue.GetCueConfig(path)
+	if err != nil {
+		if v, ok := referenceCycle(err); ok {
+			return nil, nil, Error([]Violation{v})
+		}
+		return nil, nil, err
+	}
+	conf, err := cue.GetGoConfig(*value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conf, Run(*value, *conf), nil
+}
+
+// referenceCycle turns the structural cycle that CUE reports when
+// services refer to each other, like a: after: [$service.b] and
+// b: after: [$service.a], into a violation of dependency-cycle. The
+// services are found by following the path of the error, which goes
+// through the references.
+func referenceCycle(err error) (Violation, bool) {
+	errx, ok := err.(*errorx.Error)
+	if !ok {
+		return Violation{}, false
+	}
+	v, ok := errx.Property(cue.ValueProperty)
+	if !ok {
+		return Violation{}, false
+	}
+	root := v.(cuelang.Value)
+	for _, e := range cueerrors.Errors(errx.Cause()) {
+		format, _ := e.Msg()
+		path := e.Path()
+		if format != "structural cycle" || len(path) < 2 {
+			continue
+		}
+		cycle := []string{unquote(path[1])}
+		var pos token.Pos
+		current := root.LookupPath(cuelang.MakePath(cuelang.Str(unquote(path[0])), cuelang.Str(cycle[0])))
+		for _, p := range path[2:] {
+			sel := cuelang.Str(unquote(p))
+			if i, err := strconv.Atoi(p); err == nil {
+				sel = cuelang.Index(i)
+			}
+			current = current.LookupPath(cuelang.MakePath(sel))
+			_, ref := current.ReferencePath()
+			sels := ref.Selectors()
+			if len(sels) != 2 || !strings.HasPrefix(sels[0].String(), "$") {
+				continue
+			}
+			if !pos.IsValid() {
+				pos = userPos(current)
+			}
+			cycle = append(cycle, unquote(sels[1].String()))
+		}
+		if len(cycle) < 2 {
+			continue
+		}
+		return Violation{
+			Rule: "dependency-cycle",
+			Severity: "error",
+			Message: fmt.Sprintf("dependency cycle %s", strings.Join(cycle, " -> ")),
+			Pos: pos,
+		}, true
+	}
+	return Violation{}, false
+}
+
+func unquote(label string) string {
+	if s, err := strconv.Unquote(label); err == nil {
+		return s
+	}
+	return label
+}
@@ -0,0 +1,315 @@
+package volume
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+// An archive is a compressed tar file, with the metadata as first entry
+// and the content of the volume in the data directory
+
+const metadataName = "sloop-volume.json"
+const dataDir = "data"
+
+type Metadata struct {
+	Volume string `json:"volume"`
+	Created time.Time `json:"created"`
+	// Snapshot is the driver used to take the snapshot that was archived
+	Snapshot string `json:"snapshot"`
+	// Services are the services that used the volume
+	Services []string `json:"services"`
+	Compression string `json:"compression"`
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func compressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, ArchiveError.Wrap(err, "cannot create zstd writer")
+		}
+		return zw, nil
+	case "none":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, ArchiveError.New("unknown compression %s", compression)
+}
+
+// decompressor detects the compression from the first bytes
+func decompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, RestoreError.Wrap(err, "invalid gzip archive")
+		}
+		return gr, nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, RestoreError.Wrap(err, "invalid zstd archive")
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// Write archives the directory dir to w
+func Write(w io.Writer, dir string, meta Metadata) error {
+	cw, err := compressor(w, meta.Compression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	metaB, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return ArchiveError.Wrap(err, "cannot marshal metadata")
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name: metadataName,
+		Mode: 0644,
+		Size: int64(len(metaB)),
+		ModTime: meta.Created,
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(metaB)
+	}
+	if err != nil {
+		return ArchiveError.Wrap(err, "cannot write metadata")
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode() & fs.ModeSocket != 0 {
+			return nil
+		}
+		link := ""
+		if info.Mode() & fs.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(dataDir, rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return ArchiveError.Wrap(err, "cannot archive %s", dir)
+	}
+	err = tw.Close()
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		return ArchiveError.Wrap(err, "cannot finish archive of %s", dir)
+	}
+	return nil
+}
+
+func readMetadata(tr *tar.Reader) (*Metadata, error) {
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != metadataName {
+		return nil, RestoreError.New("not a sloop volume archive")
+	}
+	var meta Metadata
+	err = json.NewDecoder(tr).Decode(&meta)
+	if err != nil {
+		return nil, RestoreError.Wrap(err, "invalid metadata")
+	}
+	return &meta, nil
+}
+
+// ReadMetadata reads the metadata of the archive in r
+func ReadMetadata(r io.Reader) (*Metadata, error) {
+	dr, err := decompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	return readMetadata(tar.NewReader(dr))
+}
+
+// checkPath fails if a component of name below dir is a symbolic link,
+// since an entry could then be written outside dir through a link made
+// by an earlier entry. The components that do not exist yet are fine.
+func checkPath(dir string, name string) error {
+	p := dir
+	for _, c := range strings.Split(name, string(filepath.Separator)) {
+		if c == "." {
+			continue
+		}
+		p = filepath.Join(p, c)
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode() & fs.ModeSymlink != 0 {
+			return RestoreError.New("%s is a symbolic link", p)
+		}
+	}
+	return nil
+}
+
+// Extract extracts the archive in r to the empty directory dir
+func Extract(r io.Reader, dir string) (*Metadata, error) {
+	dr, err := decompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	meta, err := readMetadata(tr)
+	if err != nil {
+		return nil, err
+	}
+	// directories are created before their content, so their times
+	// are set at the end
+	type dirTime struct {
+		path string
+		time time.Time
+	}
+	var dirs []dirTime
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, RestoreError.Wrap(err, "cannot read archive")
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if name == dataDir {
+			name = "."
+		} else if strings.HasPrefix(name, dataDir + string(filepath.Separator)) {
+			name = strings.TrimPrefix(name, dataDir + string(filepath.Separator))
+		} else {
+			return nil, RestoreError.New("unexpected entry %s in archive", hdr.Name)
+		}
+		if err = checkPath(dir, name); err != nil {
+			return nil, RestoreError.Wrap(err, "unsafe entry %s in archive", hdr.Name)
+		}
+		p := filepath.Join(dir, name)
+		mode := fs.FileMode(hdr.Mode) & fs.ModePerm
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0700)
+			dirs = append(dirs, dirTime{p, hdr.ModTime})
+		case tar.TypeReg:
+			var f *os.File
+			f, err = os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|unix.O_NOFOLLOW, 0600)
+			if err == nil {
+				_, err = io.Copy(f, tr)
+				f.Close()
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, p)
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			err = mknod(p, hdr)
+		default:
+			continue
+		}
+		if err == nil {
+			err = os.Lchown(p, hdr.Uid, hdr.Gid)
+		}
+		if err == nil && hdr.Typeflag != tar.TypeSymlink {
+			// after chown, which clears the setuid and setgid bits
+			err = os.Chmod(p, mode | fileModeBits(hdr.Mode))
+		}
+		if err == nil && hdr.Typeflag == tar.TypeReg {
+			err = os.Chtimes(p, hdr.ModTime, hdr.ModTime)
+		}
+		if err != nil {
+			return nil, RestoreError.Wrap(err, "cannot extract %s", hdr.Name)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].time, dirs[i].time)
+	}
+	return meta, nil
+}
+
+func mknod(p string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	}
+	return unix.Mknod(p, mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+}
+
+// fileModeBits converts the special bits of a tar mode
+func fileModeBits(mode int64) fs.FileMode {
+	m := fs.FileMode(0)
+	if mode & 01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	if mode & 02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode & 04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	return m
+}
@@ -0,0 +1,98 @@
+package volume
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testArchive returns a volume archive with entries
+func testArchive(t *testing.T, entries []*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	meta := []byte(`{"volume": "data"}`)
+	tw.WriteHeader(&tar.Header{Name: metadataName, Mode: 0600, Size: int64(len(meta)), Typeflag: tar.TypeReg})
+	tw.Write(meta)
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write(make([]byte, hdr.Size))
+		}
+	}
+	tw.Close()
+	return &buf
+}
+
+func TestExtractRejectsWritesThroughSymlinks(t *testing.T) {
+	cases := map[string][]*tar.Header{
+		"file in linked directory": {
+			{Name: "data/escape", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "data/escape/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+		"file over link": {
+			{Name: "data/evil", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE/evil"},
+			{Name: "data/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+		"directory over link": {
+			{Name: "data/escape", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "data/escape", Typeflag: tar.TypeDir, Mode: 0777},
+		},
+		"parent escape": {
+			{Name: "data/../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+	}
+	for name, entries := range cases {
+		t.Run(name, func(t *testing.T) {
+			outside := t.TempDir()
+			os.Chmod(outside, 0700)
+			dir := t.TempDir()
+			for _, hdr := range entries {
+				if hdr.Typeflag == tar.TypeSymlink {
+					hdr.Linkname = filepath.Join(outside, filepath.Base(hdr.Linkname))
+					if filepath.Base(hdr.Linkname) == "OUTSIDE" {
+						hdr.Linkname = outside
+					}
+				}
+				hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+			}
+			_, err := Extract(testArchive(t, entries), dir)
+			if err == nil {
+				t.Fatal("malicious archive extracted without errors")
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "evil")); err == nil {
+				t.Fatal("file written outside the volume")
+			}
+			info, _ := os.Stat(outside)
+			if info.Mode().Perm() != 0700 {
+				t.Fatalf("permissions of outside changed to %o", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	entries := []*tar.Header{
+		{Name: "data", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "data/sub", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "data/sub/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "sub/file"},
+	}
+	for _, hdr := range entries {
+		hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+	}
+	meta, err := Extract(testArchive(t, entries), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Volume != "data" {
+		t.Fatalf("volume is %s", meta.Volume)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+}
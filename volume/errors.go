@@ -0,0 +1,16 @@
+package volume
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	VolumeErrors = errorx.NewNamespace("volume")
+
+	SnapshotError = VolumeErrors.NewType("snapshot")
+	ArchiveError = VolumeErrors.NewType("archive")
+	RestoreError = VolumeErrors.NewType("restore")
+	NotFoundError = VolumeErrors.NewType("not_found")
+	InUseError = VolumeErrors.NewType("in_use")
+	FilesystemError = VolumeErrors.NewType("filesystem")
+)
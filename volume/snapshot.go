@@ -0,0 +1,242 @@
+package volume
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A Snapshot is a copy of a volume that does not change while it is
+// archived, so that the services using the volume can be started again
+// right after it is taken
+type Snapshot struct {
+	// Path is the directory with the content of the volume
+	Path string
+	Driver string
+	remove func() error
+}
+
+// Remove deletes the snapshot
+func (s *Snapshot) Remove() error {
+	if s.remove == nil {
+		return nil
+	}
+	return s.remove()
+}
+
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", SnapshotError.Wrap(err, "%s %s failed: %s", name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Detect returns the driver that can snapshot path: "btrfs" if it is a
+// subvolume, "lvm" if it is on a logical volume, or "" if there is none
+func Detect(path string) string {
+	if _, err := run("btrfs", "subvolume", "show", path); err == nil {
+		return "btrfs"
+	}
+	if _, err := lvmOrigin(path); err == nil {
+		return "lvm"
+	}
+	return ""
+}
+
+// Take snapshots the volume in path with driver, which is one of "btrfs",
+// "lvm", "copy" or "none". With "none" the volume itself is archived.
+func Take(driver string, path string) (*Snapshot, error) {
+	switch driver {
+	case "btrfs":
+		return btrfsSnapshot(path)
+	case "lvm":
+		return lvmSnapshot(path)
+	case "copy":
+		return copySnapshot(path)
+	case "none":
+		return &Snapshot{Path: path, Driver: driver}, nil
+	}
+	return nil, SnapshotError.New("unknown snapshot driver %s", driver)
+}
+
+// snapshotPath is next to the volume, so that it is on the same filesystem
+func snapshotPath(path string, suffix string) string {
+	return filepath.Join(filepath.Dir(path), "." + filepath.Base(path) + "." + suffix)
+}
+
+func btrfsSnapshot(path string) (*Snapshot, error) {
+	dst := snapshotPath(path, "snapshot")
+	_, err := run("btrfs", "subvolume", "snapshot", "-r", path, dst)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		Path: dst,
+		Driver: "btrfs",
+		remove: func() error {
+			_, err := run("btrfs", "subvolume", "delete", dst)
+			return err
+		},
+	}, nil
+}
+
+type lvmVolume struct {
+	// Mountpoint is where the logical volume is mounted
+	Mountpoint string
+	Fstype string
+	Group string
+	Name string
+	Thin bool
+}
+
+// lvmOrigin returns the logical volume that contains path
+func lvmOrigin(path string) (*lvmVolume, error) {
+	out, err := run("findmnt", "-n", "-o", "SOURCE,TARGET,FSTYPE", "--target", path)
+	if err != nil {
+		return nil, err
+	}
+	mnt := strings.Fields(out)
+	if len(mnt) != 3 {
+		return nil, SnapshotError.New("unexpected findmnt output %q", out)
+	}
+	out, err = run("lvs", "--noheadings", "-o", "vg_name,lv_name,segtype", mnt[0])
+	if err != nil {
+		return nil, err
+	}
+	lv := strings.Fields(out)
+	if len(lv) != 3 {
+		return nil, SnapshotError.New("unexpected lvs output %q", out)
+	}
+	return &lvmVolume{mnt[1], mnt[2], lv[0], lv[1], lv[2] == "thin"}, nil
+}
+
+func lvmSnapshot(path string) (*Snapshot, error) {
+	origin, err := lvmOrigin(path)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(origin.Mountpoint, path)
+	if err != nil {
+		return nil, SnapshotError.Wrap(err, "cannot find %s in %s", path, origin.Mountpoint)
+	}
+	name := origin.Name + "-sloop-" + filepath.Base(path)
+	args := []string{"--snapshot", "--name", name}
+	if origin.Thin {
+		args = append(args, "--setactivationskip", "n")
+	} else {
+		args = append(args, "--extents", "20%ORIGIN")
+	}
+	_, err = run("lvcreate", append(args, origin.Group + "/" + origin.Name)...)
+	if err != nil {
+		return nil, err
+	}
+	removeLv := func() error {
+		_, err := run("lvremove", "-y", origin.Group + "/" + name)
+		return err
+	}
+	mnt, err := os.MkdirTemp("", "sloop-snapshot-")
+	if err != nil {
+		removeLv()
+		return nil, SnapshotError.Wrap(err, "cannot create mount point for snapshot of %s", path)
+	}
+	opts := "ro"
+	if origin.Fstype == "xfs" {
+		// the snapshot has the same uuid as its origin
+		opts += ",nouuid"
+	}
+	_, err = run("mount", "-o", opts, "/dev/" + origin.Group + "/" + name, mnt)
+	if err != nil {
+		os.Remove(mnt)
+		removeLv()
+		return nil, err
+	}
+	return &Snapshot{
+		Path: filepath.Join(mnt, rel),
+		Driver: "lvm",
+		remove: func() error {
+			_, err := run("umount", mnt)
+			if err != nil {
+				return err
+			}
+			os.Remove(mnt)
+			return removeLv()
+		},
+	}, nil
+}
+
+func copySnapshot(path string) (*Snapshot, error) {
+	dst := snapshotPath(path, "copy")
+	err := os.RemoveAll(dst)
+	if err != nil {
+		return nil, SnapshotError.Wrap(err, "cannot remove old copy %s", dst)
+	}
+	_, err = run("cp", "-a", "--reflink=auto", path, dst)
+	if err != nil {
+		os.RemoveAll(dst)
+		return nil, err
+	}
+	return &Snapshot{
+		Path: dst,
+		Driver: "copy",
+		remove: func() error {
+			err := os.RemoveAll(dst)
+			if err != nil {
+				return SnapshotError.Wrap(err, "cannot remove copy %s", dst)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// CreateDir creates an empty directory in path, which is a btrfs subvolume
+// if like is one too
+func CreateDir(path string, like string) error {
+	if _, err := run("btrfs", "subvolume", "show", like); err == nil {
+		_, err = run("btrfs", "subvolume", "create", path)
+		return err
+	}
+	err := os.Mkdir(path, 0755)
+	if err != nil {
+		return FilesystemError.Wrap(err, "cannot create %s", path)
+	}
+	return nil
+}
+
+// RemoveDir removes the directory in path, deleting it as a subvolume if
+// it is one
+func RemoveDir(path string) error {
+	if _, err := run("btrfs", "subvolume", "show", path); err == nil {
+		_, err = run("btrfs", "subvolume", "delete", path)
+		return err
+	}
+	err := os.RemoveAll(path)
+	if err != nil {
+		return FilesystemError.Wrap(err, "cannot remove %s", path)
+	}
+	return nil
+}
+
+// Size returns the total size of the files in dir
+func Size(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, FilesystemError.Wrap(err, "cannot compute size of %s", dir)
+	}
+	return size, nil
+}